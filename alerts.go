@@ -0,0 +1,292 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	AlertPending  string = "pending"
+	AlertFiring   string = "firing"
+	AlertResolved string = "resolved"
+)
+
+var (
+	ErrorInvalidRule error = errors.New("Invalid Alert Rule")
+)
+
+// An alert rule, in the "alerts" of the configuration. The rule applies
+// to the services listed, or to all services.
+type AlertRule struct {
+	Name     string   `json:"name"`
+	Expr     string   `json:"expr"`
+	Services []string `json:"services,omitempty"`
+}
+
+// State of a rule for a service, as returned by Alert.List. Since is the
+// time the condition started to hold, Value that of its left side when
+// last evaluated.
+type AlertState struct {
+	Rule    string    `json:"rule"`
+	Service string    `json:"service"`
+	Expr    string    `json:"expr"`
+	State   string    `json:"state"`
+	Value   float64   `json:"value"`
+	Since   time.Time `json:"since"`
+	Fired   time.Time `json:"fired,omitempty"`
+}
+
+// Data of "alert" events, when an alert fires or is resolved
+type AlertEvent struct {
+	AlertState
+	Time time.Time `json:"time"`
+}
+
+// Alerts evaluates the alert rules against the stats of services, as
+// they are collected.
+type Alerts struct {
+	context *ServiceContext
+	mutex   sync.Mutex
+
+	// rules, parsed from the configuration
+	config *Config
+	rules  []*alertRule
+
+	// last stats of each service, for rates
+	samples map[string]*alertSample
+
+	// pending and firing alerts, by rule and service
+	states map[[2]string]*AlertState
+}
+
+type alertRule struct {
+	AlertRule
+	expr     *Expr
+	services map[string]bool
+}
+
+type alertSample struct {
+	time   time.Time
+	values map[string]float64
+}
+
+// ----------------------------------------------------------------------------
+//
+// AlertRule Methods
+//
+// ----------------------------------------------------------------------------
+
+// parse the expression of the rule
+func (self *AlertRule) parse() (*alertRule, error) {
+	if self.Name == "" {
+		return nil, fmt.Errorf("%s: missing name", ErrorInvalidRule.Error())
+	}
+	expr, err := ParseExpr(self.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", self.Name, err.Error())
+	}
+
+	rule := &alertRule{AlertRule: *self, expr: expr}
+	if len(self.Services) > 0 {
+		rule.services = map[string]bool{}
+		for _, id := range self.Services {
+			rule.services[id] = true
+		}
+	}
+	return rule, nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Alerts Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewAlerts(context *ServiceContext) *Alerts {
+	return &Alerts{
+		context: context,
+		samples: map[string]*alertSample{},
+		states:  map[[2]string]*AlertState{},
+	}
+}
+
+// List the pending and firing alerts
+func (self *Alerts) List(req *http.Request, args *struct{}, res *[]AlertState) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	alerts := []AlertState{}
+	for _, state := range self.states {
+		alerts = append(alerts, *state)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Service < alerts[j].Service
+	})
+
+	*res = alerts
+	return nil
+}
+
+// Rules lists the configured alert rules
+func (self *Alerts) Rules(req *http.Request, args *struct{}, res *[]AlertRule) error {
+	rules := []AlertRule{}
+	if config := self.context.currentConfig(); config != nil {
+		rules = append(rules, config.Alerts...)
+	}
+	*res = rules
+	return nil
+}
+
+// evaluate the rules against the stats of a service, nil if they could not
+// be collected.
+//
+// Alerts are left as they are while they cannot be decided, when the stats
+// could not be collected or lack a stat of the rule; rates then span the
+// gap, from the last sample.
+func (self *Alerts) evaluate(serviceId string, t time.Time, stats *service.Stats) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.load()
+
+	if stats == nil {
+		return
+	}
+
+	env := &exprEnv{values: map[string]float64{}}
+	for _, m := range stats.Metrics {
+		env.values[m.Key()] = m.Value
+	}
+	if last, exists := self.samples[serviceId]; exists {
+		env.previous = last.values
+		env.elapsed = t.Sub(last.time).Seconds()
+	}
+	self.samples[serviceId] = &alertSample{time: t, values: env.values}
+
+	for _, rule := range self.rules {
+		if rule.services != nil && !rule.services[serviceId] {
+			continue
+		}
+
+		key := [2]string{rule.Name, serviceId}
+		state, exists := self.states[key]
+		holds, value, ok := rule.expr.eval(env)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case holds && !exists:
+			state = &AlertState{
+				Rule:    rule.Name,
+				Service: serviceId,
+				Expr:    rule.Expr,
+				State:   AlertPending,
+				Value:   value,
+				Since:   t,
+			}
+			self.states[key] = state
+		case holds:
+			state.Value = value
+		case exists:
+			delete(self.states, key)
+			if state.State == AlertFiring {
+				state.State = AlertResolved
+				self.emit(state, t)
+			}
+			continue
+		default:
+			continue
+		}
+
+		if state.State == AlertPending && t.Sub(state.Since) >= rule.expr.For {
+			state.State = AlertFiring
+			state.Fired = t
+			self.emit(state, t)
+		}
+	}
+}
+
+// load the rules of the configuration, if it changed. Alerts of rules
+// which no longer exist are resolved.
+func (self *Alerts) load() {
+
+	config := self.context.currentConfig()
+	if config == self.config {
+		return
+	}
+	self.config = config
+
+	self.rules = []*alertRule{}
+	names := map[string]bool{}
+	if config != nil {
+		for _, r := range config.Alerts {
+			rule, err := r.parse()
+			if err != nil {
+				log.Printf("error: alerts: %s\n", err.Error())
+				continue
+			}
+			self.rules = append(self.rules, rule)
+			names[rule.Name] = true
+		}
+	}
+
+	for key, state := range self.states {
+		if !names[key[0]] {
+			self.drop(key, state)
+		}
+	}
+}
+
+// forget the alerts of a service removed, or stopped, resolving those
+// firing
+func (self *Alerts) forget(serviceId string) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.samples, serviceId)
+	for key, state := range self.states {
+		if key[1] == serviceId {
+			self.drop(key, state)
+		}
+	}
+}
+
+// drop an alert, resolving it if firing
+func (self *Alerts) drop(key [2]string, state *AlertState) {
+	delete(self.states, key)
+	if state.State == AlertFiring {
+		state.State = AlertResolved
+		self.emit(state, time.Now())
+	}
+}
+
+// emit an "alert" event
+func (self *Alerts) emit(state *AlertState, t time.Time) {
+	log.Printf("info: alert: %s: %s %s (%g)\n", state.Rule, state.Service, state.State, state.Value)
+	sendEvent(self.context.SendEventMessage, "alert", &AlertEvent{AlertState: *state, Time: t})
+}
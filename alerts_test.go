@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// alertStats returns stats of gauges
+func alertStats(values map[string]float64) *service.Stats {
+	stats := &service.Stats{}
+	for name, value := range values {
+		stats.Add(service.Metric{Name: name, Kind: service.Gauge, Value: value})
+	}
+	return stats
+}
+
+// newTestAlerts returns alerts of `rules`, and the states of the "alert"
+// events they emit
+func newTestAlerts(t *testing.T, rules ...AlertRule) (*Alerts, func() []string) {
+	ctx := newTestContext(t)
+	ctx.SetConfig(&Config{Alerts: rules})
+
+	var mutex sync.Mutex
+	events := []string{}
+	ctx.SendEventMessage = func(data, event, id string) {
+		var e AlertEvent
+		json.Unmarshal([]byte(data), &e)
+		mutex.Lock()
+		events = append(events, e.Rule+" "+e.State)
+		mutex.Unlock()
+	}
+
+	alerts := NewAlerts(ctx)
+	return alerts, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		all := events
+		events = []string{}
+		return all
+	}
+}
+
+// alertState returns the state of an alert, "" if it is not pending or
+// firing
+func alertState(alerts *Alerts, rule string, serviceId string) string {
+	var list []AlertState
+	alerts.List(nil, &struct{}{}, &list)
+	for _, alert := range list {
+		if alert.Rule == rule && alert.Service == serviceId {
+			return alert.State
+		}
+	}
+	return ""
+}
+
+func TestAlertsFor(t *testing.T) {
+	alerts, events := newTestAlerts(t, AlertRule{Name: "high", Expr: "a > 1 for 1m"})
+	start := time.Now()
+
+	steps := []struct {
+		after  time.Duration
+		stats  *service.Stats
+		state  string
+		events []string
+	}{
+		{0, alertStats(map[string]float64{"a": 2}), AlertPending, nil},
+		{30 * time.Second, alertStats(map[string]float64{"a": 3}), AlertPending, nil},
+		// a gap does not fire a pending alert, nor reset it
+		{60 * time.Second, nil, AlertPending, nil},
+		{75 * time.Second, alertStats(map[string]float64{"a": 2}), AlertFiring, []string{"high firing"}},
+		// nor resolve a firing one
+		{90 * time.Second, nil, AlertFiring, nil},
+		{105 * time.Second, alertStats(map[string]float64{"b": 1}), AlertFiring, nil},
+		{120 * time.Second, alertStats(map[string]float64{"a": 0}), "", []string{"high resolved"}},
+		// the duration starts over
+		{135 * time.Second, alertStats(map[string]float64{"a": 2}), AlertPending, nil},
+	}
+
+	for _, step := range steps {
+		alerts.evaluate("svc", start.Add(step.after), step.stats)
+		if state := alertState(alerts, "high", "svc"); state != step.state {
+			t.Fatalf("%s: %q, expected %q", step.after, state, step.state)
+		}
+		if got := events(); len(got) != len(step.events) || (len(got) > 0 && got[0] != step.events[0]) {
+			t.Fatalf("%s: events %v, expected %v", step.after, got, step.events)
+		}
+	}
+}
+
+// Rates span the samples which could not be collected
+func TestAlertsRate(t *testing.T) {
+	alerts, _ := newTestAlerts(t, AlertRule{Name: "errors", Expr: "rate(err) > 1/s", Services: []string{"svc"}})
+	start := time.Now()
+
+	alerts.evaluate("svc", start, alertStats(map[string]float64{"err": 100}))
+	alerts.evaluate("other", start, alertStats(map[string]float64{"err": 100}))
+	if state := alertState(alerts, "errors", "svc"); state != "" {
+		t.Fatalf("first sample: %q", state)
+	}
+
+	alerts.evaluate("svc", start.Add(15*time.Second), nil)
+	alerts.evaluate("svc", start.Add(30*time.Second), alertStats(map[string]float64{"err": 160}))
+	alerts.evaluate("other", start.Add(30*time.Second), alertStats(map[string]float64{"err": 160}))
+	if state := alertState(alerts, "errors", "svc"); state != AlertFiring {
+		t.Fatalf("rate of 2/s: %q", state)
+	}
+	if state := alertState(alerts, "errors", "other"); state != "" {
+		t.Fatalf("other service: %q", state)
+	}
+
+	// a reset counter counts from zero
+	alerts.evaluate("svc", start.Add(45*time.Second), alertStats(map[string]float64{"err": 10}))
+	if state := alertState(alerts, "errors", "svc"); state != "" {
+		t.Fatalf("rate after reset: %q", state)
+	}
+}
+
+// Alerts of services stopped through minion are resolved, and fire again
+// once they are started
+func TestAlertsStopped(t *testing.T) {
+	alerts, events := newTestAlerts(t, AlertRule{Name: "busy", Expr: "requests > 0"})
+	ctx := alerts.context
+	ctx.Alerts = alerts
+	ctx.Metrics = NewMetrics(ctx)
+	id := "svc"
+
+	startService(t, ctx, id, testService)
+	events()
+	ctx.Metrics.collect()
+	if state := alertState(alerts, "busy", id); state != AlertFiring {
+		t.Fatalf("running: %q", state)
+	}
+
+	var jobId string
+	if err := ctx.Stop(nil, &id, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, jobId)
+	events()
+	ctx.Metrics.collect()
+	if state := alertState(alerts, "busy", id); state != "" {
+		t.Fatalf("stopped: %q", state)
+	}
+	if got := events(); len(got) != 1 || got[0] != "busy resolved" {
+		t.Fatalf("stopped: events %v", got)
+	}
+
+	if err := ctx.Start(nil, &id, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, jobId)
+	events()
+	ctx.Metrics.collect()
+	if got := events(); len(got) != 1 || got[0] != "busy firing" {
+		t.Fatalf("started: events %v", got)
+	}
+}
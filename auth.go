@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	handlers "github.com/gorilla/handlers"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleReader
+	RoleOperator
+	RoleAdmin
+)
+
+const (
+	AuthToken string = "token"
+	AuthHMAC  string = "hmac"
+	AuthCert  string = "cert"
+)
+
+const (
+	// maximum size of a request body
+	authMaxBody int64 = 1 << 20
+
+	// maximum clock skew of HMAC signed requests
+	authMaxSkew time.Duration = 5 * time.Minute
+)
+
+var (
+	ErrorUnauthenticated  error = errors.New("Authentication Required")
+	ErrorInvalidToken     error = errors.New("Invalid Token")
+	ErrorInvalidHMAC      error = errors.New("Invalid Request Signature")
+	ErrorExpiredHMAC      error = errors.New("Expired Request Signature")
+	ErrorUnknownCert      error = errors.New("Unknown Client Certificate")
+	ErrorUnknownAuth      error = errors.New("Unknown Authentication Mode")
+	ErrorPermissionDenied error = errors.New("Permission Denied")
+	ErrorBodyTooLarge     error = errors.New("Request Body Too Large")
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleReader:   "reader",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+// Role required by each RPC method. Unlisted methods require RoleAdmin.
+var methodRoles = map[string]Role{
+	"Service.List":         RoleReader,
+	"Service.Exists":       RoleReader,
+	"Service.Status":       RoleReader,
+	"Service.Stats":        RoleReader,
+	"Service.StatsReport":  RoleReader,
+	"Service.StatsHistory": RoleReader,
+	"Service.Health":       RoleReader,
+	"Service.Start":        RoleOperator,
+	"Service.Stop":         RoleOperator,
+	"Service.Configure":    RoleOperator,
+	"Service.Install":      RoleAdmin,
+	"Service.Remove":       RoleAdmin,
+	"Service.Upgrade":      RoleAdmin,
+	"Job.Get":              RoleReader,
+	"Job.List":             RoleReader,
+	"Job.Wait":             RoleReader,
+	"Job.Cancel":           RoleOperator,
+	"Alert.List":           RoleReader,
+	"Alert.Rules":          RoleReader,
+	"Fleet.Nodes":          RoleReader,
+	"Fleet.Stats":          RoleReader,
+	"Fleet.Start":          RoleOperator,
+	"Fleet.Stop":           RoleOperator,
+	"Fleet.Restart":        RoleOperator,
+	"Fleet.Roll":           RoleOperator,
+	"Fleet.Install":        RoleAdmin,
+	"Fleet.Add":            RoleAdmin,
+	"Fleet.Remove":         RoleAdmin,
+}
+
+// An authenticated client
+type Principal struct {
+	Name string
+	Role Role
+}
+
+// An Authenticator identifies the principal of a request.
+// It returns nil, nil if the request carries none of its credentials.
+type Authenticator interface {
+	Authenticate(req *http.Request, body []byte) (*Principal, error)
+}
+
+// Auth checks the principal of requests against the role they require.
+// Without authenticators, all requests are allowed.
+type Auth struct {
+	mutex          sync.RWMutex
+	authenticators []Authenticator
+}
+
+// Bearer tokens, from etc/tokens: "<token> <role> <name>" per line
+type tokenAuthenticator struct {
+	tokens map[string]*Principal
+}
+
+// HMAC signed requests, from etc/hmac.keys: "<key> <secret> <role>" per line.
+//
+// Requests carry X-Minion-Key, X-Minion-Timestamp (unix seconds) and
+// X-Minion-Signature, the hex HMAC-SHA256 of
+// "<http method>\n<path>\n<timestamp>\n<body>".
+type hmacAuthenticator struct {
+	secrets map[string][]byte
+	roles   map[string]Role
+}
+
+// key of the body read by readBody, in the request context
+type bodyKey struct{}
+
+// Verified TLS client certificates, from etc/certs.roles:
+// "<common name> <role>" per line
+type certAuthenticator struct {
+	roles map[string]Role
+}
+
+// ----------------------------------------------------------------------------
+//
+// Role Methods
+//
+// ----------------------------------------------------------------------------
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if n == name {
+			return r, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role: %s", name)
+}
+
+// methodRole returns the role required to call an RPC method
+func methodRole(method string) Role {
+	if role, exists := methodRoles[method]; exists {
+		return role
+	}
+	return RoleAdmin
+}
+
+// ----------------------------------------------------------------------------
+//
+// Auth Methods
+//
+// ----------------------------------------------------------------------------
+
+// LoadAuth loads the authenticators for `modes`, any of "token", "hmac"
+// and "cert", from files under etc/.
+func LoadAuth(modes []string) (*Auth, error) {
+
+	auth := &Auth{}
+	etcPath := filepath.Join(rootPath, "etc")
+
+	for _, mode := range modes {
+		var a Authenticator
+		var err error
+
+		switch strings.TrimSpace(mode) {
+		case "":
+			continue
+		case AuthToken:
+			a, err = loadTokens(filepath.Join(etcPath, "tokens"))
+		case AuthHMAC:
+			a, err = loadHMAC(filepath.Join(etcPath, "hmac.keys"))
+		case AuthCert:
+			a, err = loadCertRoles(filepath.Join(etcPath, "certs.roles"))
+		default:
+			err = fmt.Errorf("%s: %s", ErrorUnknownAuth.Error(), mode)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		auth.authenticators = append(auth.authenticators, a)
+	}
+
+	return auth, nil
+}
+
+// Enabled reports whether requests are authenticated
+func (self *Auth) Enabled() bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return len(self.authenticators) > 0
+}
+
+// Replace the authenticators with those of `other`
+func (self *Auth) Replace(other *Auth) {
+	other.mutex.RLock()
+	authenticators := other.authenticators
+	other.mutex.RUnlock()
+
+	self.mutex.Lock()
+	self.authenticators = authenticators
+	self.mutex.Unlock()
+}
+
+// authenticate returns the principal of the request
+func (self *Auth) authenticate(req *http.Request, body []byte) (*Principal, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for _, a := range self.authenticators {
+		principal, err := a.Authenticate(req, body)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+	return nil, ErrorUnauthenticated
+}
+
+// Handler wraps `handler`, requiring the role of the RPC method called if
+// `rpc` is set, RoleReader otherwise. The principal is recorded as the user
+// of the request, and denials are written to `accessLog`.
+func (self *Auth) Handler(accessLog io.Writer, handler http.Handler, rpc bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if !self.Enabled() {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		req, body, err := readBody(req)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+
+		required := RoleReader
+		method := ""
+		if rpc {
+			method = rpcMethod(body)
+			required = methodRole(method)
+		}
+
+		principal, err := self.authenticate(req, body)
+		if err != nil {
+			log.Printf("error: auth: denied %s %s: %s\n", req.RemoteAddr, method, err.Error())
+			deny(accessLog, w, req, http.StatusUnauthorized, err)
+			return
+		}
+
+		req.URL.User = url.User(principal.Name)
+
+		if principal.Role < required {
+			log.Printf("error: auth: denied %s (%s) %s: requires %s\n", principal.Name, principal.Role, method, required)
+			deny(accessLog, w, req, http.StatusForbidden, ErrorPermissionDenied)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// deny the request, writing it to the access log
+func deny(accessLog io.Writer, w http.ResponseWriter, req *http.Request, status int, err error) {
+	handlers.CombinedLoggingHandler(accessLog, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="minion"`)
+		}
+		http.Error(w, err.Error(), status)
+	})).ServeHTTP(w, req)
+}
+
+// readBody reads the body of a request, of at most authMaxBody bytes. The
+// body is kept by the returned request, so handlers it is passed to read
+// it once.
+func readBody(req *http.Request) (*http.Request, []byte, error) {
+
+	if body, ok := req.Context().Value(bodyKey{}).([]byte); ok {
+		return req, body, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, authMaxBody+1))
+	if err != nil {
+		return req, nil, err
+	}
+	if int64(len(body)) > authMaxBody {
+		return req, nil, ErrorBodyTooLarge
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), bodyKey{}, body))
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return req, body, nil
+}
+
+// bodyError writes the error of readBody
+func bodyError(w http.ResponseWriter, err error) {
+	if err == ErrorBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// rpcMethod returns the method of a JSON-RPC request body
+func rpcMethod(body []byte) string {
+	var call struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal(body, &call)
+	return call.Method
+}
+
+// ----------------------------------------------------------------------------
+//
+// Authenticator Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *tokenAuthenticator) Authenticate(req *http.Request, body []byte) (*Principal, error) {
+
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	for t, principal := range self.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return principal, nil
+		}
+	}
+	return nil, ErrorInvalidToken
+}
+
+func (self *hmacAuthenticator) Authenticate(req *http.Request, body []byte) (*Principal, error) {
+
+	key := req.Header.Get("X-Minion-Key")
+	if key == "" {
+		return nil, nil
+	}
+
+	secret, exists := self.secrets[key]
+	if !exists {
+		return nil, ErrorInvalidHMAC
+	}
+
+	timestamp := req.Header.Get("X-Minion-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrorInvalidHMAC
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > authMaxSkew || skew < -authMaxSkew {
+		return nil, ErrorExpiredHMAC
+	}
+
+	signature, err := hex.DecodeString(req.Header.Get("X-Minion-Signature"))
+	if err != nil {
+		return nil, ErrorInvalidHMAC
+	}
+
+	if !hmac.Equal(signature, signHMAC(secret, req.Method, req.URL.Path, timestamp, body)) {
+		return nil, ErrorInvalidHMAC
+	}
+
+	return &Principal{Name: key, Role: self.roles[key]}, nil
+}
+
+// signHMAC computes the signature of a request
+func signHMAC(secret []byte, method string, path string, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, path, timestamp)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (self *certAuthenticator) Authenticate(req *http.Request, body []byte) (*Principal, error) {
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+
+	name := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	role, exists := self.roles[name]
+	if !exists {
+		return nil, ErrorUnknownCert
+	}
+
+	return &Principal{Name: name, Role: role}, nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Loaders
+//
+// ----------------------------------------------------------------------------
+
+// readFields reads whitespace separated fields of each line of a file,
+// skipping blank lines and comments
+func readFields(file string, n int) ([][]string, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < n {
+			return nil, fmt.Errorf("%s:%d: expected %d fields", file, i, n)
+		}
+		lines = append(lines, fields)
+	}
+	return lines, scanner.Err()
+}
+
+func loadTokens(file string) (*tokenAuthenticator, error) {
+
+	lines, err := readFields(file, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &tokenAuthenticator{tokens: map[string]*Principal{}}
+	for _, fields := range lines {
+		role, err := parseRole(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		a.tokens[fields[0]] = &Principal{Name: fields[2], Role: role}
+	}
+	return a, nil
+}
+
+func loadHMAC(file string) (*hmacAuthenticator, error) {
+
+	lines, err := readFields(file, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &hmacAuthenticator{secrets: map[string][]byte{}, roles: map[string]Role{}}
+	for _, fields := range lines {
+		role, err := parseRole(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		a.secrets[fields[0]] = []byte(fields[1])
+		a.roles[fields[0]] = role
+	}
+	return a, nil
+}
+
+func loadCertRoles(file string) (*certAuthenticator, error) {
+
+	lines, err := readFields(file, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &certAuthenticator{roles: map[string]Role{}}
+	for _, fields := range lines {
+		role, err := parseRole(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		a.roles[fields[0]] = role
+	}
+	return a, nil
+}
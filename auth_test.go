@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeEtc writes a file of etc/, under the test root
+func writeEtc(t *testing.T, name string, data string) {
+	t.Helper()
+
+	file := filepath.Join(rootPath, "etc", name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signedRequest returns a request signed with the HMAC key "ops"
+func signedRequest(t *testing.T, url string, body []byte) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Minion-Key", "ops")
+	req.Header.Set("X-Minion-Timestamp", timestamp)
+	req.Header.Set("X-Minion-Signature", hex.EncodeToString(signHMAC([]byte("secret"), "POST", req.URL.Path, timestamp, body)))
+	return req
+}
+
+// Bodies are read whole, once, by the auth and metrics handlers; bodies
+// over the limit are rejected rather than truncated.
+func TestAuthBodyLimit(t *testing.T) {
+	ctx := newTestContext(t)
+	writeEtc(t, "hmac.keys", "ops secret admin\n")
+
+	auth, err := LoadAuth([]string{AuthHMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := -1
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received = len(body)
+	})
+	server := httptest.NewServer(auth.Handler(ioutil.Discard, NewMetrics(ctx).Handler(echo), true))
+	defer server.Close()
+
+	// a JSON-RPC call padded to the limit
+	call := []byte(`{"method":"Service.List","params":[{}],"id":1}`)
+	body := append(call, bytes.Repeat([]byte(" "), int(authMaxBody)-len(call))...)
+
+	res, err := http.DefaultClient.Do(signedRequest(t, server.URL+"/rpc", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || received != len(body) {
+		t.Fatalf("body at limit: %s, received %d of %d bytes", res.Status, received, len(body))
+	}
+
+	received = -1
+	body = append(body, ' ')
+	res, err = http.DefaultClient.Do(signedRequest(t, server.URL+"/rpc", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge || received != -1 {
+		t.Fatalf("body over limit: %s, received %d bytes", res.Status, received)
+	}
+}
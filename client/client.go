@@ -0,0 +1,417 @@
+// Package client is a Go client of minion's JSON-RPC API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jsonrpc "github.com/gorilla/rpc/v2/json"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// defaults of new clients
+	DefaultTimeout time.Duration = 30 * time.Second
+	DefaultRetries int           = 3
+	DefaultBackoff time.Duration = 500 * time.Millisecond
+
+	// longest wait of a single Job.Wait call, in seconds
+	jobWaitMax int = 8
+)
+
+var (
+	ErrorJobFailed error = errors.New("Job Failed")
+)
+
+// Client of a minion.
+//
+// Calls of methods which do not change state are retried on transport
+// errors and 502, 503 and 504 responses, with exponential backoff.
+type Client struct {
+	// URL of the RPC endpoint, as http://localhost:9090/rpc
+	URL string
+
+	// Bearer token, if set
+	Token string
+
+	// HMAC key and secret, if set
+	Key    string
+	Secret string
+
+	// timeout of each call, unless the context has an earlier deadline
+	Timeout time.Duration
+
+	// retries of idempotent calls, and the backoff before the first retry
+	Retries int
+	Backoff time.Duration
+
+	HTTPClient *http.Client
+}
+
+// An error returned by minion, either by the RPC method or as an HTTP
+// error status.
+type Error struct {
+	Method     string
+	StatusCode int
+	Message    string
+}
+
+// Methods which do not change state, and can be retried
+var idempotent = map[string]bool{
+	"Service.List":         true,
+	"Service.Exists":       true,
+	"Service.Status":       true,
+	"Service.Stats":        true,
+	"Service.StatsReport":  true,
+	"Service.StatsHistory": true,
+	"Service.Health":       true,
+	"Job.Get":              true,
+	"Job.List":             true,
+	"Job.Wait":             true,
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// New returns a client of the minion at `host`, either host:port or an
+// http(s):// URL.
+func New(host string) *Client {
+	endpoint := "http://" + host + "/rpc"
+	if strings.Contains(host, "://") {
+		endpoint = strings.TrimSuffix(host, "/") + "/rpc"
+	}
+
+	return &Client{
+		URL:        endpoint,
+		Timeout:    DefaultTimeout,
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// Error Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *Error) Error() string {
+	return fmt.Sprintf("%s: %s", self.Method, self.Message)
+}
+
+// retryable reports whether the error is a temporary HTTP error
+func (self *Error) retryable() bool {
+	switch self.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// Service Methods
+//
+// ----------------------------------------------------------------------------
+
+// List the installed services
+func (self *Client) List(ctx context.Context) (map[string]*ServiceInstall, error) {
+	var res map[string]*ServiceInstall
+	err := self.Call(ctx, "Service.List", &struct{}{}, &res)
+	return res, err
+}
+
+// Install a service. Returns the id of the install job.
+func (self *Client) Install(ctx context.Context, svc *ServiceInstall) (string, error) {
+	var res string
+	err := self.Call(ctx, "Service.Install", svc, &res)
+	return res, err
+}
+
+// Remove a service. Returns the id of the remove job.
+func (self *Client) Remove(ctx context.Context, serviceId string) (string, error) {
+	var res string
+	err := self.Call(ctx, "Service.Remove", &serviceId, &res)
+	return res, err
+}
+
+// Exists checks whether a service is installed
+func (self *Client) Exists(ctx context.Context, serviceId string) (bool, error) {
+	var res bool
+	err := self.Call(ctx, "Service.Exists", &serviceId, &res)
+	return res, err
+}
+
+// Status of a service
+func (self *Client) Status(ctx context.Context, serviceId string) (*ServiceStatus, error) {
+	var res ServiceStatus
+	if err := self.Call(ctx, "Service.Status", &serviceId, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Start a service. Returns the id of the start job.
+func (self *Client) Start(ctx context.Context, serviceId string) (string, error) {
+	var res string
+	err := self.Call(ctx, "Service.Start", &serviceId, &res)
+	return res, err
+}
+
+// Stop a service. Returns the id of the stop job.
+func (self *Client) Stop(ctx context.Context, serviceId string) (string, error) {
+	var res string
+	err := self.Call(ctx, "Service.Stop", &serviceId, &res)
+	return res, err
+}
+
+// Stats of a service
+func (self *Client) Stats(ctx context.Context, serviceId string) (Stats, error) {
+	var res Stats
+	err := self.Call(ctx, "Service.Stats", &serviceId, &res)
+	return res, err
+}
+
+// StatsReport of a service, the stats with their kinds, units and labels
+func (self *Client) StatsReport(ctx context.Context, serviceId string) (*StatsReport, error) {
+	var res StatsReport
+	if err := self.Call(ctx, "Service.StatsReport", &serviceId, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// StatsHistory returns the recorded stats of a service
+func (self *Client) StatsHistory(ctx context.Context, args *StatsHistoryArgs) (*StatsHistory, error) {
+	var res StatsHistory
+	if err := self.Call(ctx, "Service.StatsHistory", args, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Health of a service
+func (self *Client) Health(ctx context.Context, serviceId string) (*HealthReport, error) {
+	var res HealthReport
+	if err := self.Call(ctx, "Service.Health", &serviceId, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Configure a service. Returns the id of the configure job.
+func (self *Client) Configure(ctx context.Context, args *ServiceConfigure) (string, error) {
+	var res string
+	err := self.Call(ctx, "Service.Configure", args, &res)
+	return res, err
+}
+
+// Upgrade a service. Returns the id of the upgrade job.
+func (self *Client) Upgrade(ctx context.Context, args *ServiceUpgrade) (string, error) {
+	var res string
+	err := self.Call(ctx, "Service.Upgrade", args, &res)
+	return res, err
+}
+
+// ----------------------------------------------------------------------------
+//
+// Job Methods
+//
+// ----------------------------------------------------------------------------
+
+// Job returns a job
+func (self *Client) Job(ctx context.Context, jobId string) (*JobInfo, error) {
+	var res JobInfo
+	if err := self.Call(ctx, "Job.Get", &jobId, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Jobs lists the retained jobs
+func (self *Client) Jobs(ctx context.Context) ([]JobInfo, error) {
+	var res []JobInfo
+	err := self.Call(ctx, "Job.List", &struct{}{}, &res)
+	return res, err
+}
+
+// CancelJob cancels a running job
+func (self *Client) CancelJob(ctx context.Context, jobId string) error {
+	var res bool
+	return self.Call(ctx, "Job.Cancel", &jobId, &res)
+}
+
+// Wait for a job to finish, until the context is done. Returns
+// ErrorJobFailed, with the job, if it did not succeed.
+func (self *Client) Wait(ctx context.Context, jobId string) (*JobInfo, error) {
+	for {
+		var res JobInfo
+		if err := self.Call(ctx, "Job.Wait", &jobWait{Id: jobId, Timeout: jobWaitMax}, &res); err != nil {
+			return nil, err
+		}
+		if res.Finished() {
+			if res.State != JobSucceeded {
+				return &res, ErrorJobFailed
+			}
+			return &res, nil
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// Alert Methods
+//
+// ----------------------------------------------------------------------------
+
+// Alerts lists the pending and firing alerts
+func (self *Client) Alerts(ctx context.Context) ([]AlertState, error) {
+	var res []AlertState
+	err := self.Call(ctx, "Alert.List", &struct{}{}, &res)
+	return res, err
+}
+
+// AlertRules lists the configured alert rules
+func (self *Client) AlertRules(ctx context.Context) ([]AlertRule, error) {
+	var res []AlertRule
+	err := self.Call(ctx, "Alert.Rules", &struct{}{}, &res)
+	return res, err
+}
+
+// ----------------------------------------------------------------------------
+//
+// Client Methods
+//
+// ----------------------------------------------------------------------------
+
+// Call an RPC method. Calls of idempotent methods are retried.
+func (self *Client) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+
+	body, err := jsonrpc.EncodeClientRequest(method, args)
+	if err != nil {
+		return err
+	}
+
+	retries := 0
+	if idempotent[method] {
+		retries = self.Retries
+	}
+	backoff := self.Backoff
+
+	for attempt := 0; ; attempt++ {
+		err = self.post(ctx, method, body, reply)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post a request, with the client's timeout
+func (self *Client) post(ctx context.Context, method string, body []byte, reply interface{}) error {
+
+	if self.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", self.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	self.authorize(req, body)
+
+	httpClient := self.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(res.Body)
+		return &Error{
+			Method:     method,
+			StatusCode: res.StatusCode,
+			Message:    strings.TrimSpace(res.Status + " " + string(message)),
+		}
+	}
+
+	err = jsonrpc.DecodeClientResponse(res.Body, reply)
+	if rpcErr, ok := err.(*jsonrpc.Error); ok {
+		return &Error{Method: method, StatusCode: res.StatusCode, Message: fmt.Sprint(rpcErr.Data)}
+	}
+	return err
+}
+
+// authorize the request with the token or HMAC key of the client
+func (self *Client) authorize(req *http.Request, body []byte) {
+
+	if self.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+self.Token)
+	}
+
+	if self.Key != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(self.Secret))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n", req.Method, requestPath(req.URL), timestamp)
+		mac.Write(body)
+
+		req.Header.Set("X-Minion-Key", self.Key)
+		req.Header.Set("X-Minion-Timestamp", timestamp)
+		req.Header.Set("X-Minion-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// retryable reports whether a failed call may succeed if retried
+func retryable(err error) bool {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if e, ok := err.(*Error); ok {
+		return e.retryable()
+	}
+	// transport errors
+	_, ok := err.(*url.Error)
+	return ok
+}
+
+func requestPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"strconv"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// These mirror the arguments and results of minion's RPC methods.
+//
+// ----------------------------------------------------------------------------
+
+type ServiceInstall struct {
+	Id             string                 `json:"id"`
+	URL            string                 `json:"url"`
+	Params         map[string]interface{} `json:"params"`
+	Checksum       string                 `json:"checksum,omitempty"`
+	Signature      string                 `json:"signature,omitempty"`
+	Supervise      *SupervisePolicy       `json:"supervise,omitempty"`
+	Health         *HealthConfig          `json:"health,omitempty"`
+	StopOnShutdown *bool                  `json:"stop_on_shutdown,omitempty"`
+
+	StatsKinds map[string]service.MetricKind `json:"stats_kinds,omitempty"`
+}
+
+// Supervision of a service. Durations are in seconds.
+type SupervisePolicy struct {
+	Restart           string `json:"restart"`
+	Interval          int    `json:"interval,omitempty"`
+	Backoff           int    `json:"backoff,omitempty"`
+	MaxBackoff        int    `json:"max_backoff,omitempty"`
+	MaxRetries        int    `json:"max_retries,omitempty"`
+	CrashLoopRestarts int    `json:"crash_loop_restarts,omitempty"`
+	CrashLoopWindow   int    `json:"crash_loop_window,omitempty"`
+}
+
+// Health checks of a service. Durations are in seconds.
+type HealthConfig struct {
+	Interval    int           `json:"interval,omitempty"`
+	Timeout     int           `json:"timeout,omitempty"`
+	History     int           `json:"history,omitempty"`
+	StartPeriod int           `json:"start_period,omitempty"`
+	Probes      []HealthProbe `json:"probes,omitempty"`
+}
+
+type HealthProbe struct {
+	Name    string   `json:"name,omitempty"`
+	Type    string   `json:"type"`
+	Address string   `json:"address,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Status  int      `json:"status,omitempty"`
+	Command []string `json:"command,omitempty"`
+}
+
+// Status of a service, as returned by Service.Status
+type ServiceStatus struct {
+	Id string `json:"id"`
+	service.StatusDetail
+	Supervisor *SupervisorStatus `json:"supervisor,omitempty"`
+}
+
+type SupervisorStatus struct {
+	Restart     string     `json:"restart"`
+	Restarts    int        `json:"restarts"`
+	LastExit    string     `json:"last_exit,omitempty"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+	CrashLoop   bool       `json:"crash_loop"`
+	GaveUp      bool       `json:"gave_up"`
+}
+
+// Health of a service, as returned by Service.Health
+type HealthReport struct {
+	Id      string        `json:"id"`
+	Status  string        `json:"status"`
+	Results []ProbeResult `json:"results"`
+}
+
+type ProbeResult struct {
+	Probe    string    `json:"probe"`
+	Type     string    `json:"type"`
+	Healthy  bool      `json:"healthy"`
+	Detail   string    `json:"detail,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"`
+}
+
+// Arguments for Service.Configure
+type ServiceConfigure struct {
+	Id      string                 `json:"id"`
+	Params  map[string]interface{} `json:"params"`
+	Replace bool                   `json:"replace,omitempty"`
+	Restart bool                   `json:"restart,omitempty"`
+}
+
+// Arguments for Service.Upgrade
+type ServiceUpgrade struct {
+	Id        string                 `json:"id"`
+	URL       string                 `json:"url"`
+	Checksum  string                 `json:"checksum,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+// Stats of a service, as returned by Service.Stats
+type Stats map[string]interface{}
+
+// Stats of a service with their kinds, units and labels, as returned by
+// Service.StatsReport
+type StatsReport struct {
+	service.Stats
+}
+
+// Arguments for Service.StatsHistory. Step is in seconds, Aggregate one
+// of "avg", "min" and "max".
+type StatsHistoryArgs struct {
+	Id        string    `json:"id"`
+	From      time.Time `json:"from,omitempty"`
+	To        time.Time `json:"to,omitempty"`
+	Metrics   []string  `json:"metrics,omitempty"`
+	Step      int       `json:"step,omitempty"`
+	Aggregate string    `json:"aggregate,omitempty"`
+	Rate      bool      `json:"rate,omitempty"`
+}
+
+// History of the stats of a service, as returned by Service.StatsHistory
+type StatsHistory struct {
+	Id     string        `json:"id"`
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Step   int           `json:"step,omitempty"`
+	Series []StatsSeries `json:"series"`
+}
+
+type StatsSeries struct {
+	Metric string       `json:"metric"`
+	Rate   bool         `json:"rate,omitempty"`
+	Points []StatsPoint `json:"points"`
+}
+
+type StatsPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type AlertRule struct {
+	Name     string   `json:"name"`
+	Expr     string   `json:"expr"`
+	Services []string `json:"services,omitempty"`
+}
+
+const (
+	AlertPending  string = "pending"
+	AlertFiring   string = "firing"
+	AlertResolved string = "resolved"
+)
+
+// An alert, as returned by Alert.List
+type AlertState struct {
+	Rule    string    `json:"rule"`
+	Service string    `json:"service"`
+	Expr    string    `json:"expr"`
+	State   string    `json:"state"`
+	Value   float64   `json:"value"`
+	Since   time.Time `json:"since"`
+	Fired   time.Time `json:"fired,omitempty"`
+}
+
+const (
+	JobRunning   string = "running"
+	JobSucceeded string = "succeeded"
+	JobFailed    string = "failed"
+	JobCancelled string = "cancelled"
+)
+
+// A job, as returned by the Job methods
+type JobInfo struct {
+	Id       string     `json:"id"`
+	Service  string     `json:"service"`
+	Command  string     `json:"command"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Ended    *time.Time `json:"ended,omitempty"`
+	ExitCode int        `json:"exit_code"`
+	Output   string     `json:"output"`
+	Error    string     `json:"error,omitempty"`
+}
+
+type jobWait struct {
+	Id      string `json:"id"`
+	Timeout int    `json:"timeout"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// Stats Methods
+//
+// ----------------------------------------------------------------------------
+
+// Float returns a numeric stat. Numbers reported as strings are parsed.
+func (self Stats) Float(name string) (float64, bool) {
+	switch v := self[name].(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// String returns a stat as a string
+func (self Stats) String(name string) (string, bool) {
+	switch v := self[name].(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// Finished reports whether the job is no longer running
+func (self *JobInfo) Finished() bool {
+	return self.State != JobRunning
+}
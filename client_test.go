@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/client"
+
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	jsonrpc "github.com/gorilla/rpc/v2/json"
+)
+
+// rpcHandler returns the RPC API of `ctx`, behind `auth` if not nil
+func rpcHandler(ctx *ServiceContext, auth *Auth) http.Handler {
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterCodec(jsonrpc.NewCodec(), "application/json")
+	rpcServer.RegisterService(ctx, "Service")
+	rpcServer.RegisterService(ctx.Jobs, "Job")
+
+	var handler http.Handler = rpcServer
+	if auth != nil {
+		handler = auth.Handler(ioutil.Discard, handler, true)
+	}
+	return handler
+}
+
+// serveMinion serves the RPC API of `ctx`, behind `auth` if not nil
+func serveMinion(t *testing.T, ctx *ServiceContext, auth *Auth) *httptest.Server {
+	server := httptest.NewServer(rpcHandler(ctx, auth))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// A handler answering 503 to the first `failures` requests
+type unavailable struct {
+	handler  http.Handler
+	failures int
+	requests int
+	mutex    sync.Mutex
+}
+
+func (self *unavailable) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	self.mutex.Lock()
+	self.requests++
+	fail := self.requests <= self.failures
+	self.mutex.Unlock()
+
+	if fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	self.handler.ServeHTTP(w, req)
+}
+
+func (self *unavailable) reset(failures int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.failures = failures
+	self.requests = 0
+}
+
+func (self *unavailable) count() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.requests
+}
+
+// Requests signed by the client are accepted by the HMAC verifier
+func TestClientHMAC(t *testing.T) {
+	ctx := newTestContext(t)
+	writeEtc(t, "hmac.keys", "ops secret admin\n")
+	auth, err := LoadAuth([]string{AuthHMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveMinion(t, ctx, auth)
+
+	c := client.New(server.URL)
+	c.Key, c.Secret = "ops", "secret"
+	background := context.Background()
+
+	jobId, err := c.Install(background, &client.ServiceInstall{Id: "svc", URL: writeService(t, testService)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Wait(background, jobId); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := c.Exists(background, "svc"); err != nil || !exists {
+		t.Fatalf("exists: %v %v", exists, err)
+	}
+
+	c.Secret = "wrong"
+	_, err = c.List(background)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: %v", err)
+	}
+}
+
+// Calls are retried on 503 only if the method is idempotent
+func TestClientRetries(t *testing.T) {
+	ctx := newTestContext(t)
+	server := &unavailable{handler: rpcHandler(ctx, nil)}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	c := client.New(httpServer.URL)
+	c.Backoff = time.Millisecond
+	background := context.Background()
+
+	server.reset(2)
+	if _, err := c.List(background); err != nil {
+		t.Fatal(err)
+	}
+	if requests := server.count(); requests != 3 {
+		t.Fatalf("list: %d requests", requests)
+	}
+
+	// retries are bounded
+	server.reset(c.Retries + 1)
+	_, err := c.List(background)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("list: %v", err)
+	}
+	if requests := server.count(); requests != c.Retries+1 {
+		t.Fatalf("list: %d requests", requests)
+	}
+
+	server.reset(1)
+	_, err = c.Install(background, &client.ServiceInstall{Id: "svc", URL: writeService(t, testService)})
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("install: %v", err)
+	}
+	if requests := server.count(); requests != 1 {
+		t.Fatalf("install: %d requests", requests)
+	}
+	if ctx.Registry.Exists("svc") {
+		t.Fatal("install: installed")
+	}
+}
@@ -0,0 +1,421 @@
+// minionctl drives a minion over its JSON-RPC API.
+//
+//	minionctl [-host host:port] [-token token] [-json] <command> [arguments]
+//
+// Exit codes: 0 on success, 1 if the RPC or the job failed, 2 on usage
+// errors, 3 if minion could not be reached.
+package main
+
+import (
+	"github.com/aerospike-labs/minion/client"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	ExitOK          int = 0
+	ExitFailed      int = 1
+	ExitUsage       int = 2
+	ExitUnreachable int = 3
+)
+
+var (
+	host       string        = "localhost:9090"
+	token      string        = os.Getenv("MINION_TOKEN")
+	jsonOutput bool          = false
+	timeout    time.Duration = client.DefaultTimeout
+
+	minion *client.Client = nil
+)
+
+// A usage error
+type usageError struct {
+	message string
+}
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"list":    {"list", list},
+	"install": {"install <id> <url> [-param k=v ...] [-checksum sha256:hex] [-signature base64] [-wait]", install},
+	"remove":  {"remove <id> [-wait]", remove},
+	"status":  {"status <id>", status},
+	"start":   {"start <id> [-wait]", start},
+	"stop":    {"stop <id> [-wait]", stop},
+	"stats":   {"stats <id>", stats},
+}
+
+// Repeated -param k=v flags
+type paramsValue map[string]interface{}
+
+// ----------------------------------------------------------------------------
+//
+// Main
+//
+// ----------------------------------------------------------------------------
+
+func main() {
+
+	flag.StringVar(&host, "host", host, "Address of minion, as host:port or a http(s):// URL.")
+	flag.StringVar(&token, "token", token, "Bearer token, defaults to $MINION_TOKEN.")
+	flag.BoolVar(&jsonOutput, "json", jsonOutput, "Print JSON instead of tables.")
+	flag.DurationVar(&timeout, "timeout", timeout, "Timeout of each request.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(ExitUsage)
+	}
+
+	cmd, exists := commands[flag.Arg(0)]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "error: unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(ExitUsage)
+	}
+
+	minion = client.New(host)
+	minion.Token = token
+	minion.Timeout = timeout
+
+	err := cmd.run(flag.Args()[1:])
+	switch err.(type) {
+	case nil:
+		os.Exit(ExitOK)
+	case *usageError:
+		fmt.Fprintf(os.Stderr, "error: %s\nusage: minionctl %s\n", err.Error(), cmd.usage)
+		os.Exit(ExitUsage)
+	case *url.Error:
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(ExitUnreachable)
+	default:
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(ExitFailed)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: minionctl [flags] <command> [arguments]\n\ncommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// ----------------------------------------------------------------------------
+//
+// Commands
+//
+// ----------------------------------------------------------------------------
+
+func list(args []string) error {
+
+	if _, err := parseArgs(flag.NewFlagSet("list", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	res, err := minion.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(res)
+	}
+
+	ids := []string{}
+	for id := range res {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tURL\tPARAMS")
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", id, res[id].URL, formatParams(res[id].Params))
+	}
+	return w.Flush()
+}
+
+func install(args []string) error {
+
+	params := paramsValue{}
+	svc := &client.ServiceInstall{}
+
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	fs.Var(params, "param", "Service parameter k=v, repeatable.")
+	fs.StringVar(&svc.Checksum, "checksum", "", "Checksum of the artifact.")
+	fs.StringVar(&svc.Signature, "signature", "", "Signature of the artifact.")
+	wait := fs.Bool("wait", false, "Wait for the job to finish.")
+
+	positional, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	svc.Id = positional[0]
+	svc.URL = positional[1]
+	svc.Params = params
+
+	jobId, err := minion.Install(context.Background(), svc)
+	if err != nil {
+		return err
+	}
+	return printJob(jobId, *wait)
+}
+
+func remove(args []string) error {
+	return jobCommand("remove", minion.Remove, args)
+}
+
+func start(args []string) error {
+	return jobCommand("start", minion.Start, args)
+}
+
+func stop(args []string) error {
+	return jobCommand("stop", minion.Stop, args)
+}
+
+func status(args []string) error {
+
+	positional, err := parseArgs(flag.NewFlagSet("status", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	res, err := minion.Status(context.Background(), positional[0])
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(res)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tPID\tUPTIME\tVERSION\tHEALTH\tLAST ERROR")
+	health := ""
+	if s, ok := res.Health["status"]; ok {
+		health = fmt.Sprint(s)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		res.Id, res.State, formatInt(int64(res.Pid)), formatUptime(res.Uptime),
+		res.Version, health, res.LastError)
+	return w.Flush()
+}
+
+func stats(args []string) error {
+
+	positional, err := parseArgs(flag.NewFlagSet("stats", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	res, err := minion.StatsReport(context.Background(), positional[0])
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(res)
+	}
+
+	metrics := res.Metrics
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Key() < metrics[j].Key()
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKIND\tUNIT\tVALUE")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Key(), m.Kind, m.Unit, formatValue(m.Value))
+	}
+	return w.Flush()
+}
+
+// jobCommand calls a method taking a service id and returning a job id
+func jobCommand(name string, method func(context.Context, string) (string, error), args []string) error {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	wait := fs.Bool("wait", false, "Wait for the job to finish.")
+
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	jobId, err := method(context.Background(), positional[0])
+	if err != nil {
+		return err
+	}
+	return printJob(jobId, *wait)
+}
+
+// printJob prints the job id, or waits for the job and prints its result
+func printJob(jobId string, wait bool) error {
+
+	if !wait {
+		if jsonOutput {
+			return printJSON(map[string]string{"job": jobId})
+		}
+		fmt.Println(jobId)
+		return nil
+	}
+
+	info, err := minion.Wait(context.Background(), jobId)
+	if info == nil {
+		return err
+	}
+
+	if jsonOutput {
+		printJSON(info)
+	} else {
+		fmt.Print(info.Output)
+		fmt.Printf("job %s %s\n", info.Id, info.State)
+	}
+
+	if err != nil && info.Error != "" {
+		return fmt.Errorf("%s: %s", err.Error(), info.Error)
+	}
+	return err
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// parseArgs parses flags interspersed with `n` positional arguments
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+
+	fs.SetOutput(os.Stderr)
+	positional := []string{}
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, &usageError{err.Error()}
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if len(positional) != n {
+		return nil, &usageError{fmt.Sprintf("expected %d arguments, got %d", n, len(positional))}
+	}
+	return positional, nil
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func formatParams(params map[string]interface{}) string {
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+formatValue(params[k]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatValue(v interface{}) string {
+	switch v.(type) {
+	case string, float64, bool, nil:
+		return fmt.Sprint(v)
+	default:
+		out, _ := json.Marshal(v)
+		return string(out)
+	}
+}
+
+func formatInt(i int64) string {
+	if i == 0 {
+		return "-"
+	}
+	return fmt.Sprint(i)
+}
+
+func formatUptime(seconds int64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// ----------------------------------------------------------------------------
+//
+// Error Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *usageError) Error() string {
+	return self.message
+}
+
+// ----------------------------------------------------------------------------
+//
+// paramsValue Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self paramsValue) String() string {
+	return formatParams(self)
+}
+
+// Set a k=v param. Values are JSON if valid, as 3000 or true, strings
+// otherwise.
+func (self paramsValue) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return errors.New("expected k=v")
+	}
+
+	key, raw := s[:i], s[i+1:]
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		value = raw
+	}
+	self[key] = value
+	return nil
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+// Minion configuration, read from etc/minion.json.
+//
+// Flags given on the command line override the file, and environment
+// variables override both. The variable of a flag is its name in upper
+// case, prefixed by MINION_: -tls-cert is MINION_TLS_CERT.
+//
+// Fleet is the path of the fleet inventory; if set, minion is also the
+// controller of the fleet. Alerts are evaluated against the stats of the
+// services, and webhooks notified of their events.
+type Config struct {
+	Listen   string                    `json:"listen,omitempty"`
+	Paths    PathsConfig               `json:"paths"`
+	Timeouts TimeoutsConfig            `json:"timeouts"`
+	Auth     []string                  `json:"auth,omitempty"`
+	TLS      TLSConfig                 `json:"tls"`
+	Install  InstallConfig             `json:"install"`
+	Defaults ServicePolicy             `json:"defaults"`
+	Services map[string]*ServicePolicy `json:"services,omitempty"`
+	Fleet    string                    `json:"fleet,omitempty"`
+	Alerts   []AlertRule               `json:"alerts,omitempty"`
+	Webhooks []WebhookConfig           `json:"webhooks,omitempty"`
+}
+
+type PathsConfig struct {
+	Pid    string `json:"pid,omitempty"`
+	Log    string `json:"log,omitempty"`
+	Access string `json:"access,omitempty"`
+}
+
+type TimeoutsConfig struct {
+	Read     Duration `json:"read,omitempty"`
+	Write    Duration `json:"write,omitempty"`
+	Shutdown Duration `json:"shutdown,omitempty"`
+}
+
+type TLSConfig struct {
+	Listen   string `json:"listen,omitempty"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	ClientCA string `json:"client_ca,omitempty"`
+}
+
+// Limits of installs and upgrades. MaxSize bounds downloaded artifacts,
+// and the binary extracted from them, in bytes. Timeout bounds downloads.
+type InstallConfig struct {
+	MaxSize int64    `json:"max_size,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Policies of services. The defaults apply to services which do not set
+// them in service.json; per-service policies override service.json.
+type ServicePolicy struct {
+	Supervise      *SupervisePolicy `json:"supervise,omitempty"`
+	Health         *HealthConfig    `json:"health,omitempty"`
+	StopOnShutdown *bool            `json:"stop_on_shutdown,omitempty"`
+}
+
+// A time.Duration, written as "10s" in the configuration
+type Duration time.Duration
+
+// A string setting, as a flag.Value
+type stringValue string
+
+// A setting which can be set by the file, a flag, and the environment
+type configSetting struct {
+	flag  string
+	value func(config *Config) flag.Value
+}
+
+var configSettings = []configSetting{
+	{"listen", func(c *Config) flag.Value { return (*stringValue)(&c.Listen) }},
+	{"pid", func(c *Config) flag.Value { return (*stringValue)(&c.Paths.Pid) }},
+	{"log", func(c *Config) flag.Value { return (*stringValue)(&c.Paths.Log) }},
+	{"access", func(c *Config) flag.Value { return (*stringValue)(&c.Paths.Access) }},
+	{"read-timeout", func(c *Config) flag.Value { return &c.Timeouts.Read }},
+	{"write-timeout", func(c *Config) flag.Value { return &c.Timeouts.Write }},
+	{"shutdown-timeout", func(c *Config) flag.Value { return &c.Timeouts.Shutdown }},
+	{"tls-listen", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Listen) }},
+	{"tls-cert", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Cert) }},
+	{"tls-key", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Key) }},
+	{"tls-client-ca", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.ClientCA) }},
+	{"fleet", func(c *Config) flag.Value { return (*stringValue)(&c.Fleet) }},
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// LoadConfig reads the configuration file, applies the flags and the
+// environment, and validates the result. A missing file is an empty
+// configuration.
+//
+// The file is read over the flag defaults, so the values it sets, even to
+// zero, override them.
+func LoadConfig(file string) (*Config, error) {
+
+	config := &Config{}
+	config.defaults()
+
+	if !path.IsAbs(file) {
+		file = path.Join(rootPath, file)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+
+	if err = config.resolve(); err != nil {
+		return nil, err
+	}
+	if err = config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configEnv returns the environment variable of a flag
+func configEnv(name string) string {
+	return "MINION_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// configCheck validates the configuration file, and prints the effective
+// configuration. Returns the exit code of `minion config check`.
+func configCheck() int {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		return 1
+	}
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// ----------------------------------------------------------------------------
+//
+// Config Methods
+//
+// ----------------------------------------------------------------------------
+
+// defaults sets the values of the flags, before the file is read
+func (self *Config) defaults() {
+	for _, setting := range configSettings {
+		if f := flag.Lookup(setting.flag); f != nil {
+			setting.value(self).Set(f.Value.String())
+		}
+	}
+	self.Auth = splitList(authModes)
+}
+
+// resolve applies the flags and the environment to the values of the file.
+// Flags set on the command line override the file.
+func (self *Config) resolve() error {
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, setting := range configSettings {
+		value := setting.value(self)
+		if f := flag.Lookup(setting.flag); f != nil && set[setting.flag] {
+			value.Set(f.Value.String())
+		}
+		if env := os.Getenv(configEnv(setting.flag)); env != "" {
+			if err := value.Set(env); err != nil {
+				return fmt.Errorf("%s: %s", configEnv(setting.flag), err.Error())
+			}
+		}
+	}
+
+	if set["auth"] {
+		self.Auth = splitList(authModes)
+	}
+	if env := os.Getenv(configEnv("auth")); env != "" {
+		self.Auth = splitList(env)
+	}
+
+	return nil
+}
+
+// validate the configuration
+func (self *Config) validate() error {
+
+	if self.Listen != "" {
+		if _, _, err := net.SplitHostPort(self.Listen); err != nil {
+			return fmt.Errorf("listen: %s", err.Error())
+		}
+	}
+	if self.TLS.Listen != "" {
+		if _, _, err := net.SplitHostPort(self.TLS.Listen); err != nil {
+			return fmt.Errorf("tls.listen: %s", err.Error())
+		}
+	}
+
+	if self.Timeouts.Read < 0 || self.Timeouts.Write < 0 || self.Timeouts.Shutdown < 0 {
+		return errors.New("timeouts: negative duration")
+	}
+	if self.Install.MaxSize < 0 {
+		return errors.New("install: negative max_size")
+	}
+	if self.Install.Timeout < 0 {
+		return errors.New("install: negative timeout")
+	}
+
+	tls := false
+	for _, mode := range self.Auth {
+		switch strings.TrimSpace(mode) {
+		case "", AuthToken, AuthHMAC:
+		case AuthCert:
+			tls = true
+		default:
+			return fmt.Errorf("auth: %s: %s", ErrorUnknownAuth.Error(), mode)
+		}
+	}
+
+	if self.TLS.Cert == "" {
+		if self.TLS.Key != "" || self.TLS.ClientCA != "" || self.TLS.Listen != "" {
+			return errors.New("tls: key, client_ca and listen require a cert")
+		}
+		if tls {
+			return errors.New("auth: cert requires tls")
+		}
+	} else if self.TLS.Key == "" {
+		return errors.New("tls: cert requires a key")
+	}
+
+	if err := self.Defaults.validate(); err != nil {
+		return fmt.Errorf("defaults: %s", err.Error())
+	}
+	for id, policy := range self.Services {
+		if policy == nil {
+			continue
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("services: %s: %s", id, err.Error())
+		}
+	}
+
+	names := map[string]bool{}
+	for _, rule := range self.Alerts {
+		if _, err := rule.parse(); err != nil {
+			return fmt.Errorf("alerts: %s", err.Error())
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("alerts: %s: duplicate", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	urls := map[string]bool{}
+	for _, hook := range self.Webhooks {
+		if err := hook.validate(); err != nil {
+			return fmt.Errorf("webhooks: %s", err.Error())
+		}
+		if urls[hook.URL] {
+			return fmt.Errorf("webhooks: %s: duplicate", hook.URL)
+		}
+		urls[hook.URL] = true
+	}
+
+	return nil
+}
+
+// Service returns a copy of `svc`, with the service defaults and overrides
+// applied.
+func (self *Config) Service(svc *ServiceInstall) *ServiceInstall {
+	if self == nil {
+		return svc
+	}
+
+	effective := *svc
+	if effective.Supervise == nil {
+		effective.Supervise = self.Defaults.Supervise
+	}
+	if effective.Health == nil {
+		effective.Health = self.Defaults.Health
+	}
+	if effective.StopOnShutdown == nil {
+		effective.StopOnShutdown = self.Defaults.StopOnShutdown
+	}
+
+	if policy := self.Services[svc.Id]; policy != nil {
+		if policy.Supervise != nil {
+			effective.Supervise = policy.Supervise
+		}
+		if policy.Health != nil {
+			effective.Health = policy.Health
+		}
+		if policy.StopOnShutdown != nil {
+			effective.StopOnShutdown = policy.StopOnShutdown
+		}
+	}
+
+	return &effective
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Config Methods
+//
+// ----------------------------------------------------------------------------
+
+// SetConfig sets the configuration of services, on startup and reload
+func (self *ServiceContext) SetConfig(config *Config) {
+	self.configMutex.Lock()
+	defer self.configMutex.Unlock()
+	self.config = config
+}
+
+// currentConfig returns the configuration in effect
+func (self *ServiceContext) currentConfig() *Config {
+	self.configMutex.RLock()
+	defer self.configMutex.RUnlock()
+	return self.config
+}
+
+// policy returns the service with the configured defaults and overrides
+// applied
+func (self *ServiceContext) policy(svc *ServiceInstall) *ServiceInstall {
+	self.configMutex.RLock()
+	defer self.configMutex.RUnlock()
+	return self.config.Service(svc)
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServicePolicy Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *ServicePolicy) validate() error {
+
+	if self.Supervise != nil {
+		switch self.Supervise.Restart {
+		case "", RestartNever, RestartOnFailure, RestartAlways:
+		default:
+			return fmt.Errorf("supervise: unknown restart policy: %s", self.Supervise.Restart)
+		}
+	}
+
+	if self.Health != nil {
+		for _, probe := range self.Health.Probes {
+			switch probe.Type {
+			case ProbeTCP, ProbeHTTP, ProbeExec, ProbeService:
+			default:
+				return fmt.Errorf("health: unknown probe type: %s", probe.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Value Methods
+//
+// ----------------------------------------------------------------------------
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*b)
+}
+
+func TestConfigServiceStopOnShutdown(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		service  *bool
+		defaults *bool
+		policy   *bool
+		expected *bool
+	}{
+		{nil, nil, nil, nil},
+		{nil, &yes, nil, &yes},
+		// set in service.json, even to false, over the default
+		{&no, &yes, nil, &no},
+		{&yes, &no, nil, &yes},
+		// per-service policies override service.json
+		{&no, &yes, &yes, &yes},
+		{&yes, nil, &no, &no},
+	}
+
+	for i, test := range tests {
+		config := &Config{
+			Defaults: ServicePolicy{StopOnShutdown: test.defaults},
+			Services: map[string]*ServicePolicy{"svc": {StopOnShutdown: test.policy}},
+		}
+		svc := &ServiceInstall{Id: "svc", StopOnShutdown: test.service}
+
+		got := config.Service(svc).StopOnShutdown
+		if formatBool(got) != formatBool(test.expected) {
+			t.Errorf("%d: %s, expected %s", i, formatBool(got), formatBool(test.expected))
+		}
+	}
+}
+
+// Values set by the file, even to zero, override the flag defaults
+func TestLoadConfigZero(t *testing.T) {
+	setTestRoot(t)
+	for _, name := range []string{"read-timeout", "write-timeout"} {
+		if flag.Lookup(name) == nil {
+			flag.Duration(name, 30*time.Second, "")
+		}
+	}
+	writeEtc(t, "minion.json", `{"timeouts": {"read": "0s"}}`)
+
+	config, err := LoadConfig("etc/minion.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Timeouts.Read != 0 || config.Timeouts.Write != Duration(30*time.Second) {
+		t.Fatalf("timeouts: %+v", config.Timeouts)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"log"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+// Arguments for Service.Configure.
+// Params are merged into the installed params, unless Replace is set.
+// If Restart is set, a running service is restarted once configured.
+type ServiceConfigure struct {
+	Id      string                 `json:"id"`
+	Params  map[string]interface{} `json:"params"`
+	Replace bool                   `json:"replace,omitempty"`
+	Restart bool                   `json:"restart,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Configure Methods
+//
+// ----------------------------------------------------------------------------
+
+// Configure a Service
+//
+// The updated params are passed to the "configure" command and, if it
+// succeeds, stored in service.json. Services which do not implement the
+// command have the params stored, and are restarted if running.
+// Configuration runs as a job, `res` is set to the job id.
+func (self *ServiceContext) Configure(req *http.Request, args *ServiceConfigure, res *string) error {
+
+	var err error = nil
+
+	if err = self.Registry.Acquire(args.Id, "configure"); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	svc, exists := self.Registry.Get(args.Id)
+	if !exists {
+		self.Registry.Release(args.Id)
+		return service.NotFound
+	}
+
+	if tracked := self.Registry.State(args.Id); transitional(tracked.Status) {
+		self.Registry.Release(args.Id)
+		return &TransitionError{Id: args.Id, From: tracked.Status, To: tracked.Status}
+	}
+
+	configured := *svc
+	configured.Params = map[string]interface{}{}
+	if !args.Replace {
+		for k, v := range svc.Params {
+			configured.Params[k] = v
+		}
+	}
+	for k, v := range args.Params {
+		configured.Params[k] = v
+	}
+
+	job := self.Jobs.start(svc.Id, "configure", func(job *Job) error {
+		defer self.Registry.Release(svc.Id)
+		err := self.configure(job, &configured, args.Restart)
+		if err != nil {
+			self.emitError(svc.Id, "configure", err)
+		}
+		return err
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+func (self *ServiceContext) configure(job *Job, svc *ServiceInstall, restart bool) error {
+
+	var err error = nil
+
+	err = self.run(job, svc.Id, "configure", svc.Params, nil)
+	if unsupported(err) {
+		log.Printf("info: configure: %s: unsupported, restarting with the new params\n", svc.Id)
+		err = nil
+		restart = true
+	}
+	if err != nil {
+		return err
+	}
+
+	self.Registry.Put(svc)
+	if err = self.save(svc); err != nil {
+		return err
+	}
+
+	if !restart {
+		return nil
+	}
+
+	tracked := self.Registry.State(svc.Id)
+	if tracked.Status != service.Running && tracked.Status != service.Degraded {
+		return nil
+	}
+
+	if err = self.transition(svc.Id, service.Stopping, ""); err != nil {
+		return err
+	}
+	if err = self.stop(job, svc.Id); err != nil {
+		return err
+	}
+	if err = self.transition(svc.Id, service.Starting, ""); err != nil {
+		return err
+	}
+	return self.start(job, svc.Id)
+}
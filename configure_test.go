@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Services exiting ExitUnsupported from "configure" have the params stored
+// and are restarted; other failures, as panics, fail the configure.
+func TestConfigureUnsupported(t *testing.T) {
+	tests := []struct {
+		exit      string
+		succeeded bool
+	}{
+		{"64", true},
+		{"2", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.exit, func(t *testing.T) {
+			ctx := newTestContext(t)
+			script := strings.Replace(testService, "case \"$1\" in\nstatus)", "case \"$1\" in\nconfigure)\n\texit "+test.exit+" ;;\nstart)\n\techo >> starts ;;\nstatus)", 1)
+			installService(t, ctx, "svc", script)
+
+			id := "svc"
+			var jobId string
+			if err := ctx.Start(nil, &id, &jobId); err != nil {
+				t.Fatal(err)
+			}
+			waitJob(t, ctx, jobId)
+
+			if err := ctx.Configure(nil, &ServiceConfigure{Id: id, Params: map[string]interface{}{"a": "b"}}, &jobId); err != nil {
+				t.Fatal(err)
+			}
+			info := waitJob(t, ctx, jobId)
+			if (info.State == JobSucceeded) != test.succeeded {
+				t.Fatalf("configure: %s %s", info.State, info.Error)
+			}
+
+			svc, _ := ctx.Registry.Get(id)
+			if stored := svc.Params["a"] == "b"; stored != test.succeeded {
+				t.Fatalf("params: %v", svc.Params)
+			}
+			if state := ctx.Registry.State(id).Status; state != service.Running {
+				t.Fatalf("state: %s", state)
+			}
+
+			starts, _ := ioutil.ReadFile(filepath.Join(rootPath, "svc", id, "starts"))
+			if restarted := len(starts) == 2; restarted != test.succeeded {
+				t.Fatalf("started %d times", len(starts))
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// number of events retained for Last-Event-ID replay
+	eventRingSize int = 1024
+
+	// events buffered per subscriber before it is dropped
+	eventSubscriberBuffer int = 256
+
+	// interval between keep-alive comments
+	eventKeepAlive time.Duration = 15 * time.Second
+)
+
+type Event struct {
+	Id    uint64
+	Event string
+	Data  string
+}
+
+// Server-Sent Events stream.
+//
+// Events are kept in a bounded ring so clients reconnecting with a
+// Last-Event-ID header receive the events they missed.
+type EventStream struct {
+	mutex       sync.Mutex
+	ring        []Event
+	next        uint64
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+// ----------------------------------------------------------------------------
+//
+// EventStream Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewEventStream() *EventStream {
+	return &EventStream{
+		ring:        make([]Event, 0, eventRingSize),
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// SendEventMessage publishes an event to all subscribers.
+//
+// Event ids are assigned by the stream, so replay works across all
+// publishers; the `id` argument is ignored.
+func (self *EventStream) SendEventMessage(data, event, id string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.next++
+	e := Event{Id: self.next, Event: event, Data: data}
+
+	if len(self.ring) == eventRingSize {
+		copy(self.ring, self.ring[1:])
+		self.ring = self.ring[:eventRingSize-1]
+	}
+	self.ring = append(self.ring, e)
+
+	for ch := range self.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// slow subscriber, drop it; it can reconnect and replay
+			delete(self.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of new events and the retained events after `lastId`
+func (self *EventStream) subscribe(lastId uint64) (chan Event, []Event) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	replay := []Event{}
+	for _, e := range self.ring {
+		if e.Id > lastId {
+			replay = append(replay, e)
+		}
+	}
+
+	ch := make(chan Event, eventSubscriberBuffer)
+	if self.closed {
+		close(ch)
+		return ch, replay
+	}
+	self.subscribers[ch] = struct{}{}
+	return ch, replay
+}
+
+func (self *EventStream) unsubscribe(ch chan Event) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if _, exists := self.subscribers[ch]; exists {
+		delete(self.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Close ends the streams of all subscribers, on shutdown
+func (self *EventStream) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closed = true
+	for ch := range self.subscribers {
+		delete(self.subscribers, ch)
+		close(ch)
+	}
+}
+
+// ServeHTTP streams events to the client
+func (self *EventStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastId uint64 = 0
+	if s := req.Header.Get("Last-Event-ID"); s != "" {
+		lastId, _ = strconv.ParseUint(s, 10, 64)
+	}
+
+	// the stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("error: events: %s\n", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	ch, replay := self.subscribe(lastId)
+	defer self.unsubscribe(ch)
+
+	for _, e := range replay {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) {
+	fmt.Fprintf(w, "id: %d\n", e.Id)
+	if e.Event != "" {
+		fmt.Fprintf(w, "event: %s\n", e.Event)
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// sendEvent marshals `v` as the data of an event
+func sendEvent(send func(data, event, id string), event string, v interface{}) {
+	if send == nil {
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error: event: %s\n", err.Error())
+		return
+	}
+	send(string(b), event, "")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads `n` events from a stream, as "id event data"
+func readEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+
+	events := []string{}
+	fields := []string{}
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %v: %v", events, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if len(fields) > 0 {
+				events = append(events, strings.Join(fields, " "))
+			}
+			fields = fields[:0]
+		case strings.HasPrefix(line, ":"):
+		default:
+			fields = append(fields, line[strings.Index(line, ": ")+2:])
+		}
+	}
+	return events
+}
+
+// Clients reconnecting with a Last-Event-ID get the events they missed,
+// then the new ones
+func TestEventsReplay(t *testing.T) {
+	stream := NewEventStream()
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	for i := 1; i <= 3; i++ {
+		stream.SendEventMessage("data"+strconv.Itoa(i), "lifecycle", "")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type: %q", ct)
+	}
+	r := bufio.NewReader(res.Body)
+
+	events := readEvents(t, r, 2)
+	if strings.Join(events, ", ") != "2 lifecycle data2, 3 lifecycle data3" {
+		t.Fatalf("replay: %v", events)
+	}
+
+	stream.SendEventMessage("a\nb", "", "")
+	if events := readEvents(t, r, 1); events[0] != "4 a b" {
+		t.Fatalf("live: %v", events)
+	}
+}
+
+// The ring keeps the last eventRingSize events
+func TestEventsEviction(t *testing.T) {
+	stream := NewEventStream()
+	for i := 0; i < eventRingSize+10; i++ {
+		stream.SendEventMessage(strconv.Itoa(i), "", "")
+	}
+
+	ch, replay := stream.subscribe(0)
+	defer stream.unsubscribe(ch)
+	if len(replay) != eventRingSize || replay[0].Id != 11 || replay[len(replay)-1].Id != uint64(eventRingSize+10) {
+		t.Fatalf("replay of %d, from %d", len(replay), replay[0].Id)
+	}
+
+	ch2, replay := stream.subscribe(uint64(eventRingSize + 5))
+	defer stream.unsubscribe(ch2)
+	if len(replay) != 5 || replay[0].Id != uint64(eventRingSize+6) {
+		t.Fatalf("replay of %d", len(replay))
+	}
+}
+
+// Subscribers which fall behind are dropped, the others keep receiving
+func TestEventsSlowSubscriber(t *testing.T) {
+	stream := NewEventStream()
+	slow, _ := stream.subscribe(0)
+	fast, _ := stream.subscribe(0)
+	defer stream.unsubscribe(fast)
+
+	for i := 0; i <= eventSubscriberBuffer; i++ {
+		stream.SendEventMessage(strconv.Itoa(i), "", "")
+		<-fast
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != eventSubscriberBuffer {
+		t.Fatalf("slow subscriber received %d", received)
+	}
+
+	stream.SendEventMessage("after", "", "")
+	if e := <-fast; e.Data != "after" {
+		t.Fatalf("fast subscriber: %+v", e)
+	}
+	stream.unsubscribe(slow)
+}
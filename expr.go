@@ -0,0 +1,574 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+var (
+	ErrorInvalidExpr error = errors.New("Invalid Expression")
+)
+
+// An alert expression, as
+//
+//	memory_used / memory_total > 0.8 for 5m
+//	rate(write_err) > 10/s
+//	latency_over{histogram="reads",threshold="1ms"} > 5 and cluster_size < 3
+//
+// Stats are referenced by name, with their labels if they have any.
+// rate(stat) is the per second rate of a counter between the last two
+// samples. Numbers may be given per second, minute or hour, as 10/s or
+// 600/m. The condition compares arithmetic (+ - * /) of stats and numbers
+// with > >= < <= == !=, combined with "and" and "or". An optional "for"
+// duration requires the condition to hold that long.
+type Expr struct {
+	source string
+	cond   exprNode
+	For    time.Duration
+}
+
+// Values of the stats of a service, for evaluating expressions
+type exprEnv struct {
+	values   map[string]float64
+	previous map[string]float64
+	elapsed  float64
+}
+
+// A node of an expression. Evaluating returns false if a stat is missing
+// or the value is undefined.
+type exprNode interface {
+	eval(env *exprEnv) (float64, bool)
+	boolean() bool
+}
+
+type numberNode struct {
+	value float64
+}
+
+type statNode struct {
+	key string
+}
+
+type rateNode struct {
+	key string
+}
+
+type negNode struct {
+	operand exprNode
+}
+
+type binaryNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+// a comparison or a logical operator, evaluating to 1 or 0
+type condNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+type exprToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	pos    int
+}
+
+const (
+	tokenNumber string = "number"
+	tokenIdent  string = "ident"
+	tokenOp     string = "op"
+	tokenEnd    string = "end"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// ParseExpr parses an alert expression
+func ParseExpr(source string) (*Expr, error) {
+
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{source: source, tokens: tokens}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !cond.boolean() {
+		return nil, p.errorf("expected a comparison")
+	}
+
+	expr := &Expr{source: source, cond: cond}
+
+	if p.peek().kind == tokenIdent && p.peek().text == "for" {
+		p.next()
+		t := p.next()
+		if t.kind != tokenNumber {
+			return nil, p.errorAt(t, "expected a duration")
+		}
+		expr.For, err = time.ParseDuration(t.text)
+		if err != nil || expr.For < 0 {
+			return nil, p.errorAt(t, "invalid duration: "+t.text)
+		}
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.errorAt(t, "unexpected "+t.text)
+	}
+
+	return expr, nil
+}
+
+func lexExpr(source string) ([]exprToken, error) {
+
+	tokens := []exprToken{}
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+
+		// numbers and durations, as 0.8, 1e3 and 5m
+		case unicode.IsDigit(r) || r == '.':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '.' ||
+				((runes[i] == '+' || runes[i] == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokenNumber, string(runes[start:i]), start})
+
+		// stats, with their labels
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			if i < len(runes) && runes[i] == '{' {
+				end := strings.IndexRune(string(runes[i:]), '}')
+				if end < 0 {
+					return nil, fmt.Errorf("%s: %s: unterminated labels at %d", ErrorInvalidExpr.Error(), source, i)
+				}
+				i += len([]rune(string(runes[i:])[:end])) + 1
+			}
+			tokens = append(tokens, exprToken{tokenIdent, string(runes[start:i]), start})
+
+		default:
+			op := string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case ">=", "<=", "==", "!=":
+					op = two
+				}
+			}
+			if !strings.Contains("+-*/()<>=!", op[:1]) || op == "=" || op == "!" {
+				return nil, fmt.Errorf("%s: %s: unexpected %q at %d", ErrorInvalidExpr.Error(), source, op, i)
+			}
+			i += len([]rune(op))
+			tokens = append(tokens, exprToken{tokenOp, op, start})
+		}
+	}
+
+	return append(tokens, exprToken{tokenEnd, "end", len(runes)}), nil
+}
+
+// statKey returns the key of a stat, as `name{label="value"}`, with its
+// labels sorted
+func statKey(text string) (string, error) {
+
+	i := strings.IndexRune(text, '{')
+	if i < 0 {
+		return text, nil
+	}
+
+	metric := &service.Metric{Name: text[:i], Labels: map[string]string{}}
+	labels := strings.TrimSpace(text[i+1 : len(text)-1])
+	for labels != "" {
+		eq := strings.IndexRune(labels, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("invalid labels: %s", text)
+		}
+		name := strings.TrimSpace(labels[:eq])
+		rest := strings.TrimSpace(labels[eq+1:])
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return "", fmt.Errorf("invalid labels: %s", text)
+		}
+		value, _ := strconv.Unquote(quoted)
+		metric.Labels[name] = value
+
+		labels = strings.TrimSpace(rest[len(quoted):])
+		labels = strings.TrimSpace(strings.TrimPrefix(labels, ","))
+	}
+
+	return metric.Key(), nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Expr Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *Expr) String() string {
+	return self.source
+}
+
+// eval reports whether the condition holds, and the value of its left
+// side. It is undecided, `ok` is false, if a stat it needs is missing or
+// a value is undefined.
+func (self *Expr) eval(env *exprEnv) (holds bool, value float64, ok bool) {
+
+	result, ok := self.cond.eval(env)
+	if !ok {
+		return false, 0, false
+	}
+	if result == 0 {
+		return false, 0, true
+	}
+
+	if cond, isCond := self.cond.(*condNode); isCond && !cond.left.boolean() {
+		value, _ = cond.left.eval(env)
+	}
+	return true, value, true
+}
+
+// ----------------------------------------------------------------------------
+//
+// exprParser Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *exprParser) peek() exprToken {
+	return self.tokens[self.pos]
+}
+
+func (self *exprParser) next() exprToken {
+	t := self.tokens[self.pos]
+	if t.kind != tokenEnd {
+		self.pos++
+	}
+	return t
+}
+
+func (self *exprParser) accept(kind string, text string) bool {
+	if t := self.peek(); t.kind == kind && t.text == text {
+		self.pos++
+		return true
+	}
+	return false
+}
+
+func (self *exprParser) errorf(message string) error {
+	return fmt.Errorf("%s: %s: %s", ErrorInvalidExpr.Error(), self.source, message)
+}
+
+func (self *exprParser) errorAt(t exprToken, message string) error {
+	return fmt.Errorf("%s: %s: %s at %d", ErrorInvalidExpr.Error(), self.source, message, t.pos)
+}
+
+func (self *exprParser) parseOr() (exprNode, error) {
+	left, err := self.parseAnd()
+	for err == nil && self.accept(tokenIdent, "or") {
+		var right exprNode
+		if right, err = self.parseAnd(); err == nil {
+			left, err = self.logical("or", left, right)
+		}
+	}
+	return left, err
+}
+
+func (self *exprParser) parseAnd() (exprNode, error) {
+	left, err := self.parseCompare()
+	for err == nil && self.accept(tokenIdent, "and") {
+		var right exprNode
+		if right, err = self.parseCompare(); err == nil {
+			left, err = self.logical("and", left, right)
+		}
+	}
+	return left, err
+}
+
+func (self *exprParser) logical(op string, left exprNode, right exprNode) (exprNode, error) {
+	if !left.boolean() || !right.boolean() {
+		return nil, self.errorf("operands of " + op + " must be comparisons")
+	}
+	return &condNode{op: op, left: left, right: right}, nil
+}
+
+func (self *exprParser) parseCompare() (exprNode, error) {
+
+	left, err := self.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	t := self.peek()
+	switch t.text {
+	case ">", ">=", "<", "<=", "==", "!=":
+		self.next()
+	default:
+		return left, nil
+	}
+
+	right, err := self.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if left.boolean() || right.boolean() {
+		return nil, self.errorAt(t, "comparison of comparisons")
+	}
+	return &condNode{op: t.text, left: left, right: right}, nil
+}
+
+func (self *exprParser) parseSum() (exprNode, error) {
+	left, err := self.parseProduct()
+	for err == nil && (self.peek().text == "+" || self.peek().text == "-") && self.peek().kind == tokenOp {
+		op := self.next().text
+		var right exprNode
+		if right, err = self.parseProduct(); err == nil {
+			left = &binaryNode{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (self *exprParser) parseProduct() (exprNode, error) {
+	left, err := self.parseUnary()
+	for err == nil && (self.peek().text == "*" || self.peek().text == "/") && self.peek().kind == tokenOp {
+		op := self.next().text
+		var right exprNode
+		if right, err = self.parseUnary(); err == nil {
+			left = &binaryNode{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (self *exprParser) parseUnary() (exprNode, error) {
+	if self.accept(tokenOp, "-") {
+		operand, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negNode{operand: operand}, nil
+	}
+	return self.parsePrimary()
+}
+
+func (self *exprParser) parsePrimary() (exprNode, error) {
+
+	t := self.next()
+
+	switch {
+	case t.kind == tokenNumber:
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, self.errorAt(t, "invalid number: "+t.text)
+		}
+
+		// rates, as 10/s
+		if self.peek().text == "/" && self.tokens[self.pos+1].kind == tokenIdent {
+			per := map[string]float64{"s": 1, "m": 60, "h": 3600}[self.tokens[self.pos+1].text]
+			if per > 0 {
+				self.pos += 2
+				value /= per
+			}
+		}
+		return &numberNode{value: value}, nil
+
+	case t.kind == tokenIdent && t.text == "rate":
+		if !self.accept(tokenOp, "(") {
+			return nil, self.errorAt(self.peek(), "expected (")
+		}
+		stat := self.next()
+		if stat.kind != tokenIdent {
+			return nil, self.errorAt(stat, "expected a stat")
+		}
+		key, err := statKey(stat.text)
+		if err != nil {
+			return nil, self.errorAt(stat, err.Error())
+		}
+		if !self.accept(tokenOp, ")") {
+			return nil, self.errorAt(self.peek(), "expected )")
+		}
+		return &rateNode{key: key}, nil
+
+	case t.kind == tokenIdent:
+		switch t.text {
+		case "and", "or", "for":
+			return nil, self.errorAt(t, "unexpected "+t.text)
+		}
+		key, err := statKey(t.text)
+		if err != nil {
+			return nil, self.errorAt(t, err.Error())
+		}
+		return &statNode{key: key}, nil
+
+	case t.kind == tokenOp && t.text == "(":
+		node, err := self.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !self.accept(tokenOp, ")") {
+			return nil, self.errorAt(self.peek(), "expected )")
+		}
+		return node, nil
+	}
+
+	return nil, self.errorAt(t, "unexpected "+t.text)
+}
+
+// ----------------------------------------------------------------------------
+//
+// exprNode Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *numberNode) eval(env *exprEnv) (float64, bool) {
+	return self.value, true
+}
+
+func (self *numberNode) boolean() bool {
+	return false
+}
+
+func (self *statNode) eval(env *exprEnv) (float64, bool) {
+	v, ok := env.values[self.key]
+	return v, ok
+}
+
+func (self *statNode) boolean() bool {
+	return false
+}
+
+// eval the rate of a counter. A counter which went down was reset, and
+// counts from zero.
+func (self *rateNode) eval(env *exprEnv) (float64, bool) {
+	v, ok := env.values[self.key]
+	prev, hasPrev := env.previous[self.key]
+	if !ok || !hasPrev || env.elapsed <= 0 {
+		return 0, false
+	}
+	delta := v - prev
+	if delta < 0 {
+		delta = v
+	}
+	return delta / env.elapsed, true
+}
+
+func (self *rateNode) boolean() bool {
+	return false
+}
+
+func (self *negNode) eval(env *exprEnv) (float64, bool) {
+	v, ok := self.operand.eval(env)
+	return -v, ok
+}
+
+func (self *negNode) boolean() bool {
+	return false
+}
+
+func (self *binaryNode) eval(env *exprEnv) (float64, bool) {
+	l, ok := self.left.eval(env)
+	if !ok {
+		return 0, false
+	}
+	r, ok := self.right.eval(env)
+	if !ok {
+		return 0, false
+	}
+
+	switch self.op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+	return 0, false
+}
+
+func (self *binaryNode) boolean() bool {
+	return false
+}
+
+// eval the condition; a logical operator holds if it can be decided,
+// even if a stat of one side is missing
+func (self *condNode) eval(env *exprEnv) (float64, bool) {
+	l, lok := self.left.eval(env)
+	r, rok := self.right.eval(env)
+
+	switch self.op {
+	case "and":
+		if (lok && l == 0) || (rok && r == 0) {
+			return 0, true
+		}
+		return boolValue(lok && rok), lok && rok
+	case "or":
+		if (lok && l != 0) || (rok && r != 0) {
+			return 1, true
+		}
+		return 0, lok && rok
+	}
+
+	if !lok || !rok {
+		return 0, false
+	}
+
+	switch self.op {
+	case ">":
+		return boolValue(l > r), true
+	case ">=":
+		return boolValue(l >= r), true
+	case "<":
+		return boolValue(l < r), true
+	case "<=":
+		return boolValue(l <= r), true
+	case "==":
+		return boolValue(l == r), true
+	case "!=":
+		return boolValue(l != r), true
+	}
+	return 0, false
+}
+
+func (self *condNode) boolean() bool {
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpr(t *testing.T) {
+	valid := []struct {
+		source string
+		For    time.Duration
+	}{
+		{"memory_used / memory_total > 0.8 for 5m", 5 * time.Minute},
+		{"rate(write_err) > 10/s", 0},
+		{`latency_over{threshold="1ms", histogram="reads"} > 5 and cluster_size < 3`, 0},
+		{"-a + 2 * b >= (c - 1) or (d == 1e3 and e != 0)", 0},
+	}
+	for _, test := range valid {
+		expr, err := ParseExpr(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if expr.For != test.For || expr.String() != test.source {
+			t.Errorf("%s: for %s", test.source, expr.For)
+		}
+	}
+
+	invalid := []struct {
+		source string
+		err    string
+	}{
+		{"memory_used", "expected a comparison"},
+		{"a > b > c", "unexpected >"},
+		{"a > 1 and b", "must be comparisons"},
+		{"(a > 1) > 0", "comparison of comparisons"},
+		{"a > 1 for x", "expected a duration"},
+		{"a > 1 for 5", "invalid duration"},
+		{"a > 1 for -5m", "expected a duration"},
+		{"rate(a > 1", "expected )"},
+		{"rate(1) > 1", "expected a stat"},
+		{"a{b=1} > 1", "invalid labels"},
+		{"a{b=\"1\" > 1", "unterminated labels"},
+		{"a ! b", "unexpected \"!\""},
+		{"a > ", "unexpected end"},
+		{"for > 1", "unexpected for"},
+	}
+	for _, test := range invalid {
+		_, err := ParseExpr(test.source)
+		if err == nil || !strings.HasPrefix(err.Error(), ErrorInvalidExpr.Error()) || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: %v, expected %q", test.source, err, test.err)
+		}
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		source   string
+		values   map[string]float64
+		previous map[string]float64
+		elapsed  float64
+		holds    bool
+		value    float64
+		ok       bool
+	}{
+		{"a > 1", map[string]float64{"a": 2}, nil, 0, true, 2, true},
+		{"a > 1", map[string]float64{"a": 0}, nil, 0, false, 0, true},
+		{"a * 2 - 1 >= 3", map[string]float64{"a": 2}, nil, 0, true, 3, true},
+		{"x > 600/m", map[string]float64{"x": 11}, nil, 0, true, 11, true},
+		{`m{b="2",a="1"} == 1`, map[string]float64{`m{a="1",b="2"}`: 1}, nil, 0, true, 1, true},
+
+		// missing stats and undefined values leave it undecided
+		{"a > 1", map[string]float64{}, nil, 0, false, 0, false},
+		{"a / b > 1", map[string]float64{"a": 1, "b": 0}, nil, 0, false, 0, false},
+		{"a > 1 and b > 1", map[string]float64{"a": 2}, nil, 0, false, 0, false},
+		{"a > 1 or b > 1", map[string]float64{"a": 0}, nil, 0, false, 0, false},
+
+		// unless the other side decides it
+		{"a > 1 or b > 1", map[string]float64{"a": 2}, nil, 0, true, 0, true},
+		{"a > 1 and b > 1", map[string]float64{"a": 0}, nil, 0, false, 0, true},
+
+		// rates, across counter resets
+		{"rate(c) > 1/s", map[string]float64{"c": 70}, map[string]float64{"c": 10}, 30, true, 2, true},
+		{"rate(c) > 1/s", map[string]float64{"c": 30}, map[string]float64{"c": 100}, 10, true, 3, true},
+		{"rate(c) > 1/s", map[string]float64{"c": 5}, map[string]float64{"c": 100}, 10, false, 0, true},
+		{"rate(c) > 1/s", map[string]float64{"c": 70}, nil, 0, false, 0, false},
+		{"rate(c) > 1/s", map[string]float64{"c": 70}, map[string]float64{"d": 10}, 30, false, 0, false},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env := &exprEnv{values: test.values, previous: test.previous, elapsed: test.elapsed}
+		holds, value, ok := expr.eval(env)
+		if holds != test.holds || value != test.value || ok != test.ok {
+			t.Errorf("%s %v: %v %g %v, expected %v %g %v", test.source, test.values, holds, value, ok, test.holds, test.value, test.ok)
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/client"
+	"github.com/aerospike-labs/minion/service"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// nodes operated on at once, by default
+	fleetConcurrency int = 4
+
+	// seconds a restarted node has to become healthy, by default
+	fleetHealthTimeout int = 300
+)
+
+var (
+	// interval between status polls of a node
+	fleetPollInterval time.Duration = 2 * time.Second
+)
+
+var (
+	ErrorNodeNotFound error = errors.New("Node Not Found")
+	ErrorNodeExists   error = errors.New("Node Exists")
+	ErrorInvalidNode  error = errors.New("Invalid Node")
+	ErrorNodeSkipped  error = errors.New("Skipped After Failure")
+	ErrorHealthGate   error = errors.New("Node Not Healthy")
+	ErrorFleetFailed  error = errors.New("Fleet Operation Failed")
+)
+
+// A minion of the fleet. The token authenticates the controller to it.
+type FleetNode struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+}
+
+// Fleet is the controller of a fleet of minions, with the inventory kept
+// in a file. Operations fan out to the nodes as jobs of the controller.
+type Fleet struct {
+	context *ServiceContext
+	file    string
+	mutex   sync.RWMutex
+	nodes   map[string]*FleetNode
+}
+
+// Arguments for Fleet.Install. Without Nodes, all nodes are targeted.
+type FleetInstall struct {
+	Nodes       []string              `json:"nodes,omitempty"`
+	Concurrency int                   `json:"concurrency,omitempty"`
+	Service     client.ServiceInstall `json:"service"`
+}
+
+// Arguments for Fleet.Start, Fleet.Stop, Fleet.Restart and Fleet.Stats.
+// Without Nodes, all nodes are targeted.
+//
+// Restart is a rolling operation, see Fleet.Roll: Concurrency nodes
+// restart at once, defaulting to 1, and each must be running and healthy
+// within HealthTimeout seconds before the next starts. A failure stops
+// the roll.
+type FleetCommand struct {
+	Nodes         []string `json:"nodes,omitempty"`
+	Service       string   `json:"service"`
+	Concurrency   int      `json:"concurrency,omitempty"`
+	HealthTimeout int      `json:"health_timeout,omitempty"`
+}
+
+// Stats of a service across the fleet, as returned by Fleet.Stats.
+// Totals sums the numeric stats of the nodes.
+type FleetStats struct {
+	Nodes  map[string]client.Stats `json:"nodes"`
+	Errors map[string]string       `json:"errors,omitempty"`
+	Totals map[string]float64      `json:"totals"`
+}
+
+// Data of "fleet" events
+type FleetEvent struct {
+	Job     string `json:"job"`
+	Node    string `json:"node"`
+	Service string `json:"service"`
+	Step    string `json:"step"`
+	Error   string `json:"error,omitempty"`
+}
+
+// The inventory file
+type fleetInventory struct {
+	Nodes []*FleetNode `json:"nodes"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// LoadFleet loads the inventory in `file`. A missing file is an empty
+// inventory.
+func LoadFleet(file string, context *ServiceContext) (*Fleet, error) {
+
+	if !path.IsAbs(file) {
+		file = path.Join(rootPath, file)
+	}
+
+	fleet := &Fleet{
+		context: context,
+		file:    file,
+		nodes:   map[string]*FleetNode{},
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return fleet, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var inventory fleetInventory
+	if err = json.Unmarshal(data, &inventory); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	for _, node := range inventory.Nodes {
+		if node.Name == "" || node.URL == "" {
+			return nil, fmt.Errorf("%s: %s", file, ErrorInvalidNode.Error())
+		}
+		fleet.nodes[node.Name] = node
+	}
+
+	log.Printf("info: loaded fleet of %d nodes\n", len(fleet.nodes))
+	return fleet, nil
+}
+
+// fanOut runs `fn` for each of `names`, `concurrency` at once. If `abort`
+// is set, those not yet started when one fails are skipped.
+// Returns the error of each name.
+func fanOut(ctx context.Context, names []string, concurrency int, abort bool, fn func(ctx context.Context, i int) error) map[string]error {
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	if concurrency <= 0 {
+		concurrency = fleetConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+	results := map[string]error{}
+	failed := false
+
+	for i, name := range names {
+		slots <- struct{}{}
+
+		mutex.Lock()
+		if (abort && failed) || ctx.Err() != nil {
+			results[name] = ErrorNodeSkipped
+			mutex.Unlock()
+			<-slots
+			continue
+		}
+		mutex.Unlock()
+
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := fn(ctx, i)
+
+			mutex.Lock()
+			results[name] = err
+			if err != nil {
+				failed = true
+			}
+			mutex.Unlock()
+		}(i, name)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// nodeNames returns the names of the nodes
+func nodeNames(nodes []*FleetNode) []string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	return names
+}
+
+// ----------------------------------------------------------------------------
+//
+// Fleet RPC Methods
+//
+// ----------------------------------------------------------------------------
+
+// Nodes of the fleet, without their tokens
+func (self *Fleet) Nodes(req *http.Request, args *struct{}, res *[]FleetNode) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	nodes := []FleetNode{}
+	for _, node := range self.nodes {
+		nodes = append(nodes, FleetNode{Name: node.Name, URL: node.URL})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	*res = nodes
+	return nil
+}
+
+// Add a node to the fleet
+func (self *Fleet) Add(req *http.Request, node *FleetNode, res *bool) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if node.Name == "" || node.URL == "" {
+		return ErrorInvalidNode
+	}
+	if _, exists := self.nodes[node.Name]; exists {
+		return ErrorNodeExists
+	}
+
+	added := *node
+	self.nodes[node.Name] = &added
+	if err := self.save(); err != nil {
+		delete(self.nodes, node.Name)
+		return err
+	}
+
+	*res = true
+	return nil
+}
+
+// Remove a node from the fleet
+func (self *Fleet) Remove(req *http.Request, name *string, res *bool) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	node, exists := self.nodes[*name]
+	if !exists {
+		return ErrorNodeNotFound
+	}
+
+	delete(self.nodes, *name)
+	if err := self.save(); err != nil {
+		self.nodes[*name] = node
+		return err
+	}
+
+	*res = true
+	return nil
+}
+
+// Install a service on the nodes. Returns the id of the controller's job.
+func (self *Fleet) Install(req *http.Request, args *FleetInstall, res *string) error {
+
+	nodes, err := self.selectNodes(args.Nodes)
+	if err != nil {
+		return err
+	}
+
+	svc := args.Service
+	job := self.context.Jobs.start(svc.Id, "fleet-install", func(job *Job) error {
+		results := fanOut(job.Context(), nodeNames(nodes), args.Concurrency, false, func(ctx context.Context, i int) error {
+			return self.onNode(job, nodes[i], svc.Id, func(c *client.Client) error {
+				self.event(job, nodes[i], svc.Id, "install", nil)
+				jobId, err := c.Install(ctx, &svc)
+				if err != nil {
+					return err
+				}
+				return self.wait(ctx, c, jobId)
+			})
+		})
+		return self.report(job, results)
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+// Start a service on the nodes. Returns the id of the controller's job.
+func (self *Fleet) Start(req *http.Request, args *FleetCommand, res *string) error {
+	return self.command(args, "start", res, func(ctx context.Context, c *client.Client, serviceId string) (string, error) {
+		return c.Start(ctx, serviceId)
+	})
+}
+
+// Stop a service on the nodes. Returns the id of the controller's job.
+func (self *Fleet) Stop(req *http.Request, args *FleetCommand, res *string) error {
+	return self.command(args, "stop", res, func(ctx context.Context, c *client.Client, serviceId string) (string, error) {
+		return c.Stop(ctx, serviceId)
+	})
+}
+
+// Restart a service on the nodes, rolling. Returns the id of the
+// controller's job.
+func (self *Fleet) Restart(req *http.Request, args *FleetCommand, res *string) error {
+
+	nodes, err := self.selectNodes(args.Nodes)
+	if err != nil {
+		return err
+	}
+
+	op := &RollingOperation{
+		Concurrency: args.Concurrency,
+		Timeout:     args.HealthTimeout,
+	}
+	for _, node := range nodes {
+		op.Targets = append(op.Targets, RollingTarget{Node: node.Name, Service: args.Service})
+	}
+
+	return self.Roll(req, op, res)
+}
+
+// Stats of a service across the nodes
+func (self *Fleet) Stats(req *http.Request, args *FleetCommand, res *FleetStats) error {
+
+	nodes, err := self.selectNodes(args.Nodes)
+	if err != nil {
+		return err
+	}
+
+	var mutex sync.Mutex
+	stats := &FleetStats{
+		Nodes:  map[string]client.Stats{},
+		Errors: map[string]string{},
+		Totals: map[string]float64{},
+	}
+
+	fanOut(req.Context(), nodeNames(nodes), args.Concurrency, false, func(ctx context.Context, i int) error {
+		node := nodes[i]
+		s, err := self.client(node).Stats(ctx, args.Service)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err != nil {
+			stats.Errors[node.Name] = err.Error()
+			return err
+		}
+		stats.Nodes[node.Name] = s
+		for name, value := range s {
+			if v, ok := value.(float64); ok {
+				stats.Totals[name] += v
+			}
+		}
+		return nil
+	})
+
+	*res = *stats
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Fleet Methods
+//
+// ----------------------------------------------------------------------------
+
+// command runs a job returning method on the nodes
+func (self *Fleet) command(args *FleetCommand, name string, res *string, fn func(ctx context.Context, c *client.Client, serviceId string) (string, error)) error {
+
+	nodes, err := self.selectNodes(args.Nodes)
+	if err != nil {
+		return err
+	}
+
+	job := self.context.Jobs.start(args.Service, "fleet-"+name, func(job *Job) error {
+		results := fanOut(job.Context(), nodeNames(nodes), args.Concurrency, false, func(ctx context.Context, i int) error {
+			return self.onNode(job, nodes[i], args.Service, func(c *client.Client) error {
+				self.event(job, nodes[i], args.Service, name, nil)
+				jobId, err := fn(ctx, c, args.Service)
+				if err != nil {
+					return err
+				}
+				return self.wait(ctx, c, jobId)
+			})
+		})
+		return self.report(job, results)
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+// selectNodes returns the named nodes, or all nodes, sorted by name
+func (self *Fleet) selectNodes(names []string) ([]*FleetNode, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	nodes := []*FleetNode{}
+	if len(names) == 0 {
+		for _, node := range self.nodes {
+			nodes = append(nodes, node)
+		}
+	} else {
+		for _, name := range names {
+			node, exists := self.nodes[name]
+			if !exists {
+				return nil, fmt.Errorf("%s: %s", ErrorNodeNotFound.Error(), name)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes, nil
+}
+
+// client of a node
+func (self *Fleet) client(node *FleetNode) *client.Client {
+	c := client.New(node.URL)
+	c.Token = node.Token
+	return c
+}
+
+// wait for a job on a node
+func (self *Fleet) wait(ctx context.Context, c *client.Client, jobId string) error {
+	info, err := c.Wait(ctx, jobId)
+	if err != nil && info != nil && info.Error != "" {
+		return fmt.Errorf("%s: %s", err.Error(), info.Error)
+	}
+	return err
+}
+
+// healthy waits for the service on a node to be running, and healthy if
+// it has health checks
+func (self *Fleet) healthy(ctx context.Context, c *client.Client, serviceId string, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	last := ""
+
+	for {
+		status, err := c.Status(ctx, serviceId)
+		if err != nil {
+			last = err.Error()
+		} else {
+			health, checked := status.Health["status"]
+			if status.State == service.Running && (!checked || health == HealthHealthy) {
+				return nil
+			}
+			last = status.State.String()
+			if checked {
+				last += fmt.Sprintf(", %v", health)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: %s", ErrorHealthGate.Error(), last)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(fleetPollInterval):
+		}
+	}
+}
+
+// onNode runs `fn` with a client of the node, publishing a "done" event
+// with its result
+func (self *Fleet) onNode(job *Job, node *FleetNode, serviceId string, fn func(c *client.Client) error) error {
+	err := fn(self.client(node))
+	self.event(job, node, serviceId, "done", err)
+	return err
+}
+
+// report the results to the job
+func (self *Fleet) report(job *Job, results map[string]error) error {
+
+	names := []string{}
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := 0
+	skipped := 0
+	for _, name := range names {
+		err := results[name]
+		switch err {
+		case nil:
+			job.printf("%s: ok", name)
+		case ErrorNodeSkipped:
+			skipped++
+			job.printf("%s: %s", name, err.Error())
+		default:
+			failures++
+			job.printf("%s: %s", name, err.Error())
+		}
+	}
+
+	if failures > 0 || skipped > 0 {
+		return fmt.Errorf("%s: %d failed, %d skipped of %d", ErrorFleetFailed.Error(), failures, skipped, len(names))
+	}
+	return nil
+}
+
+// event publishes a "fleet" event
+func (self *Fleet) event(job *Job, node *FleetNode, serviceId string, step string, err error) {
+	e := &FleetEvent{
+		Job:     job.Id(),
+		Node:    node.Name,
+		Service: serviceId,
+		Step:    step,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	sendEvent(self.context.SendEventMessage, "fleet", e)
+}
+
+// save the inventory. Must hold the lock.
+func (self *Fleet) save() error {
+
+	inventory := fleetInventory{Nodes: []*FleetNode{}}
+	for _, node := range self.nodes {
+		inventory.Nodes = append(inventory.Nodes, node)
+	}
+	sort.Slice(inventory.Nodes, func(i, j int) bool { return inventory.Nodes[i].Name < inventory.Nodes[j].Name })
+
+	data, err := json.MarshalIndent(&inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(self.file), 0755); err != nil {
+		return err
+	}
+
+	// the inventory holds tokens
+	tmp := self.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.file)
+}
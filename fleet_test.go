@@ -0,0 +1,349 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/client"
+	"github.com/aerospike-labs/minion/service"
+
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	jsonrpc "github.com/gorilla/rpc/v2/json"
+)
+
+// The calls made to the minions of a fleet test, and how many ran at once
+type fleetCalls struct {
+	mutex    sync.Mutex
+	calls    []string
+	inFlight int
+	most     int
+}
+
+// A minion of a fleet test, failing the methods in `fail`. Its jobs
+// finish as soon as they are started.
+type fakeMinion struct {
+	name  string
+	fail  map[string]bool
+	calls *fleetCalls
+	state service.Status
+
+	// aerospike minions report migrations, one fewer on each stats call
+	aerospike  bool
+	migrations int
+}
+
+// fakeJobs answers Job.Wait for a fake minion
+type fakeJobs struct{}
+
+func (self *fakeJobs) Wait(req *http.Request, args *JobWait, res *client.JobInfo) error {
+	*res = client.JobInfo{Id: args.Id, State: client.JobSucceeded}
+	return nil
+}
+
+// call records a call, failing it if it is in `fail`
+func (self *fakeMinion) call(method string) error {
+	self.calls.mutex.Lock()
+	self.calls.calls = append(self.calls.calls, self.name+" "+method)
+	self.calls.inFlight++
+	if self.calls.inFlight > self.calls.most {
+		self.calls.most = self.calls.inFlight
+	}
+	self.calls.mutex.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	self.calls.mutex.Lock()
+	self.calls.inFlight--
+	self.calls.mutex.Unlock()
+
+	if self.fail[method] {
+		return errors.New(method + " failed")
+	}
+	return nil
+}
+
+func (self *fakeMinion) Install(req *http.Request, svc *client.ServiceInstall, res *string) error {
+	*res = self.name + "-install"
+	return self.call("install")
+}
+
+func (self *fakeMinion) Start(req *http.Request, serviceId *string, res *string) error {
+	*res = self.name + "-start"
+	if err := self.call("start"); err != nil {
+		return err
+	}
+	self.state = service.Running
+	return nil
+}
+
+func (self *fakeMinion) Stop(req *http.Request, serviceId *string, res *string) error {
+	*res = self.name + "-stop"
+	if err := self.call("stop"); err != nil {
+		return err
+	}
+	self.state = service.Stopped
+	return nil
+}
+
+func (self *fakeMinion) Status(req *http.Request, serviceId *string, res *client.ServiceStatus) error {
+	res.Id = *serviceId
+	res.State = self.state
+	return nil
+}
+
+func (self *fakeMinion) Stats(req *http.Request, serviceId *string, res *client.Stats) error {
+	if err := self.call("stats"); err != nil {
+		return err
+	}
+	*res = client.Stats{"requests": float64(len(self.name)), "version": "1"}
+	if self.aerospike {
+		(*res)["migrate_progress_send"] = float64(self.migrations)
+		(*res)["migrate_progress_recv"] = "0"
+		if self.migrations > 0 {
+			self.migrations--
+		}
+	}
+	return nil
+}
+
+// newFleet returns a fleet of fake minions, named by `names`
+func newFleet(t *testing.T, names []string, fail map[string]map[string]bool) (*ServiceContext, *Fleet, *fleetCalls) {
+	ctx, fleet, calls, _ := newFakeMinions(t, names, fail)
+	return ctx, fleet, calls
+}
+
+// newFakeMinions returns a fleet of fake minions, named by `names`, and
+// the minions
+func newFakeMinions(t *testing.T, names []string, fail map[string]map[string]bool) (*ServiceContext, *Fleet, *fleetCalls, map[string]*fakeMinion) {
+	t.Helper()
+
+	ctx := newTestContext(t)
+	fleet, err := LoadFleet("etc/fleet.json", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := &fleetCalls{}
+	minions := map[string]*fakeMinion{}
+	for _, name := range names {
+		minions[name] = &fakeMinion{name: name, fail: fail[name], calls: calls, state: service.Running}
+		rpcServer := rpc.NewServer()
+		rpcServer.RegisterCodec(jsonrpc.NewCodec(), "application/json")
+		rpcServer.RegisterService(minions[name], "Service")
+		rpcServer.RegisterService(&fakeJobs{}, "Job")
+		server := httptest.NewServer(rpcServer)
+		t.Cleanup(server.Close)
+
+		var added bool
+		if err = fleet.Add(nil, &FleetNode{Name: name, URL: server.URL}, &added); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ctx, fleet, calls, minions
+}
+
+func (self *fleetCalls) list() []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]string{}, self.calls...)
+}
+
+func (self *fleetCalls) atOnce() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.most
+}
+
+func TestFleetInstall(t *testing.T) {
+	ctx, fleet, calls := newFleet(t, []string{"a", "b", "c"}, map[string]map[string]bool{
+		"c": {"install": true},
+	})
+
+	var jobId string
+	args := &FleetInstall{Concurrency: 2, Service: client.ServiceInstall{Id: "svc", URL: "file:///svc"}}
+	if err := fleet.Install(nil, args, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	info := waitJob(t, ctx, jobId)
+
+	// one failure fails the job, not the other nodes
+	if !strings.HasSuffix(info.Error, "1 failed, 0 skipped of 3") {
+		t.Fatalf("install: %s %s", info.State, info.Error)
+	}
+	for _, line := range []string{"a: ok", "b: ok", "install failed"} {
+		if !strings.Contains(info.Output, line) {
+			t.Errorf("output missing %q: %s", line, info.Output)
+		}
+	}
+	if n := len(calls.list()); n != 3 {
+		t.Errorf("%d installs", n)
+	}
+	if n := calls.atOnce(); n != 2 {
+		t.Errorf("%d installs at once, expected 2", n)
+	}
+}
+
+// Restarts roll one node at a time, and skip the rest after a failure
+func TestFleetRestartAbort(t *testing.T) {
+	ctx, fleet, calls := newFleet(t, []string{"a", "b", "c"}, map[string]map[string]bool{
+		"b": {"stop": true},
+	})
+
+	var jobId string
+	if err := fleet.Restart(nil, &FleetCommand{Service: "svc", HealthTimeout: 5}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	info := waitJob(t, ctx, jobId)
+
+	if !strings.HasSuffix(info.Error, "1 failed, 1 skipped of 3") {
+		t.Fatalf("restart: %s %s", info.State, info.Error)
+	}
+	if !strings.Contains(info.Output, "c/svc: "+ErrorNodeSkipped.Error()) {
+		t.Errorf("c not skipped: %s", info.Output)
+	}
+
+	expected := []string{"a stop", "a start", "b stop"}
+	if got := calls.list(); strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("calls %v, expected %v", got, expected)
+	}
+	if n := calls.atOnce(); n != 1 {
+		t.Errorf("%d restarts at once", n)
+	}
+}
+
+// Stats fan out, reporting the nodes which failed
+func TestFleetStats(t *testing.T) {
+	_, fleet, _ := newFleet(t, []string{"a", "bb", "ccc"}, map[string]map[string]bool{
+		"ccc": {"stats": true},
+	})
+
+	var stats FleetStats
+	req := httptest.NewRequest("POST", "/rpc", nil)
+	if err := fleet.Stats(req, &FleetCommand{Service: "svc"}, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.Nodes) != 2 || stats.Nodes["a"] == nil || stats.Nodes["bb"] == nil {
+		t.Errorf("nodes: %v", stats.Nodes)
+	}
+	if !strings.Contains(stats.Errors["ccc"], "stats failed") || len(stats.Errors) != 1 {
+		t.Errorf("errors: %v", stats.Errors)
+	}
+	if stats.Totals["requests"] != 3 || len(stats.Totals) != 1 {
+		t.Errorf("totals: %v", stats.Totals)
+	}
+}
+
+// Services which are down are started, not stopped first
+func TestFleetRestartDown(t *testing.T) {
+	ctx, fleet, calls, minions := newFakeMinions(t, []string{"a", "b"}, nil)
+	minions["a"].state = service.Stopped
+	minions["b"].state = service.Failed
+
+	var jobId string
+	if err := fleet.Restart(nil, &FleetCommand{Service: "svc", HealthTimeout: 5}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+		t.Fatalf("restart: %s %s", info.State, info.Error)
+	}
+
+	expected := []string{"a start", "b start"}
+	if got := calls.list(); strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("calls %v, expected %v", got, expected)
+	}
+}
+
+func TestReadyConditionHolds(t *testing.T) {
+	stats := client.Stats{"pending": float64(3), "parsed": "0", "version": "3.8.1"}
+
+	tests := []struct {
+		condition ReadyCondition
+		holds     bool
+	}{
+		{ReadyCondition{"pending", "==", 3}, true},
+		{ReadyCondition{"pending", "!=", 3}, false},
+		{ReadyCondition{"pending", "<", 3}, false},
+		{ReadyCondition{"pending", "<=", 3}, true},
+		{ReadyCondition{"pending", ">", 2}, true},
+		{ReadyCondition{"pending", ">=", 4}, false},
+		{ReadyCondition{"parsed", "==", 0}, true},
+		// stats which are missing, or not numbers, never hold
+		{ReadyCondition{"version", "!=", 0}, false},
+		{ReadyCondition{"missing", "!=", 0}, false},
+	}
+
+	for _, test := range tests {
+		if holds := test.condition.holds(stats); holds != test.holds {
+			t.Errorf("%s: %v", test.condition.String(), holds)
+		}
+	}
+}
+
+// rollAerospike rolls the aerospike minion "a", migrating for
+// `migrations` stats calls, returning the job, how long it took, and the
+// number of stats polls
+func rollAerospike(t *testing.T, migrations int, settle int, timeout int) (JobInfo, time.Duration, int) {
+	t.Helper()
+
+	interval := fleetPollInterval
+	fleetPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { fleetPollInterval = interval })
+
+	ctx, fleet, calls, minions := newFakeMinions(t, []string{"a"}, nil)
+	minions["a"].aerospike = true
+	minions["a"].migrations = migrations
+
+	var jobId string
+	op := &RollingOperation{Targets: []RollingTarget{{Node: "a", Service: "svc"}}, Preset: "aerospike-migrations", Settle: settle, Timeout: timeout}
+	if err := fleet.Roll(nil, op, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	info := waitJob(t, ctx, jobId)
+
+	polls := 0
+	for _, call := range calls.list() {
+		if call == "a stats" {
+			polls++
+		}
+	}
+	return info, time.Since(start), polls
+}
+
+// Rolls wait for the stats to meet the ready conditions, for Settle
+func TestRollReady(t *testing.T) {
+	info, _, polls := rollAerospike(t, 3, 0, 5)
+	if info.State != JobSucceeded || polls != 4 {
+		t.Fatalf("roll: %s %s, %d polls", info.State, info.Error, polls)
+	}
+
+	info, elapsed, polls := rollAerospike(t, 3, 1, 5)
+	if info.State != JobSucceeded || elapsed < time.Second || polls < 6 {
+		t.Fatalf("settled roll: %s %s, %d polls in %s", info.State, info.Error, polls, elapsed)
+	}
+}
+
+// Rolls fail once the timeout passes without the conditions met
+func TestRollNotReady(t *testing.T) {
+	info, elapsed, _ := rollAerospike(t, 1<<30, 0, 1)
+	if info.State != JobFailed || !strings.Contains(info.Output, ErrorNotReady.Error()+": migrate_progress_send == 0") {
+		t.Fatalf("roll: %s %s: %s", info.State, info.Error, info.Output)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("timed out after %s", elapsed)
+	}
+
+	// presets are checked before rolling
+	_, fleet, _ := newFleet(t, []string{"a"}, nil)
+	var jobId string
+	op := &RollingOperation{Targets: []RollingTarget{{Node: "a", Service: "svc"}}, Preset: "unknown"}
+	if err := fleet.Roll(nil, op, &jobId); err == nil || !strings.HasPrefix(err.Error(), ErrorUnknownPreset.Error()) {
+		t.Fatalf("unknown preset: %v", err)
+	}
+}
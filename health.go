@@ -0,0 +1,405 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	ProbeTCP     string = "tcp"
+	ProbeHTTP    string = "http"
+	ProbeExec    string = "exec"
+	ProbeService string = "service"
+)
+
+const (
+	HealthHealthy   string = "healthy"
+	HealthUnhealthy string = "unhealthy"
+	HealthDegraded  string = "degraded"
+	HealthUnknown   string = "unknown"
+)
+
+// Health checks of a service, declared in service.json.
+//
+// Without probes, the service's own "health" command is used. An upgraded
+// service is given StartPeriod to become healthy before it is rolled back.
+// Durations are in seconds.
+type HealthConfig struct {
+	Interval    int           `json:"interval,omitempty"`
+	Timeout     int           `json:"timeout,omitempty"`
+	History     int           `json:"history,omitempty"`
+	StartPeriod int           `json:"start_period,omitempty"`
+	Probes      []HealthProbe `json:"probes,omitempty"`
+}
+
+// A probe: "tcp" connects to Address, "http" GETs URL and expects Status
+// (or any 2xx/3xx), "exec" runs Command in the service directory,
+// "service" runs the service's "health" command.
+type HealthProbe struct {
+	Name    string   `json:"name,omitempty"`
+	Type    string   `json:"type"`
+	Address string   `json:"address,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Status  int      `json:"status,omitempty"`
+	Command []string `json:"command,omitempty"`
+}
+
+type ProbeResult struct {
+	Probe    string    `json:"probe"`
+	Type     string    `json:"type"`
+	Healthy  bool      `json:"healthy"`
+	Detail   string    `json:"detail,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"`
+}
+
+// Health of a service, as returned by Service.Health
+type HealthReport struct {
+	Id      string        `json:"id"`
+	Status  string        `json:"status"`
+	Results []ProbeResult `json:"results"`
+}
+
+type healthState struct {
+	checked time.Time
+	running bool
+	status  string
+	results []ProbeResult
+}
+
+// HealthMonitor runs the health checks of services.
+type HealthMonitor struct {
+	context *ServiceContext
+	mutex   sync.Mutex
+	states  map[string]*healthState
+	done    chan struct{}
+}
+
+// ----------------------------------------------------------------------------
+//
+// HealthConfig Methods
+//
+// ----------------------------------------------------------------------------
+
+// withDefaults returns the config with unset values defaulted
+func (self HealthConfig) withDefaults() HealthConfig {
+	if self.Interval <= 0 {
+		self.Interval = 30
+	}
+	if self.Timeout <= 0 {
+		self.Timeout = 5
+	}
+	if self.History <= 0 {
+		self.History = 10
+	}
+	if self.StartPeriod <= 0 {
+		self.StartPeriod = 60
+	}
+	if len(self.Probes) == 0 {
+		self.Probes = []HealthProbe{{Type: ProbeService}}
+	}
+
+	// the probes are shared with the service.json of the service
+	probes := make([]HealthProbe, len(self.Probes))
+	copy(probes, self.Probes)
+	for i, probe := range probes {
+		if probe.Name == "" {
+			probes[i].Name = fmt.Sprintf("%s-%d", probe.Type, i)
+		}
+	}
+	self.Probes = probes
+	return self
+}
+
+// ----------------------------------------------------------------------------
+//
+// HealthMonitor Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewHealthMonitor(context *ServiceContext) *HealthMonitor {
+	return &HealthMonitor{
+		context: context,
+		states:  map[string]*healthState{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Run the monitor until Stop is called
+func (self *HealthMonitor) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case now := <-ticker.C:
+			for id, svc := range self.context.Registry.List() {
+				svc = self.context.policy(svc)
+				if svc.Health == nil {
+					continue
+				}
+				config := svc.Health.withDefaults()
+				if self.due(id, config, now) {
+					go self.check(id, config)
+				}
+			}
+		}
+	}
+}
+
+// Stop the monitor
+func (self *HealthMonitor) Stop() {
+	close(self.done)
+}
+
+func (self *HealthMonitor) state(serviceId string) *healthState {
+	state, exists := self.states[serviceId]
+	if !exists {
+		state = &healthState{status: HealthUnknown}
+		self.states[serviceId] = state
+	}
+	return state
+}
+
+// due reports whether the service should be checked at `now`
+func (self *HealthMonitor) due(serviceId string, config HealthConfig, now time.Time) bool {
+
+	// only probe services expected to be up
+	switch self.context.Registry.State(serviceId).Status {
+	case service.Running, service.Degraded, service.StatusUnknown:
+	default:
+		return false
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	state := self.state(serviceId)
+	if state.running || now.Sub(state.checked) < time.Duration(config.Interval)*time.Second {
+		return false
+	}
+	state.checked = now
+	state.running = true
+	return true
+}
+
+// check runs all probes of the service and records the results
+func (self *HealthMonitor) check(serviceId string, config HealthConfig) {
+
+	timeout := time.Duration(config.Timeout) * time.Second
+
+	results := make([]ProbeResult, 0, len(config.Probes))
+	for _, probe := range config.Probes {
+		results = append(results, self.probe(serviceId, probe, timeout))
+	}
+
+	status := rollup(results)
+
+	self.mutex.Lock()
+	state := self.state(serviceId)
+	state.running = false
+	state.status = status
+	state.results = append(state.results, results...)
+	if excess := len(state.results) - config.History*len(config.Probes); excess > 0 {
+		state.results = state.results[excess:]
+	}
+	self.mutex.Unlock()
+
+	// an unhealthy running service is degraded
+	var from service.Status
+	var changed bool
+	switch status {
+	case HealthHealthy:
+		if self.context.Registry.State(serviceId).Status == service.Degraded {
+			from, changed = self.context.Registry.Observe(serviceId, service.Running, "")
+		}
+	case HealthUnhealthy, HealthDegraded:
+		if self.context.Registry.State(serviceId).Status == service.Running {
+			from, changed = self.context.Registry.Observe(serviceId, service.Degraded, "health check failed")
+		}
+	}
+	if changed {
+		state := self.context.Registry.State(serviceId)
+		sendEvent(self.context.SendEventMessage, "lifecycle", &LifecycleEvent{Id: serviceId, From: from, State: state.Status})
+	}
+}
+
+// probe runs a single probe
+func (self *HealthMonitor) probe(serviceId string, probe HealthProbe, timeout time.Duration) ProbeResult {
+
+	result := ProbeResult{
+		Probe: probe.Name,
+		Type:  probe.Type,
+		Time:  time.Now(),
+	}
+
+	var err error = nil
+
+	switch probe.Type {
+	case ProbeTCP:
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", probe.Address, timeout)
+		if err == nil {
+			conn.Close()
+			result.Healthy = true
+		}
+	case ProbeHTTP:
+		var res *http.Response
+		client := &http.Client{Timeout: timeout}
+		res, err = client.Get(probe.URL)
+		if err == nil {
+			res.Body.Close()
+			result.Detail = res.Status
+			if probe.Status != 0 {
+				result.Healthy = res.StatusCode == probe.Status
+			} else {
+				result.Healthy = res.StatusCode >= 200 && res.StatusCode < 400
+			}
+		}
+	case ProbeExec:
+		if len(probe.Command) == 0 {
+			err = fmt.Errorf("missing command")
+			break
+		}
+		cmd := exec.Command(probe.Command[0], probe.Command[1:]...)
+		cmd.Dir = filepath.Join(rootPath, "svc", serviceId)
+		cmd.Env = self.context.getenv(serviceId, "")
+		var out []byte
+		out, err = executeTimeout(cmd, timeout)
+		result.Detail = string(bytes.TrimSpace(out))
+		result.Healthy = err == nil
+	case ProbeService:
+		var cmd *exec.Cmd
+		var out []byte
+		var health *service.HealthResult
+		cmd, err = self.context.serviceCommand(serviceId, "health", map[string]interface{}{})
+		if err != nil {
+			break
+		}
+		out, err = executeTimeout(cmd, timeout)
+		if err != nil {
+			break
+		}
+		health, err = service.ParseHealthResult(out)
+		if err == nil {
+			result.Healthy = health.Healthy
+			result.Detail = health.Detail
+		}
+	default:
+		err = fmt.Errorf("unknown probe type: %s", probe.Type)
+	}
+
+	if err != nil {
+		result.Healthy = false
+		result.Detail = err.Error()
+		log.Printf("error: health: %s: %s: %s\n", serviceId, probe.Name, err.Error())
+	}
+
+	result.Duration = time.Since(result.Time).Seconds()
+	return result
+}
+
+// report of the health of a service
+func (self *HealthMonitor) report(serviceId string) *HealthReport {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	report := &HealthReport{
+		Id:      serviceId,
+		Status:  HealthUnknown,
+		Results: []ProbeResult{},
+	}
+
+	if state, exists := self.states[serviceId]; exists {
+		report.Status = state.status
+		report.Results = append(report.Results, state.results...)
+	}
+	return report
+}
+
+// forget a removed service
+func (self *HealthMonitor) forget(serviceId string) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.states, serviceId)
+}
+
+// rollup the results of a round of probes
+func rollup(results []ProbeResult) string {
+	healthy := 0
+	for _, result := range results {
+		if result.Healthy {
+			healthy++
+		}
+	}
+
+	switch {
+	case len(results) == 0:
+		return HealthUnknown
+	case healthy == len(results):
+		return HealthHealthy
+	case healthy == 0:
+		return HealthUnhealthy
+	default:
+		return HealthDegraded
+	}
+}
+
+// executeTimeout runs the command, killing it and its children after
+// `timeout`
+func executeTimeout(cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	defer timer.Stop()
+
+	err := cmd.Wait()
+	return out.Bytes(), err
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Health Methods
+//
+// ----------------------------------------------------------------------------
+
+// Health of the Service
+func (self *ServiceContext) Health(req *http.Request, serviceId *string, res *HealthReport) error {
+	if !self.Registry.Exists(*serviceId) {
+		return service.NotFound
+	}
+	*res = *self.HealthMonitor.report(*serviceId)
+	return nil
+}
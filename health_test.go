@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Defaults are applied to a copy of the probes of service.json
+func TestHealthDefaults(t *testing.T) {
+	probes := []HealthProbe{{Type: ProbeTCP, Address: "127.0.0.1:1"}, {Name: "web", Type: ProbeHTTP}}
+	config := HealthConfig{Probes: probes}.withDefaults()
+
+	if config.Probes[0].Name != "tcp-0" || config.Probes[1].Name != "web" {
+		t.Fatalf("names: %+v", config.Probes)
+	}
+	if probes[0].Name != "" {
+		t.Fatalf("service.json probes modified: %+v", probes)
+	}
+}
+
+// A failing "health" command is reported by its exit, not as output
+// which is not a health document
+func TestHealthProbeError(t *testing.T) {
+	ctx := newTestContext(t)
+	script := strings.Replace(testService, "case \"$1\" in\nstatus)", "case \"$1\" in\nhealth)\n\texit 3 ;;\nstatus)", 1)
+	installService(t, ctx, "svc", script)
+
+	result := ctx.HealthMonitor.probe("svc", HealthProbe{Name: "svc", Type: ProbeService}, 5*time.Second)
+	if result.Healthy || result.Detail != "exit status 3" {
+		t.Fatalf("probe: %+v", result)
+	}
+}
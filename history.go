@@ -0,0 +1,435 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// interval between samples kept in the history
+	historyInterval time.Duration = time.Minute
+
+	// the history is a ring of segments, one per hour of the last day
+	historySegment  time.Duration = time.Hour
+	historySegments int64         = 24
+
+	// range of queries without one
+	historyDefaultRange time.Duration = time.Hour
+)
+
+const (
+	AggregateAvg string = "avg"
+	AggregateMin string = "min"
+	AggregateMax string = "max"
+)
+
+var (
+	ErrorInvalidRange     error = errors.New("Invalid Time Range")
+	ErrorInvalidAggregate error = errors.New("Invalid Aggregate")
+)
+
+// History keeps the stats of services on disk, under var/stats/<id>/.
+//
+// Samples are recorded by the metrics collector, at most every
+// historyInterval. Each hour of samples is appended to a segment file,
+// overwritten a day later.
+type History struct {
+	path     string
+	mutex    sync.Mutex
+	recorded map[string]time.Time
+}
+
+// A sample, as a line of a segment file. Counters lists the keys of the
+// values which are counters, or counts of histograms.
+type historySample struct {
+	Time     time.Time          `json:"time"`
+	Values   map[string]float64 `json:"values"`
+	Counters []string           `json:"counters,omitempty"`
+}
+
+// Arguments for Service.StatsHistory.
+//
+// From and To default to the last hour. Metrics selects metrics by name,
+// for all their labels, or by key, as `latency_over{histogram="reads"}`;
+// all metrics by default. With Step, in seconds, the samples are
+// downsampled with Aggregate: "avg" (the default), "min" or "max". With
+// Rate, counters are converted to per second rates before downsampling.
+type StatsHistoryArgs struct {
+	Id        string    `json:"id"`
+	From      time.Time `json:"from,omitempty"`
+	To        time.Time `json:"to,omitempty"`
+	Metrics   []string  `json:"metrics,omitempty"`
+	Step      int       `json:"step,omitempty"`
+	Aggregate string    `json:"aggregate,omitempty"`
+	Rate      bool      `json:"rate,omitempty"`
+}
+
+// History of the stats of a service, as returned by Service.StatsHistory
+type StatsHistory struct {
+	Id     string        `json:"id"`
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Step   int           `json:"step,omitempty"`
+	Series []StatsSeries `json:"series"`
+}
+
+// Points of a metric, by its key. Rate is set for counters converted to
+// rates.
+type StatsSeries struct {
+	Metric string       `json:"metric"`
+	Rate   bool         `json:"rate,omitempty"`
+	Points []StatsPoint `json:"points"`
+}
+
+type StatsPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// History Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewHistory(path string) *History {
+	return &History{
+		path:     path,
+		recorded: map[string]time.Time{},
+	}
+}
+
+// record a sample of the stats of a service, unless one was recorded less
+// than historyInterval ago
+func (self *History) record(serviceId string, t time.Time, stats *service.Stats) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if last, exists := self.recorded[serviceId]; exists && t.Sub(last) < historyInterval {
+		return
+	}
+
+	sample := &historySample{Time: t, Values: map[string]float64{}}
+	for _, m := range stats.Metrics {
+		key := m.Key()
+		sample.Values[key] = m.Value
+		if m.Kind != service.Gauge {
+			sample.Counters = append(sample.Counters, key)
+		}
+	}
+	sort.Strings(sample.Counters)
+
+	if err := self.append(serviceId, sample); err != nil {
+		log.Printf("error: history: %s: %s\n", serviceId, err.Error())
+		return
+	}
+	self.recorded[serviceId] = t
+}
+
+// append a sample to the segment of its hour. Segments last written in
+// another hour hold samples of the previous day, and are truncated.
+func (self *History) append(serviceId string, sample *historySample) error {
+
+	dir := filepath.Join(self.path, serviceId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file := self.segment(serviceId, sample.Time)
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if info, err := os.Stat(file); err == nil && slot(info.ModTime()) != slot(sample.Time) {
+		flags |= os.O_TRUNC
+	}
+
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// segment returns the file of the segment holding samples of time `t`
+func (self *History) segment(serviceId string, t time.Time) string {
+	return filepath.Join(self.path, serviceId, fmt.Sprintf("%02d.jsonl", slot(t)%historySegments))
+}
+
+// read the samples of a service between `from` and `to`, in order
+func (self *History) read(serviceId string, from time.Time, to time.Time) ([]*historySample, error) {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	oldest := now.Add(-time.Duration(historySegments) * historySegment)
+	if from.Before(oldest) {
+		from = oldest
+	}
+	if to.After(now) {
+		to = now
+	}
+
+	// each segment once, the oldest may be overwritten by the newest
+	first := slot(from)
+	if last := slot(to); first < last-historySegments+1 {
+		first = last - historySegments + 1
+	}
+
+	samples := []*historySample{}
+	for s := first; s <= slot(to); s++ {
+		t := time.Unix(s*int64(historySegment/time.Second), 0)
+		f, err := os.Open(self.segment(serviceId, t))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			sample := &historySample{}
+			if err := json.Unmarshal(scanner.Bytes(), sample); err != nil {
+				continue
+			}
+			if sample.Time.Before(from) || sample.Time.After(to) {
+				continue
+			}
+			samples = append(samples, sample)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	return samples, nil
+}
+
+// forget the history of a removed service
+func (self *History) forget(serviceId string) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.recorded, serviceId)
+	if err := os.RemoveAll(filepath.Join(self.path, serviceId)); err != nil {
+		log.Printf("error: history: %s: %s\n", serviceId, err.Error())
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext History Methods
+//
+// ----------------------------------------------------------------------------
+
+// StatsHistory returns the recorded stats of a service
+func (self *ServiceContext) StatsHistory(req *http.Request, args *StatsHistoryArgs, res *StatsHistory) error {
+
+	if !self.Registry.Exists(args.Id) {
+		return service.NotFound
+	}
+
+	to := args.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from := args.From
+	if from.IsZero() {
+		from = to.Add(-historyDefaultRange)
+	}
+	if !from.Before(to) || args.Step < 0 {
+		return ErrorInvalidRange
+	}
+
+	aggregate := args.Aggregate
+	switch aggregate {
+	case "":
+		aggregate = AggregateAvg
+	case AggregateAvg, AggregateMin, AggregateMax:
+	default:
+		return fmt.Errorf("%s: %s", ErrorInvalidAggregate.Error(), aggregate)
+	}
+
+	samples, err := self.History.read(args.Id, from, to)
+	if err != nil {
+		return err
+	}
+
+	series := historySeries(samples, args.Metrics, args.Rate)
+	if args.Step > 0 {
+		step := time.Duration(args.Step) * time.Second
+		for i := range series {
+			series[i].Points = downsample(series[i].Points, from, step, aggregate)
+		}
+	}
+
+	*res = StatsHistory{
+		Id:     args.Id,
+		From:   from,
+		To:     to,
+		Step:   args.Step,
+		Series: series,
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// slot returns the index of the hour of `t`
+func slot(t time.Time) int64 {
+	return t.Unix() / int64(historySegment/time.Second)
+}
+
+// historySeries returns the series of the selected metrics, sorted by key.
+// With `rate`, counters are converted to per second rates; a counter
+// which went down was reset, and counts from zero.
+func historySeries(samples []*historySample, metrics []string, rate bool) []StatsSeries {
+
+	points := map[string][]StatsPoint{}
+	counters := map[string]bool{}
+
+	for _, sample := range samples {
+		for _, key := range sample.Counters {
+			counters[key] = true
+		}
+		for key, value := range sample.Values {
+			if selected(key, metrics) {
+				points[key] = append(points[key], StatsPoint{Time: sample.Time, Value: value})
+			}
+		}
+	}
+
+	keys := []string{}
+	for key := range points {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := []StatsSeries{}
+	for _, key := range keys {
+		s := StatsSeries{Metric: key, Points: points[key]}
+		if rate && counters[key] {
+			s.Rate = true
+			s.Points = rates(s.Points)
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// selected reports whether a metric key matches a name or key of `metrics`
+func selected(key string, metrics []string) bool {
+	if len(metrics) == 0 {
+		return true
+	}
+	for _, m := range metrics {
+		if key == m || strings.HasPrefix(key, m+"{") {
+			return true
+		}
+	}
+	return false
+}
+
+// rates converts the points of a counter to per second rates, at the
+// time of the later point of each pair
+func rates(points []StatsPoint) []StatsPoint {
+	result := []StatsPoint{}
+	for i := 1; i < len(points); i++ {
+		seconds := points[i].Time.Sub(points[i-1].Time).Seconds()
+		if seconds <= 0 {
+			continue
+		}
+		delta := points[i].Value - points[i-1].Value
+		if delta < 0 {
+			delta = points[i].Value
+		}
+		result = append(result, StatsPoint{Time: points[i].Time, Value: delta / seconds})
+	}
+	return result
+}
+
+// downsample the points to one per `step` from `from`, at the start of
+// the step
+func downsample(points []StatsPoint, from time.Time, step time.Duration, aggregate string) []StatsPoint {
+
+	result := []StatsPoint{}
+	var bucket time.Time
+	var value float64
+	var n int
+
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		if aggregate == AggregateAvg {
+			value /= float64(n)
+		}
+		result = append(result, StatsPoint{Time: bucket, Value: value})
+	}
+
+	for _, p := range points {
+		start := from.Add(p.Time.Sub(from) / step * step)
+		if n == 0 || !start.Equal(bucket) {
+			flush()
+			bucket, value, n = start, p.Value, 1
+			continue
+		}
+		switch aggregate {
+		case AggregateMin:
+			value = math.Min(value, p.Value)
+		case AggregateMax:
+			value = math.Max(value, p.Value)
+		default:
+			value += p.Value
+		}
+		n++
+	}
+	flush()
+
+	return result
+}
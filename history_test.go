@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHistory returns a context with a history, and the test service
+// installed
+func newTestHistory(t *testing.T) *ServiceContext {
+	t.Helper()
+
+	ctx := newTestContext(t)
+	ctx.History = NewHistory(filepath.Join(rootPath, "var", "stats"))
+	installService(t, ctx, "svc", testService)
+	return ctx
+}
+
+// recordAt records a sample of the test service as if at `at`, dating its
+// segment accordingly
+func recordAt(t *testing.T, history *History, at time.Time, metrics ...service.Metric) {
+	t.Helper()
+
+	history.record("svc", at, &service.Stats{Metrics: metrics})
+	if err := os.Chtimes(history.segment("svc", at), at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seriesOf returns the series of a metric, failing the test if missing
+func seriesOf(t *testing.T, res *StatsHistory, metric string) StatsSeries {
+	t.Helper()
+
+	for _, s := range res.Series {
+		if s.Metric == metric {
+			return s
+		}
+	}
+	t.Fatalf("no series of %s: %+v", metric, res.Series)
+	return StatsSeries{}
+}
+
+// values returns the values of points, checking they are a step apart
+// from `from`
+func values(t *testing.T, points []StatsPoint, from time.Time, step time.Duration) []float64 {
+	t.Helper()
+
+	result := []float64{}
+	for _, p := range points {
+		if offset := p.Time.Sub(from); offset%step != 0 {
+			t.Fatalf("point at %s, not on a step", offset)
+		}
+		result = append(result, p.Value)
+	}
+	return result
+}
+
+// Downsampled points aggregate the samples of each step, at its start;
+// steps without samples have no point
+func TestHistoryDownsample(t *testing.T) {
+	ctx := newTestHistory(t)
+
+	from := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 10; i++ {
+		recordAt(t, ctx.History, from.Add(time.Duration(i)*time.Minute), service.Metric{Name: "used", Kind: service.Gauge, Value: float64(i + 1)})
+	}
+	recordAt(t, ctx.History, from.Add(22*time.Minute), service.Metric{Name: "used", Kind: service.Gauge, Value: 100})
+
+	tests := []struct {
+		aggregate string
+		expected  []float64
+	}{
+		{"", []float64{3, 8, 100}},
+		{AggregateMin, []float64{1, 6, 100}},
+		{AggregateMax, []float64{5, 10, 100}},
+	}
+
+	for _, test := range tests {
+		var res StatsHistory
+		args := &StatsHistoryArgs{Id: "svc", From: from, To: from.Add(30 * time.Minute), Step: 300, Aggregate: test.aggregate}
+		if err := ctx.StatsHistory(nil, args, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		points := seriesOf(t, &res, "used").Points
+		if got := values(t, points, from, 5*time.Minute); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q: %v, expected %v", test.aggregate, got, test.expected)
+		}
+		if !points[2].Time.Equal(from.Add(20 * time.Minute)) {
+			t.Errorf("%q: last point at %s", test.aggregate, points[2].Time.Sub(from))
+		}
+	}
+
+	var res StatsHistory
+	args := &StatsHistoryArgs{Id: "svc", From: from, Step: 60, Aggregate: "median"}
+	if err := ctx.StatsHistory(nil, args, &res); err == nil {
+		t.Fatal("median: no error")
+	}
+}
+
+// Counters are converted to per second rates, counting from zero after a
+// reset; gauges are left as they are
+func TestHistoryRate(t *testing.T) {
+	ctx := newTestHistory(t)
+
+	from := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, requests := range []float64{0, 60, 180, 30, 90} {
+		recordAt(t, ctx.History, from.Add(time.Duration(i)*time.Minute),
+			service.Metric{Name: "requests", Kind: service.Counter, Value: requests},
+			service.Metric{Name: "used", Kind: service.Gauge, Value: requests})
+	}
+
+	var res StatsHistory
+	args := &StatsHistoryArgs{Id: "svc", From: from, To: from.Add(10 * time.Minute), Rate: true}
+	if err := ctx.StatsHistory(nil, args, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := seriesOf(t, &res, "requests")
+	if got := values(t, requests.Points, from, time.Minute); !requests.Rate || !reflect.DeepEqual(got, []float64{1, 2, 0.5, 1}) {
+		t.Fatalf("requests: %v %v", requests.Rate, got)
+	}
+	if !requests.Points[0].Time.Equal(from.Add(time.Minute)) {
+		t.Fatalf("first rate at %s", requests.Points[0].Time.Sub(from))
+	}
+	used := seriesOf(t, &res, "used")
+	if got := values(t, used.Points, from, time.Minute); used.Rate || !reflect.DeepEqual(got, []float64{0, 60, 180, 30, 90}) {
+		t.Fatalf("used: %v %v", used.Rate, got)
+	}
+
+	// rates are downsampled
+	args.Step = 120
+	if err := ctx.StatsHistory(nil, args, &res); err != nil {
+		t.Fatal(err)
+	}
+	if got := values(t, seriesOf(t, &res, "requests").Points, from, 2*time.Minute); !reflect.DeepEqual(got, []float64{1, 1.25, 1}) {
+		t.Fatalf("downsampled rates: %v", got)
+	}
+}
+
+// The segments of a day ago are overwritten by the samples of their hour
+// today, and read once
+func TestHistoryRing(t *testing.T) {
+	ctx := newTestHistory(t)
+
+	now := time.Now()
+	for k := historySegments + 1; k >= 0; k-- {
+		at := now.Add(-time.Duration(k) * historySegment)
+		recordAt(t, ctx.History, at, service.Metric{Name: "hours", Kind: service.Gauge, Value: float64(k)})
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(rootPath, "var", "stats", "svc"))
+	if err != nil || int64(len(files)) != historySegments {
+		t.Fatalf("segments: %d %v", len(files), err)
+	}
+	data, err := ioutil.ReadFile(ctx.History.segment("svc", now))
+	if err != nil || strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("segment not overwritten: %q %v", data, err)
+	}
+
+	samples, err := ctx.History.read("svc", now.Add(-2*time.Duration(historySegments)*historySegment), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(samples)) != historySegments {
+		t.Fatalf("read %d samples", len(samples))
+	}
+	for i, sample := range samples {
+		if expected := float64(historySegments - 1 - int64(i)); sample.Values["hours"] != expected {
+			t.Fatalf("sample %d: %v, expected %v", i, sample.Values, expected)
+		}
+	}
+
+	// forgotten with the service
+	ctx.History.forget("svc")
+	if _, err := os.Stat(filepath.Join(rootPath, "var", "stats", "svc")); !os.IsNotExist(err) {
+		t.Fatalf("forgotten: %v", err)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+const (
+	// number of finished jobs to retain
+	jobRetain int = 100
+
+	// upper bound for Job.Wait, kept below the HTTP write timeout
+	jobWaitMax time.Duration = 8 * time.Second
+)
+
+var (
+	ErrorJobNotFound  error = errors.New("Job Not Found")
+	ErrorJobCancelled error = errors.New("Job Cancelled")
+	ErrorJobFinished  error = errors.New("Job Finished")
+)
+
+// Job information, as returned by the RPC methods
+type JobInfo struct {
+	Id       string     `json:"id"`
+	Service  string     `json:"service"`
+	Command  string     `json:"command"`
+	State    JobState   `json:"state"`
+	Started  time.Time  `json:"started"`
+	Ended    *time.Time `json:"ended,omitempty"`
+	ExitCode int        `json:"exit_code"`
+	Output   string     `json:"output"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// A long-running operation on a service
+type Job struct {
+	mutex     sync.Mutex
+	info      JobInfo
+	output    bytes.Buffer
+	process   *os.Process
+	cancelled bool
+	done      chan struct{}
+	send      func(data, event, id string)
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// Arguments for Job.Wait
+type JobWait struct {
+	Id      string `json:"id"`
+	Timeout int    `json:"timeout"`
+}
+
+type JobContext struct {
+	SendEventMessage func(data, event, id string)
+
+	mutex sync.RWMutex
+	jobs  map[string]*Job
+	order []string
+	next  uint64
+}
+
+// Data of "job" and "output" events
+type JobEvent struct {
+	Id      string   `json:"id"`
+	Service string   `json:"service"`
+	Command string   `json:"command"`
+	State   JobState `json:"state,omitempty"`
+	Line    string   `json:"line,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// Job Methods
+//
+// ----------------------------------------------------------------------------
+
+// Write appends to the job's captured output.
+func (self *Job) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.output.Write(p)
+}
+
+// printf writes a line to the job's output, publishing it as an "output"
+// event, for jobs reporting progress of their own.
+func (self *Job) printf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	self.Write([]byte(line + "\n"))
+	self.event("output", "", line)
+}
+
+// Info returns a snapshot of the job
+func (self *Job) Info() JobInfo {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	info := self.info
+	info.Output = self.output.String()
+	return info
+}
+
+func (self *Job) Id() string {
+	return self.info.Id
+}
+
+func (self *Job) finished() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel the job, killing the process group of the running command.
+func (self *Job) Cancel() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.finished() {
+		return ErrorJobFinished
+	}
+
+	self.cancelled = true
+	self.cancel()
+	if self.process != nil {
+		log.Printf("info: cancelling job=%s pid=%d\n", self.info.Id, self.process.Pid)
+		if err := syscall.Kill(-self.process.Pid, syscall.SIGKILL); err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// Context of the job, done when the job is cancelled or finished.
+// A nil job has a background context.
+func (self *Job) Context() context.Context {
+	if self == nil {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// Cancelled reports whether the job was asked to stop
+func (self *Job) Cancelled() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.cancelled
+}
+
+// attach the running process to the job, so it can be cancelled
+func (self *Job) attach(process *os.Process) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.cancelled {
+		if process != nil {
+			syscall.Kill(-process.Pid, syscall.SIGKILL)
+		}
+		return ErrorJobCancelled
+	}
+	self.process = process
+	return nil
+}
+
+func (self *Job) finish(err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.process = nil
+	ended := time.Now()
+	self.info.Ended = &ended
+
+	switch {
+	case self.cancelled:
+		self.info.State = JobCancelled
+		self.info.ExitCode = -1
+		self.info.Error = ErrorJobCancelled.Error()
+	case err != nil:
+		self.info.State = JobFailed
+		self.info.ExitCode = -1
+		self.info.Error = err.Error()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				self.info.ExitCode = ws.ExitStatus()
+			}
+		}
+	default:
+		self.info.State = JobSucceeded
+		self.info.ExitCode = 0
+	}
+
+	self.cancel()
+	close(self.done)
+}
+
+// execute a command as part of the job.
+//
+// The command runs in its own process group so cancelling the job kills
+// any children it started. Output is captured by the job and returned.
+func (self *Job) execute(cmd *exec.Cmd) ([]byte, error) {
+
+	var out bytes.Buffer
+
+	if self == nil {
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		return out.Bytes(), err
+	}
+
+	writer := &jobWriter{job: self, out: &out}
+	defer writer.flush()
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	if self.Cancelled() {
+		return nil, ErrorJobCancelled
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	if err := self.attach(cmd.Process); err != nil {
+		cmd.Wait()
+		return out.Bytes(), err
+	}
+
+	err := cmd.Wait()
+	self.attach(nil)
+
+	if self.Cancelled() {
+		return out.Bytes(), ErrorJobCancelled
+	}
+	return out.Bytes(), err
+}
+
+// event publishes a "job" or "output" event for the job
+func (self *Job) event(event string, state JobState, line string) {
+	sendEvent(self.send, event, &JobEvent{
+		Id:      self.info.Id,
+		Service: self.info.Service,
+		Command: self.info.Command,
+		State:   state,
+		Line:    line,
+	})
+}
+
+// jobWriter captures command output both for the caller and the job,
+// and publishes each complete line as an "output" event.
+type jobWriter struct {
+	mutex sync.Mutex
+	job   *Job
+	out   *bytes.Buffer
+	line  []byte
+}
+
+func (self *jobWriter) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.out.Write(p)
+	for _, b := range p {
+		if b == '\n' {
+			self.job.event("output", "", string(self.line))
+			self.line = self.line[:0]
+		} else {
+			self.line = append(self.line, b)
+		}
+	}
+	return self.job.Write(p)
+}
+
+// flush publishes a trailing partial line
+func (self *jobWriter) flush() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(self.line) > 0 {
+		self.job.event("output", "", string(self.line))
+		self.line = self.line[:0]
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// JobContext Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewJobContext() *JobContext {
+	return &JobContext{
+		jobs: map[string]*Job{},
+	}
+}
+
+// start a new job running fn in the background
+func (self *JobContext) start(serviceId string, command string, fn func(job *Job) error) *Job {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	self.mutex.Lock()
+	self.next++
+	job := &Job{
+		info: JobInfo{
+			Id:      strconv.FormatUint(self.next, 10),
+			Service: serviceId,
+			Command: command,
+			State:   JobRunning,
+			Started: time.Now(),
+		},
+		done:   make(chan struct{}),
+		send:   self.SendEventMessage,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	self.jobs[job.info.Id] = job
+	self.order = append(self.order, job.info.Id)
+	self.prune()
+	self.mutex.Unlock()
+
+	log.Printf("info: job started id=%s service=%s command=%s\n", job.info.Id, serviceId, command)
+	job.event("job", JobRunning, "")
+
+	go func() {
+		err := fn(job)
+		job.finish(err)
+		info := job.Info()
+		log.Printf("info: job finished id=%s state=%s exit=%d\n", info.Id, info.State, info.ExitCode)
+		job.event("job", info.State, "")
+	}()
+
+	return job
+}
+
+// prune finished jobs beyond the retention limit. Must hold the lock.
+func (self *JobContext) prune() {
+	excess := len(self.order) - jobRetain
+	if excess <= 0 {
+		return
+	}
+
+	order := self.order[:0]
+	for _, id := range self.order {
+		job := self.jobs[id]
+		if excess > 0 && job.finished() {
+			delete(self.jobs, id)
+			excess--
+			continue
+		}
+		order = append(order, id)
+	}
+	self.order = order
+}
+
+// drain waits for the running jobs to finish. When `ctx` is done, the
+// remaining jobs are cancelled, and waited for up to `grace`.
+func (self *JobContext) drain(ctx context.Context, grace time.Duration) error {
+
+	self.mutex.RLock()
+	running := []*Job{}
+	for _, id := range self.order {
+		if job := self.jobs[id]; !job.finished() {
+			running = append(running, job)
+		}
+	}
+	self.mutex.RUnlock()
+
+	for i, job := range running {
+		select {
+		case <-job.done:
+			continue
+		case <-ctx.Done():
+		}
+
+		for _, job := range running[i:] {
+			if !job.finished() {
+				log.Printf("info: cancelling job id=%s\n", job.Id())
+				job.Cancel()
+			}
+		}
+		deadline := time.After(grace)
+		for _, job := range running[i:] {
+			select {
+			case <-job.done:
+			case <-deadline:
+				return ctx.Err()
+			}
+		}
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+func (self *JobContext) get(jobId string) (*Job, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	job, exists := self.jobs[jobId]
+	return job, exists
+}
+
+// Get a Job
+func (self *JobContext) Get(req *http.Request, jobId *string, res *JobInfo) error {
+	job, exists := self.get(*jobId)
+	if !exists {
+		return ErrorJobNotFound
+	}
+	*res = job.Info()
+	return nil
+}
+
+// List Jobs
+func (self *JobContext) List(req *http.Request, args *struct{}, res *[]JobInfo) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	list := make([]JobInfo, 0, len(self.order))
+	for _, id := range self.order {
+		list = append(list, self.jobs[id].Info())
+	}
+	*res = list
+	return nil
+}
+
+// Cancel a Job
+func (self *JobContext) Cancel(req *http.Request, jobId *string, res *bool) error {
+	job, exists := self.get(*jobId)
+	if !exists {
+		return ErrorJobNotFound
+	}
+	if err := job.Cancel(); err != nil {
+		return err
+	}
+	*res = true
+	return nil
+}
+
+// Wait for a Job to finish, or the timeout (in seconds) to expire
+func (self *JobContext) Wait(req *http.Request, args *JobWait, res *JobInfo) error {
+	job, exists := self.get(args.Id)
+	if !exists {
+		return ErrorJobNotFound
+	}
+
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout <= 0 || timeout > jobWaitMax {
+		timeout = jobWaitMax
+	}
+
+	select {
+	case <-job.done:
+	case <-time.After(timeout):
+	}
+
+	*res = job.Info()
+	return nil
+}
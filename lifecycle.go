@@ -0,0 +1,204 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+var (
+	ErrorExitedAfterStart error = errors.New("Service Exited After Start")
+	ErrorExitedUnexpected error = errors.New("Service Exited Unexpectedly")
+)
+
+// State of a service, as tracked by minion across its lifecycle
+type ServiceState struct {
+	Status    service.Status `json:"status"`
+	LastError string         `json:"last_error,omitempty"`
+	Changed   time.Time      `json:"changed"`
+}
+
+// Error returned when an operation is not valid in the current state
+type TransitionError struct {
+	Id   string
+	From service.Status
+	To   service.Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("Invalid Transition: %s is %s, cannot become %s", e.Id, e.From, e.To)
+}
+
+// Valid lifecycle transitions, from => to.
+//
+// StatusUnknown is the state of services found on disk at startup, before
+// they are observed, so any transition is valid from it.
+var transitions = map[service.Status][]service.Status{
+	service.NotInstalled: {service.Installing},
+	service.Installing:   {service.Stopped, service.NotInstalled},
+	service.Stopped:      {service.Starting, service.Running, service.NotInstalled},
+	service.Starting:     {service.Running, service.Degraded, service.Failed},
+	service.Running:      {service.Stopping, service.Degraded, service.Failed},
+	service.Degraded:     {service.Stopping, service.Running, service.Failed},
+	service.Stopping:     {service.Stopped, service.Failed},
+	service.Failed:       {service.Starting, service.Stopping, service.Stopped, service.Running, service.NotInstalled},
+}
+
+// transitional states are owned by the operation in progress
+func transitional(status service.Status) bool {
+	switch status {
+	case service.Installing, service.Starting, service.Stopping:
+		return true
+	}
+	return false
+}
+
+func canTransition(from service.Status, to service.Status) bool {
+	if from == service.StatusUnknown {
+		return true
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+//
+// Registry Lifecycle Methods
+//
+// ----------------------------------------------------------------------------
+
+// State of a service. Services without a tracked state are StatusUnknown
+// if registered, NotInstalled otherwise.
+func (self *Registry) State(serviceId string) ServiceState {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return self.state(serviceId)
+}
+
+// state of a service. Must hold the lock.
+func (self *Registry) state(serviceId string) ServiceState {
+	if state, exists := self.states[serviceId]; exists {
+		return *state
+	}
+	if _, exists := self.services[serviceId]; exists {
+		return ServiceState{Status: service.StatusUnknown}
+	}
+	return ServiceState{Status: service.NotInstalled}
+}
+
+// CanTransition checks whether the service may move to the `to` state
+func (self *Registry) CanTransition(serviceId string, to service.Status) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	from := self.state(serviceId).Status
+	if !canTransition(from, to) {
+		return &TransitionError{Id: serviceId, From: from, To: to}
+	}
+	return nil
+}
+
+// Transition the service to the `to` state, if valid.
+// Returns the previous state.
+func (self *Registry) Transition(serviceId string, to service.Status, lastError string) (service.Status, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	from := self.state(serviceId).Status
+	if !canTransition(from, to) {
+		return from, &TransitionError{Id: serviceId, From: from, To: to}
+	}
+	self.setState(serviceId, to, lastError)
+	return from, nil
+}
+
+// Observe records the state reported by the service itself.
+//
+// Observations are not validated, as they reflect what actually happened,
+// but they do not override a transitional state owned by an operation.
+// Returns the previous state, and whether the state changed.
+func (self *Registry) Observe(serviceId string, to service.Status, lastError string) (service.Status, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	from := self.state(serviceId).Status
+	if transitional(from) || from == to {
+		return from, false
+	}
+	self.setState(serviceId, to, lastError)
+	return from, true
+}
+
+// setState of a service. Must hold the lock.
+func (self *Registry) setState(serviceId string, to service.Status, lastError string) {
+	if to == service.NotInstalled {
+		delete(self.states, serviceId)
+		return
+	}
+	self.states[serviceId] = &ServiceState{
+		Status:    to,
+		LastError: lastError,
+		Changed:   time.Now(),
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Lifecycle Methods
+//
+// ----------------------------------------------------------------------------
+
+// transition the service, publishing a "lifecycle" event
+func (self *ServiceContext) transition(serviceId string, to service.Status, lastError string) error {
+	from, err := self.Registry.Transition(serviceId, to, lastError)
+	if err != nil {
+		return err
+	}
+	sendEvent(self.SendEventMessage, "lifecycle", &LifecycleEvent{Id: serviceId, From: from, State: to})
+	return nil
+}
+
+// reconcile the status reported by the service with the tracked state.
+//
+// A service minion believes is running, but which reports it is stopped,
+// has died and is reported as Failed.
+func (self *ServiceContext) reconcile(serviceId string, detail *service.StatusDetail) {
+
+	tracked := self.Registry.State(serviceId)
+
+	switch detail.State {
+	case service.StatusUnknown:
+		return
+	case service.Stopped:
+		switch tracked.Status {
+		case service.Running, service.Degraded:
+			detail.State = service.Failed
+			if detail.LastError == "" {
+				detail.LastError = ErrorExitedUnexpected.Error()
+			}
+		case service.Failed:
+			detail.State = service.Failed
+			if detail.LastError == "" {
+				detail.LastError = tracked.LastError
+			}
+		}
+	}
+
+	from, changed := self.Registry.Observe(serviceId, detail.State, detail.LastError)
+	if changed {
+		sendEvent(self.SendEventMessage, "lifecycle", &LifecycleEvent{Id: serviceId, From: from, State: detail.State})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+// A log file which can be reopened, after being moved by logrotate.
+type LogFile struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// ----------------------------------------------------------------------------
+//
+// LogFile Methods
+//
+// ----------------------------------------------------------------------------
+
+func OpenLogFile(path string) (*LogFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFile{path: path, file: file}, nil
+}
+
+func (self *LogFile) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.file.Write(p)
+}
+
+// Reopen the file at its path. On error, the current file is kept.
+func (self *LogFile) Reopen() error {
+	file, err := os.OpenFile(self.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.file.Close()
+	self.file = file
+	return nil
+}
+
+func (self *LogFile) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.file.Close()
+}
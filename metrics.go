@@ -0,0 +1,504 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// interval between collections of service stats
+	metricsInterval time.Duration = 15 * time.Second
+
+	// content type of the text exposition format
+	metricsContentType string = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Buckets of latency histograms, in seconds
+var (
+	rpcBuckets     = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	installBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+)
+
+// longest run of the "stats" command of a service
+var statsTimeout time.Duration = 10 * time.Second
+
+// Metrics of minion and of its services, exposed at /metrics in the
+// Prometheus text exposition format.
+//
+// Stats of running services are collected every metricsInterval, exposed
+// as minion_stat_<name>, labeled by service_id, recorded in the history
+// and checked against the alert rules.
+type Metrics struct {
+	context *ServiceContext
+	mutex   sync.Mutex
+	done    chan struct{}
+
+	rpcCalls      map[[2]string]float64
+	rpcSeconds    map[string]*histogram
+	installs      map[string]*histogram
+	childFailures map[[2]string]float64
+	services      map[string]*serviceMetrics
+}
+
+// Stats last collected from a service
+type serviceMetrics struct {
+	collected time.Time
+	stats     *service.Stats
+}
+
+// A metric family, with the samples of all its label sets
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+// A sample, named for the suffixes of histograms
+type metricSample struct {
+	name   string
+	labels []metricLabel
+	value  float64
+}
+
+type metricLabel struct {
+	name  string
+	value string
+}
+
+// A cumulative histogram
+type histogram struct {
+	bounds []float64
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// records the status of responses
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// ----------------------------------------------------------------------------
+//
+// Metrics Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewMetrics(context *ServiceContext) *Metrics {
+	return &Metrics{
+		context:       context,
+		done:          make(chan struct{}),
+		rpcCalls:      map[[2]string]float64{},
+		rpcSeconds:    map[string]*histogram{},
+		installs:      map[string]*histogram{},
+		childFailures: map[[2]string]float64{},
+		services:      map[string]*serviceMetrics{},
+	}
+}
+
+// Run the collector until Stop is called
+func (self *Metrics) Run() {
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+
+	self.collect()
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			self.collect()
+		}
+	}
+}
+
+// Stop the collector
+func (self *Metrics) Stop() {
+	if self == nil {
+		return
+	}
+	close(self.done)
+}
+
+// collect the stats of the running services, concurrently, so a slow
+// service only delays its own stats
+func (self *Metrics) collect() {
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	collected := map[string]*serviceMetrics{}
+
+	for id := range self.context.Registry.List() {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			m := &serviceMetrics{collected: time.Now()}
+			switch self.context.Registry.State(id).Status {
+			case service.Running, service.Degraded:
+				stats, err := self.context.stats(id)
+				if err != nil {
+					log.Printf("error: metrics: %s: %s\n", id, err.Error())
+				} else {
+					m.stats = stats
+					self.context.History.record(id, m.collected, stats)
+				}
+			case service.Stopped, service.NotInstalled:
+				// stopped on purpose, its alerts no longer apply
+				self.context.Alerts.forget(id)
+			}
+
+			self.context.Alerts.evaluate(id, m.collected, m.stats)
+
+			mutex.Lock()
+			collected[id] = m
+			mutex.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	self.mutex.Lock()
+	self.services = collected
+	self.mutex.Unlock()
+}
+
+// Handler wraps the RPC handler, counting calls and their latency by
+// method and status
+func (self *Metrics) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		req, body, err := readBody(req)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+
+		// unknown methods share a label, clients choose their names
+		method := rpcMethod(body)
+		if _, exists := methodRoles[method]; !exists {
+			method = "unknown"
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler.ServeHTTP(sw, req)
+		self.observeRPC(method, sw.status, time.Since(start))
+	})
+}
+
+func (self *Metrics) observeRPC(method string, status int, d time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.rpcCalls[[2]string{method, strconv.Itoa(status)}]++
+	h, exists := self.rpcSeconds[method]
+	if !exists {
+		h = newHistogram(rpcBuckets)
+		self.rpcSeconds[method] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// observeInstall records the duration of an install job
+func (self *Metrics) observeInstall(d time.Duration, err error) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	result := JobSucceeded
+	if err != nil {
+		result = JobFailed
+	}
+	h, exists := self.installs[string(result)]
+	if !exists {
+		h = newHistogram(installBuckets)
+		self.installs[string(result)] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// childFailed counts a failed service command
+func (self *Metrics) childFailed(serviceId string, commandName string) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.childFailures[[2]string{serviceId, commandName}]++
+}
+
+// ServeHTTP writes the metrics in the text exposition format
+func (self *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	out := bufio.NewWriter(w)
+	writeFamilies(out, self.families())
+	out.Flush()
+}
+
+// families returns the metrics, sorted by name
+func (self *Metrics) families() []*metricFamily {
+
+	rpcCalls := &metricFamily{name: "minion_rpc_requests_total", help: "RPC requests by method and HTTP status.", kind: "counter"}
+	rpcSeconds := &metricFamily{name: "minion_rpc_duration_seconds", help: "Latency of RPC requests by method.", kind: "histogram"}
+	installs := &metricFamily{name: "minion_install_duration_seconds", help: "Duration of service installs by result.", kind: "histogram"}
+	childFailures := &metricFamily{name: "minion_child_failures_total", help: "Failed service commands by service and command.", kind: "counter"}
+	states := &metricFamily{name: "minion_service_state", help: "State of services, 1 for the current state.", kind: "gauge"}
+	up := &metricFamily{name: "minion_stats_up", help: "Whether the stats of the service were collected.", kind: "gauge"}
+	collected := &metricFamily{name: "minion_stats_collected_timestamp_seconds", help: "Time the stats of the service were last collected.", kind: "gauge"}
+
+	families := map[string]*metricFamily{}
+	for _, f := range []*metricFamily{rpcCalls, rpcSeconds, installs, childFailures, states, up, collected} {
+		families[f.name] = f
+	}
+
+	for id := range self.context.Registry.List() {
+		state := self.context.Registry.State(id).Status
+		states.add(1, "service_id", id, "state", state.String())
+	}
+
+	self.mutex.Lock()
+
+	for key, n := range self.rpcCalls {
+		rpcCalls.add(n, "method", key[0], "code", key[1])
+	}
+	for method, h := range self.rpcSeconds {
+		h.samples(rpcSeconds, "method", method)
+	}
+	for result, h := range self.installs {
+		h.samples(installs, "result", result)
+	}
+	for key, n := range self.childFailures {
+		childFailures.add(n, "service_id", key[0], "command", key[1])
+	}
+
+	// a stat reported with different kinds by different services is
+	// exposed with the kind of the first service, by id
+	ids := []string{}
+	for id := range self.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		m := self.services[id]
+		up.add(boolValue(m.stats != nil), "service_id", id)
+		collected.add(float64(m.collected.UnixNano())/1e9, "service_id", id)
+		if m.stats == nil {
+			continue
+		}
+
+		for _, metric := range m.stats.Metrics {
+			name := "minion_stat_" + metric.Name
+			f, exists := families[name]
+			if !exists {
+				f = &metricFamily{name: name, help: "Stat reported by the service.", kind: string(metric.Kind)}
+				if metric.Unit != "" {
+					f.help = "Stat reported by the service, in " + metric.Unit + "."
+				}
+				families[name] = f
+			} else if f.kind != string(metric.Kind) {
+				log.Printf("error: metrics: %s: %s is a %s, not a %s\n", id, name, metric.Kind, f.kind)
+				continue
+			}
+			metricSamples(f, id, metric)
+		}
+	}
+
+	self.mutex.Unlock()
+
+	names := []string{}
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sorted := []*metricFamily{}
+	for _, name := range names {
+		f := families[name]
+		if len(f.samples) > 0 {
+			f.sort()
+			sorted = append(sorted, f)
+		}
+	}
+	return sorted
+}
+
+// ----------------------------------------------------------------------------
+//
+// metricFamily Methods
+//
+// ----------------------------------------------------------------------------
+
+// add a sample, with labels given as name, value pairs
+func (self *metricFamily) add(value float64, labels ...string) {
+	self.addNamed(self.name, value, labels...)
+}
+
+func (self *metricFamily) addNamed(name string, value float64, labels ...string) {
+	sample := metricSample{name: name, value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		sample.labels = append(sample.labels, metricLabel{labels[i], labels[i+1]})
+	}
+	self.samples = append(self.samples, sample)
+}
+
+// sort the samples by labels, keeping the order of histogram buckets
+func (self *metricFamily) sort() {
+	sort.SliceStable(self.samples, func(i, j int) bool {
+		a, b := self.samples[i].labels, self.samples[j].labels
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k].name == "le" || b[k].name == "le" {
+				return false
+			}
+			if a[k].value != b[k].value {
+				return a[k].value < b[k].value
+			}
+		}
+		return false
+	})
+}
+
+// ----------------------------------------------------------------------------
+//
+// histogram Methods
+//
+// ----------------------------------------------------------------------------
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]float64, len(bounds)),
+	}
+}
+
+func (self *histogram) observe(v float64) {
+	for i, bound := range self.bounds {
+		if v <= bound {
+			self.counts[i]++
+		}
+	}
+	self.sum += v
+	self.count++
+}
+
+// samples adds the _bucket, _sum and _count samples to the family
+func (self *histogram) samples(f *metricFamily, labels ...string) {
+	for i, bound := range self.bounds {
+		f.addNamed(f.name+"_bucket", self.counts[i], append(labels, "le", formatValue(bound))...)
+	}
+	f.addNamed(f.name+"_bucket", self.count, append(labels, "le", "+Inf")...)
+	f.addNamed(f.name+"_sum", self.sum, labels...)
+	f.addNamed(f.name+"_count", self.count, labels...)
+}
+
+// ----------------------------------------------------------------------------
+//
+// statusWriter Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *statusWriter) WriteHeader(status int) {
+	self.status = status
+	self.ResponseWriter.WriteHeader(status)
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// metricSamples adds the samples of a metric reported by a service
+func metricSamples(f *metricFamily, serviceId string, metric service.Metric) {
+
+	names := []string{}
+	for name := range metric.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := []string{"service_id", serviceId}
+	for _, name := range names {
+		labels = append(labels, name, metric.Labels[name])
+	}
+
+	if metric.Kind != service.Histogram {
+		f.add(metric.Value, labels...)
+		return
+	}
+
+	for _, b := range metric.Buckets {
+		f.addNamed(f.name+"_bucket", b.Count, append(labels, "le", formatValue(b.UpperBound))...)
+	}
+	f.addNamed(f.name+"_bucket", metric.Value, append(labels, "le", "+Inf")...)
+	if metric.Sum != 0 {
+		f.addNamed(f.name+"_sum", metric.Sum, labels...)
+	}
+	f.addNamed(f.name+"_count", metric.Value, labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeFamilies writes the families in the text exposition format
+func writeFamilies(w io.Writer, families []*metricFamily) {
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		for _, sample := range f.samples {
+			fmt.Fprint(w, sample.name)
+			if len(sample.labels) > 0 {
+				pairs := []string{}
+				for _, label := range sample.labels {
+					pairs = append(pairs, label.name+"=\""+escapeLabel(label.value)+"\"")
+				}
+				fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+			}
+			fmt.Fprintf(w, " %s\n", formatValue(sample.value))
+		}
+	}
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
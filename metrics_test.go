@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startService installs and starts a service
+func startService(t *testing.T, ctx *ServiceContext, serviceId string, script string) {
+	t.Helper()
+
+	installService(t, ctx, serviceId, script)
+	var jobId string
+	if err := ctx.Start(nil, &serviceId, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+		t.Fatalf("start: %s: %s", info.State, info.Error)
+	}
+}
+
+// Services are collected at once, and hung stats commands are killed
+func TestMetricsCollect(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.Metrics = NewMetrics(ctx)
+
+	timeout := statsTimeout
+	statsTimeout = 500 * time.Millisecond
+	defer func() { statsTimeout = timeout }()
+
+	// the hung command forks, its children are killed too
+	slow := strings.Replace(testService, "stats)\n", "stats)\n\tsleep 0.4\n", 1)
+	hung := strings.Replace(testService, "stats)\n", "stats)\n\tsleep 30\n", 1)
+	startService(t, ctx, "slow1", slow)
+	startService(t, ctx, "slow2", slow)
+	startService(t, ctx, "slow3", slow)
+	startService(t, ctx, "hung", hung)
+
+	// one after the other, collecting takes 1.7s
+	start := time.Now()
+	ctx.Metrics.collect()
+	if elapsed := time.Since(start); elapsed > 1200*time.Millisecond {
+		t.Fatalf("collected in %s", elapsed)
+	}
+
+	var out bytes.Buffer
+	writeFamilies(&out, ctx.Metrics.families())
+	for _, line := range []string{
+		`minion_stats_up{service_id="hung"} 0`,
+		`minion_stats_up{service_id="slow1"} 1`,
+		`minion_stats_up{service_id="slow2"} 1`,
+		`minion_stat_requests{service_id="slow1"} 1`,
+		`minion_child_failures_total{service_id="hung",command="stats"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+// A stat keeps the kind of the first service reporting it
+func TestMetricsKindConflict(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.Metrics = NewMetrics(ctx)
+
+	stats := func(kind service.MetricKind) *serviceMetrics {
+		return &serviceMetrics{
+			collected: time.Now(),
+			stats:     &service.Stats{Metrics: []service.Metric{{Name: "requests", Kind: kind, Value: 1}}},
+		}
+	}
+	ctx.Metrics.services = map[string]*serviceMetrics{
+		"c": stats(service.Gauge),
+		"a": stats(service.Counter),
+		"b": stats(service.Counter),
+	}
+
+	var out bytes.Buffer
+	writeFamilies(&out, ctx.Metrics.families())
+	exposed := out.String()
+
+	if strings.Count(exposed, "# TYPE minion_stat_requests ") != 1 || !strings.Contains(exposed, "# TYPE minion_stat_requests counter\n") {
+		t.Errorf("family: %s", exposed)
+	}
+	if !strings.Contains(exposed, `minion_stat_requests{service_id="b"} 1`) {
+		t.Errorf("b dropped: %s", exposed)
+	}
+	if strings.Contains(exposed, `minion_stat_requests{service_id="c"}`) {
+		t.Errorf("c exposed: %s", exposed)
+	}
+}
+
+// Services left running by a previous minion are collected after the
+// rescan of a restart
+func TestMetricsRestart(t *testing.T) {
+	ctx := newTestContext(t)
+	startService(t, ctx, "svc", testService)
+
+	ctx.Registry = NewRegistry()
+	ctx.Metrics = NewMetrics(ctx)
+	if err := checkServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := ctx.Registry.State("svc").Status; state != service.Running {
+		t.Fatalf("rescanned: %s", state)
+	}
+
+	ctx.Metrics.collect()
+	var out bytes.Buffer
+	writeFamilies(&out, ctx.Metrics.families())
+	if !strings.Contains(out.String(), `minion_stat_requests{service_id="svc"} 1`+"\n") {
+		t.Fatalf("not collected: %s", out.String())
+	}
+}
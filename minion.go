@@ -1,14 +1,19 @@
 package main
 
 import (
+	"github.com/aerospike-labs/minion/service"
+
 	"encoding/json"
 	"flag"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -24,7 +29,25 @@ var (
 	pidFile    string = "log/minion.pid"
 	logFile    string = "log/minion.log"
 	accessFile string = "log/minion-access.log"
+	configFile string = "etc/minion.json"
+	authModes  string = ""
+	tlsListen  string = ""
+	tlsCert    string = ""
+	tlsKey     string = ""
+	tlsCA      string = ""
+	fleetFile  string = ""
 	quiet      bool   = false
+	foreground bool   = false
+
+	readTimeout     time.Duration = 10 * time.Second
+	writeTimeout    time.Duration = 10 * time.Second
+	shutdownTimeout time.Duration = 30 * time.Second
+
+	// reloads on SIGHUP
+	reloader *Reloader = nil
+
+	// shuts down on SIGTERM and SIGQUIT
+	shutdown *Shutdown = nil
 )
 
 func checkFile(file string) string {
@@ -74,31 +97,81 @@ func checkDir(dir string) string {
 	return dir
 }
 
-func checkServices(ctx *ServiceContext) {
+// checkServices registers the services installed under svc/.
+//
+// On rescan, new services are added, with the status they report, and
+// services whose service.json is gone are dropped. Services busy with an
+// operation are left alone.
+func checkServices(ctx *ServiceContext) error {
 
 	servicesDir := checkDir(filepath.Join(rootPath, "svc"))
 	servicesList, err := ioutil.ReadDir(servicesDir)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	found := map[string]bool{}
 	for _, svcDir := range servicesList {
 		if svcDir.IsDir() {
 
 			svcFile := filepath.Join(servicesDir, svcDir.Name(), "service.json")
-			println("svcFile", svcFile)
-			_, err = os.Stat(svcFile)
-			if err == nil {
-				svcData, err := ioutil.ReadFile(svcFile)
-				if err == nil {
-					var svc ServiceInstall
-					err := json.Unmarshal(svcData, &svc)
-					if err == nil {
-						ctx.Registry[svc.Id] = &svc
-					}
-				}
+			svcData, err := ioutil.ReadFile(svcFile)
+			if err != nil {
+				continue
+			}
+
+			var svc ServiceInstall
+			if err = json.Unmarshal(svcData, &svc); err != nil {
+				log.Printf("error: %s: %s\n", svcFile, err.Error())
+				continue
+			}
+			if svc.Id != svcDir.Name() {
+				log.Printf("error: %s: %s: %q\n", svcFile, ErrorInvalidServiceId.Error(), svc.Id)
+				continue
+			}
+			found[svc.Id] = true
+
+			if ctx.Registry.Exists(svc.Id) {
+				continue
 			}
+			if err = ctx.Registry.Acquire(svc.Id, "rescan"); err != nil {
+				continue
+			}
+			log.Printf("info: adding service: %s\n", svc.Id)
+			ctx.Registry.Put(&svc)
+
+			// services left running by a previous minion are collected,
+			// monitored and stopped on shutdown as running
+			if detail, err := ctx.status(svc.Id); err != nil {
+				log.Printf("error: %s: %s\n", svc.Id, err.Error())
+			} else {
+				ctx.reconcile(svc.Id, detail)
+			}
+			ctx.Registry.Release(svc.Id)
+		}
+	}
+
+	for id := range ctx.Registry.List() {
+		if found[id] {
+			continue
+		}
+		if err = ctx.Registry.Acquire(id, "rescan"); err != nil {
+			continue
 		}
+		log.Printf("info: dropping service: %s\n", id)
+		ctx.Registry.Delete(id)
+		from, changed := ctx.Registry.Observe(id, service.NotInstalled, "")
+		if changed {
+			sendEvent(ctx.SendEventMessage, "lifecycle", &LifecycleEvent{Id: id, From: from, State: service.NotInstalled})
+		}
+		ctx.Supervisor.forget(id)
+		ctx.HealthMonitor.forget(id)
+		ctx.History.forget(id)
+		ctx.Alerts.forget(id)
+		ctx.Registry.Release(id)
 	}
+
+	return nil
 }
 
 func main() {
@@ -112,16 +185,48 @@ func main() {
 	flag.StringVar(&logFile, "log", logFile, "Path to Log file.")
 	flag.StringVar(&accessFile, "access", accessFile, "Path to access log file.")
 	flag.StringVar(&rootPath, "root", rootPath, "Path to minion root.")
+	flag.StringVar(&configFile, "config", configFile, "Path to configuration file.")
+	flag.StringVar(&authModes, "auth", authModes, "Comma separated authentication modes: token, hmac, cert.")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "Path to TLS certificate. Enables TLS.")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "Path to TLS private key.")
+	flag.StringVar(&tlsCA, "tls-client-ca", tlsCA, "Path to CA certificates verifying TLS client certificates.")
+	flag.StringVar(&tlsListen, "tls-listen", tlsListen, "Listening address and port for TLS. If unset, TLS replaces plain HTTP on -listen.")
+	flag.StringVar(&fleetFile, "fleet", fleetFile, "Path to fleet inventory. Enables the fleet controller.")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "Maximum duration for reading a request.")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "Maximum duration for writing a response.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "Time to wait for requests and jobs on shutdown.")
+	flag.BoolVar(&foreground, "foreground", foreground, "Run in the foreground, logging to stdout and stderr, without a PID file.")
 	flag.BoolVar(&quiet, "quiet", quiet, "If enabled, then do not send output to console.")
 	flag.Parse()
 
+	// the environment overrides flags
+	if env := os.Getenv(configEnv("root")); env != "" {
+		rootPath = env
+	}
+	if env := os.Getenv(configEnv("config")); env != "" {
+		configFile = env
+	}
+	if env := os.Getenv(configEnv("foreground")); env != "" {
+		foreground, _ = strconv.ParseBool(env)
+	}
+
 	command := ""
 	if flag.NArg() == 1 {
 		command = flag.Arg(0)
 	}
 
+	if flag.NArg() == 2 && flag.Arg(0) == "config" && flag.Arg(1) == "check" {
+		os.Exit(configCheck())
+	}
+
+	// configuration
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		log.Fatalln("Unable to load configuration:", err)
+	}
+
 	// daemon signal handlers
-	daemon.AddCommand(daemon.StringFlag(&command, "quit"), syscall.SIGQUIT, signalTerm)
+	daemon.AddCommand(daemon.StringFlag(&command, "quit"), syscall.SIGQUIT, signalQuit)
 	daemon.AddCommand(daemon.StringFlag(&command, "stop"), syscall.SIGTERM, signalTerm)
 	daemon.AddCommand(daemon.StringFlag(&command, "reload"), syscall.SIGHUP, signalHup)
 
@@ -131,87 +236,218 @@ func main() {
 	// setup logger
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
-	// check files
-	pidFile = checkFile(pidFile)
-	logFile = checkFile(logFile)
-	accessFile = checkFile(accessFile)
-
-	// daemon context
-	ctx := &daemon.Context{
-		PidFileName: pidFile,
-		PidFilePerm: 0755,
-		LogFileName: logFile,
-		LogFilePerm: 0755,
-		WorkDir:     rootPath,
-		Umask:       027,
-		Args:        []string{},
-		Credential:  &syscall.Credential{},
-	}
-
-	if len(daemon.ActiveFlags()) > 0 {
-		d, err := ctx.Search()
+	// logs, reopened on SIGHUP
+	var accessLog io.Writer = nil
+	logs := []*LogFile{}
+
+	if foreground {
+
+		// signals are handled directly, interrupt shuts down as well
+		daemon.SetSigHandler(signalTerm, syscall.SIGINT)
+
+		if err = os.Chdir(rootPath); err != nil {
+			log.Fatalln(err)
+		}
+
+		log.SetOutput(os.Stderr)
+		accessLog = os.Stdout
+
+	} else {
+
+		// check files
+		pidFile := checkFile(config.Paths.Pid)
+		logFile := checkFile(config.Paths.Log)
+		accessFile := checkFile(config.Paths.Access)
+
+		// daemon context
+		ctx := &daemon.Context{
+			PidFileName: pidFile,
+			PidFilePerm: 0755,
+			LogFileName: logFile,
+			LogFilePerm: 0755,
+			WorkDir:     rootPath,
+			Umask:       027,
+			Args:        []string{},
+			Credential:  &syscall.Credential{},
+		}
+
+		if len(daemon.ActiveFlags()) > 0 {
+			d, err := ctx.Search()
+			if err != nil {
+				log.Fatalln("Unable send signal to the daemon:", err)
+			}
+			daemon.SendCommands(d)
+			return
+		}
+
+		d, err := ctx.Reborn()
 		if err != nil {
-			log.Fatalln("Unable send signal to the daemon:", err)
+			log.Fatalln(err)
 		}
-		daemon.SendCommands(d)
-		return
-	}
+		if d != nil {
+			return
+		}
+		defer ctx.Release()
 
-	d, err := ctx.Reborn()
-	if err != nil {
-		log.Fatalln(err)
-	}
-	if d != nil {
-		return
+		// reopenable logs
+		mainLog, err := OpenLogFile(logFile)
+		if err != nil {
+			log.Panicf("error opening log: %v", err)
+		}
+		defer mainLog.Close()
+		log.SetOutput(mainLog)
+
+		accessFileLog, err := OpenLogFile(accessFile)
+		if err != nil {
+			log.Panicf("error opening access log: %v", err)
+		}
+		defer accessFileLog.Close()
+
+		accessLog = accessFileLog
+		logs = append(logs, mainLog, accessFileLog)
 	}
-	defer ctx.Release()
 
-	// open access log
-	accessLog, err := os.OpenFile(accessFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+	// authentication
+	auth, err := LoadAuth(config.Auth)
 	if err != nil {
-		log.Panic("error opening access log: %v", err)
+		log.Panicf("error loading auth: %v", err)
 	}
-	defer accessLog.Close()
+
+	// event stream
+	eventStream := NewEventStream()
 
 	// services contexts
 	serviceContext := &ServiceContext{
-		Registry: map[string]*ServiceInstall{},
+		SendEventMessage: eventStream.SendEventMessage,
+		Registry:         NewRegistry(),
+		Jobs:             NewJobContext(),
 	}
+	serviceContext.SetConfig(config)
+	serviceContext.Supervisor = NewSupervisor(serviceContext)
+	serviceContext.HealthMonitor = NewHealthMonitor(serviceContext)
+	serviceContext.Metrics = NewMetrics(serviceContext)
+	serviceContext.History = NewHistory(checkDir(filepath.Join(rootPath, "var", "stats")))
+	serviceContext.Alerts = NewAlerts(serviceContext)
+	serviceContext.Webhooks = NewWebhooks(serviceContext, checkDir(filepath.Join(rootPath, "var", "webhooks")))
+	serviceContext.SendEventMessage = serviceContext.Webhooks.Forward(eventStream.SendEventMessage)
+	serviceContext.Jobs.SendEventMessage = serviceContext.SendEventMessage
 
 	// export services
 	rpcServer := rpc.NewServer()
 	rpcServer.RegisterCodec(jsonrpc.NewCodec(), "application/json")
 	rpcServer.RegisterService(serviceContext, "Service")
+	rpcServer.RegisterService(serviceContext.Jobs, "Job")
+	rpcServer.RegisterService(serviceContext.Alerts, "Alert")
+
+	// fleet controller
+	if config.Fleet != "" {
+		fleet, err := LoadFleet(config.Fleet, serviceContext)
+		if err != nil {
+			log.Panicf("error loading fleet: %v", err)
+		}
+		rpcServer.RegisterService(fleet, "Fleet")
+	}
 
 	// routes
 	httpRouter := http.NewServeMux()
-	httpRouter.Handle("/rpc", handlers.CombinedLoggingHandler(accessLog, rpcServer))
-
-	// server
-	httpServer := &http.Server{
-		Addr:           listen,
-		Handler:        httpRouter,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	httpRouter.Handle("/rpc", auth.Handler(accessLog, handlers.CombinedLoggingHandler(accessLog, serviceContext.Metrics.Handler(rpcServer)), true))
+	httpRouter.Handle("/events", auth.Handler(accessLog, handlers.CombinedLoggingHandler(accessLog, eventStream), false))
+	httpRouter.Handle("/metrics", auth.Handler(accessLog, handlers.CombinedLoggingHandler(accessLog, serviceContext.Metrics), false))
+
+	// tls
+	plainAddr := config.Listen
+	tlsAddr := config.TLS.Listen
+	var certStore *CertStore = nil
+	if config.TLS.Cert != "" {
+		certStore, err = LoadCertStore(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA)
+		if err != nil {
+			log.Panicf("error loading tls certificates: %v", err)
+		}
+		if tlsAddr == "" {
+			tlsAddr = plainAddr
+			plainAddr = ""
+		}
+	}
+
+	if err = checkServices(serviceContext); err != nil {
+		log.Panic(err)
+	}
+
+	reloader = &Reloader{
+		context:   serviceContext,
+		auth:      auth,
+		certStore: certStore,
+		logs:      logs,
+	}
+
+	// supervise services
+	go serviceContext.Supervisor.Run()
+
+	// monitor health of services
+	go serviceContext.HealthMonitor.Run()
+
+	// collect metrics of services
+	go serviceContext.Metrics.Run()
+
+	// notify webhooks of events
+	go serviceContext.Webhooks.Run()
+
+	shutdown = &Shutdown{
+		context: serviceContext,
+		events:  eventStream,
+		timeout: time.Duration(config.Timeouts.Shutdown),
 	}
 
-	checkServices(serviceContext)
+	// start, listening before notifying readiness
+	if plainAddr != "" {
+		httpServer := newServer(plainAddr, httpRouter, config)
+		shutdown.servers = append(shutdown.servers, httpServer)
+		httpListener, err := net.Listen("tcp", plainAddr)
+		if err != nil {
+			log.Panic(err)
+		}
+		go func() {
+			log.Printf("Starting HTTP on http://%s\n", plainAddr)
+			if err := httpServer.Serve(httpListener); err != http.ErrServerClosed {
+				log.Panic(err)
+			}
+		}()
+	}
 
-	// start
-	go func() {
-		log.Printf("Starting HTTP on http://%s\n", listen)
-		log.Panic(httpServer.ListenAndServe())
-	}()
+	if certStore != nil {
+		tlsServer := newServer(tlsAddr, httpRouter, config)
+		tlsServer.TLSConfig = certStore.Config()
+		shutdown.servers = append(shutdown.servers, tlsServer)
+		tlsListener, err := net.Listen("tcp", tlsAddr)
+		if err != nil {
+			log.Panic(err)
+		}
+		go func() {
+			log.Printf("Starting HTTPS on https://%s\n", tlsAddr)
+			if err := tlsServer.ServeTLS(tlsListener, "", ""); err != http.ErrServerClosed {
+				log.Panic(err)
+			}
+		}()
+	}
+
+	// service manager notifications
+	notify(NotifyReady)
+	go watchdog()
 
-	// daemon handles signals
+	// daemon handles signals, until one shuts minion down
 	if err = daemon.ServeSignals(); err != nil {
 		log.Panic(err)
 	}
+}
 
-	// exit handled by signal handlers
-	halt := make(chan bool)
-	<-halt
+func newServer(addr string, handler http.Handler, config *Config) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    time.Duration(config.Timeouts.Read),
+		WriteTimeout:   time.Duration(config.Timeouts.Write),
+		MaxHeaderBytes: 1 << 20,
+	}
 }
 
 func currentDir() string {
@@ -224,17 +460,28 @@ func currentDir() string {
 
 func signalQuit(s os.Signal) error {
 	// logInfo("Signal QUIT Received %v", sig)
-	os.Exit(0)
-	return nil
+	return signalTerm(s)
 }
 
 func signalTerm(s os.Signal) error {
 	// logInfo("Signal TERM Received %v", sig)
-	os.Exit(0)
-	return nil
+	if shutdown != nil {
+		notify(NotifyStopping)
+		shutdown.Run()
+	}
+	return daemon.ErrStop
 }
 
 func signalHup(s os.Signal) error {
 	// logInfo("Signal HUP Received %v", s)
+
+	// errors are logged, returning one would stop serving signals
+	if reloader != nil {
+		notify(NotifyReloading)
+		if err := reloader.Reload(); err != nil {
+			log.Printf("error: reload: %s\n", err.Error())
+		}
+		notify(NotifyReady)
+	}
 	return nil
 }
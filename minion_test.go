@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a service keeping its state in a file, which records operations which
+// overlap in the "overlap" file
+const testService = `#!/bin/sh
+cd "$SERVICE_PATH"
+case "$1" in
+status)
+	if [ -f running ]; then echo '{"state":"running"}'; else echo '{"state":"stopped"}'; fi
+	exit 0 ;;
+stats)
+	echo '{"metrics":[{"name":"requests","kind":"counter","value":1}]}'
+	exit 0 ;;
+esac
+mkdir lock 2>/dev/null || echo "$1" >> overlap
+sleep 0.02
+case "$1" in
+start) touch running ;;
+stop) rm -f running ;;
+esac
+rmdir lock 2>/dev/null
+exit 0
+`
+
+func TestMain(m *testing.M) {
+	if os.Getenv("MINION_TEST_LOG") == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// setTestRoot sets the minion root to a temporary directory
+func setTestRoot(t *testing.T) {
+	root := rootPath
+	rootPath = t.TempDir()
+	t.Cleanup(func() { rootPath = root })
+}
+
+// newTestContext returns a service context rooted in a temporary directory
+func newTestContext(t *testing.T) *ServiceContext {
+	t.Helper()
+
+	setTestRoot(t)
+
+	ctx := &ServiceContext{
+		Registry: NewRegistry(),
+		Jobs:     NewJobContext(),
+	}
+	ctx.SetConfig(&Config{})
+	ctx.Supervisor = NewSupervisor(ctx)
+	ctx.HealthMonitor = NewHealthMonitor(ctx)
+	return ctx
+}
+
+// writeService writes a service binary, returning its file:// URL
+func writeService(t *testing.T, script string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "service")
+	if err := ioutil.WriteFile(file, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + file
+}
+
+// installService installs a service, failing the test if it is not
+// installed
+func installService(t *testing.T, ctx *ServiceContext, serviceId string, script string) {
+	t.Helper()
+
+	var jobId string
+	svc := &ServiceInstall{Id: serviceId, URL: writeService(t, script)}
+	if err := ctx.Install(nil, svc, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+		t.Fatalf("install: %s: %s", info.State, info.Error)
+	}
+	if state := ctx.Registry.State(serviceId).Status; state != service.Stopped {
+		t.Fatalf("install: %s", state)
+	}
+}
+
+// waitJob waits for a job to finish
+func waitJob(t *testing.T, ctx *ServiceContext, jobId string) JobInfo {
+	t.Helper()
+
+	job, exists := ctx.Jobs.get(jobId)
+	if !exists {
+		t.Fatalf("%s: %s", jobId, ErrorJobNotFound.Error())
+	}
+	select {
+	case <-job.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s: still running", jobId)
+	}
+	return job.Info()
+}
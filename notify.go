@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	NotifyReady     string = "READY=1"
+	NotifyReloading string = "RELOADING=1"
+	NotifyStopping  string = "STOPPING=1"
+	NotifyWatchdog  string = "WATCHDOG=1"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// sdNotify sends a state to the service manager over $NOTIFY_SOCKET, as
+// systemd's sd_notify. Without $NOTIFY_SOCKET, it does nothing.
+func sdNotify(state string) error {
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify sends a state to the service manager, logging errors
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Printf("error: notify: %s: %s\n", state, err.Error())
+	}
+}
+
+// watchdogInterval returns the watchdog timeout set by the service manager
+// in $WATCHDOG_USEC, or 0 if the watchdog is disabled for this process.
+func watchdogInterval() time.Duration {
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog notifies the service manager at half the watchdog timeout
+func watchdog() {
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		notify(NotifyWatchdog)
+	}
+}
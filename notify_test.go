@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenNotify listens on a unixgram socket set as $NOTIFY_SOCKET
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if name[0] == '\x00' {
+		name = "@" + name[1:]
+	}
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+// expectNotify reads the next datagram, failing unless it is `state`
+func expectNotify(t *testing.T, conn *net.UnixConn, state string) {
+	t.Helper()
+
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("expected %s: %v", state, err)
+	}
+	if string(buf[:n]) != state {
+		t.Fatalf("received %q, expected %q", buf[:n], state)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	conn := listenNotify(t, filepath.Join(t.TempDir(), "notify"))
+
+	notify(NotifyReady)
+	expectNotify(t, conn, NotifyReady)
+
+	// reloads are bracketed by RELOADING=1 and READY=1
+	ctx := newTestContext(t)
+	writeEtc(t, "minion.json", "{}")
+	auth, err := LoadAuth(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedReloader, savedShutdown := reloader, shutdown
+	defer func() { reloader, shutdown = savedReloader, savedShutdown }()
+
+	reloader = &Reloader{context: ctx, auth: auth}
+	if err = signalHup(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	expectNotify(t, conn, NotifyReloading)
+	expectNotify(t, conn, NotifyReady)
+
+	// a failed reload is still followed by READY=1
+	writeEtc(t, "minion.json", "{")
+	signalHup(syscall.SIGHUP)
+	expectNotify(t, conn, NotifyReloading)
+	expectNotify(t, conn, NotifyReady)
+
+	shutdown = &Shutdown{context: ctx, events: NewEventStream(), timeout: time.Second}
+	signalTerm(syscall.SIGTERM)
+	expectNotify(t, conn, NotifyStopping)
+}
+
+func TestNotifyAbstract(t *testing.T) {
+	conn := listenNotify(t, "\x00minion-test-"+filepath.Base(t.TempDir()))
+
+	notify(NotifyWatchdog)
+	expectNotify(t, conn, NotifyWatchdog)
+}
+
+func TestNotifyUnset(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify(NotifyReady); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if err := sdNotify(NotifyReady); err == nil {
+		t.Fatal("notified a missing socket")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Fatalf("unset: %s", interval)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if interval := watchdogInterval(); interval != 3*time.Second {
+		t.Fatalf("set: %s", interval)
+	}
+
+	// the watchdog of another process
+	t.Setenv("WATCHDOG_PID", "1")
+	if os.Getpid() != 1 {
+		if interval := watchdogInterval(); interval != 0 {
+			t.Fatalf("other pid: %s", interval)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+// Registry of installed services.
+//
+// Reads (Get, List, Exists) share a read lock and may proceed concurrently.
+// Mutating operations on a service must first Acquire the service id, which
+// serializes operations per service and rejects conflicting ones.
+type Registry struct {
+	mutex    sync.RWMutex
+	services map[string]*ServiceInstall
+	busy     map[string]string
+	states   map[string]*ServiceState
+}
+
+// Error returned when an operation is already in progress for a service.
+type BusyError struct {
+	Id        string
+	Operation string
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("Service Busy: %s is running %s", e.Id, e.Operation)
+}
+
+// ----------------------------------------------------------------------------
+//
+// Registry Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services: map[string]*ServiceInstall{},
+		busy:     map[string]string{},
+		states:   map[string]*ServiceState{},
+	}
+}
+
+// Acquire the service id for an operation.
+// Returns a *BusyError if another operation holds the id.
+func (self *Registry) Acquire(serviceId string, operation string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if op, busy := self.busy[serviceId]; busy {
+		return &BusyError{Id: serviceId, Operation: op}
+	}
+	self.busy[serviceId] = operation
+	return nil
+}
+
+// Release the service id acquired by Acquire.
+func (self *Registry) Release(serviceId string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.busy, serviceId)
+}
+
+// Get a service
+func (self *Registry) Get(serviceId string) (*ServiceInstall, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	svc, exists := self.services[serviceId]
+	return svc, exists
+}
+
+// Check Existence of a service
+func (self *Registry) Exists(serviceId string) bool {
+	_, exists := self.Get(serviceId)
+	return exists
+}
+
+// List returns a copy of the registered services.
+func (self *Registry) List() map[string]*ServiceInstall {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	list := make(map[string]*ServiceInstall, len(self.services))
+	for id, svc := range self.services {
+		list[id] = svc
+	}
+	return list
+}
+
+// Put a service into the registry
+func (self *Registry) Put(svc *ServiceInstall) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.services[svc.Id] = svc
+}
+
+// Delete a service from the registry
+func (self *Registry) Delete(serviceId string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.services, serviceId)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryAcquire(t *testing.T) {
+	registry := NewRegistry()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	acquired := 0
+
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := registry.Acquire("svc", "start")
+			if err == nil {
+				mutex.Lock()
+				acquired++
+				mutex.Unlock()
+				return
+			}
+			if _, ok := err.(*BusyError); !ok {
+				t.Errorf("acquire: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if acquired != 1 {
+		t.Fatalf("acquired %d times", acquired)
+	}
+
+	if err := registry.Acquire("other", "stop"); err != nil {
+		t.Fatalf("acquire other: %v", err)
+	}
+	registry.Release("svc")
+	if err := registry.Acquire("svc", "stop"); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+// Operations called concurrently run one at a time; the others are
+// rejected as busy, or as invalid in the state the first left.
+func TestRegistryConcurrentOperations(t *testing.T) {
+	ctx := newTestContext(t)
+	installService(t, ctx, "svc", testService)
+
+	operations := []func(jobId *string) error{
+		func(jobId *string) error { id := "svc"; return ctx.Start(nil, &id, jobId) },
+		func(jobId *string) error { id := "svc"; return ctx.Stop(nil, &id, jobId) },
+		func(jobId *string) error {
+			return ctx.Configure(nil, &ServiceConfigure{Id: "svc", Params: map[string]interface{}{"a": 1}}, jobId)
+		},
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	ran := 0
+	deadline := time.Now().Add(5 * time.Second)
+
+	for worker := 0; worker < 12; worker++ {
+		wg.Add(1)
+		go func(operation func(jobId *string) error) {
+			defer wg.Done()
+			for done := 0; done < 3 && time.Now().Before(deadline); {
+				var jobId string
+				if err := operation(&jobId); err != nil {
+					switch err.(type) {
+					case *BusyError, *TransitionError:
+					default:
+						t.Errorf("operation: %v", err)
+					}
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				waitJob(t, ctx, jobId)
+				done++
+				mutex.Lock()
+				ran++
+				mutex.Unlock()
+			}
+		}(operations[worker%len(operations)])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				var list map[string]*ServiceInstall
+				ctx.List(nil, &struct{}{}, &list)
+				var status ServiceStatus
+				id := "svc"
+				ctx.Status(nil, &id, &status)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ran < 12 {
+		t.Fatalf("%d operations ran", ran)
+	}
+
+	overlap, err := ioutil.ReadFile(filepath.Join(rootPath, "svc", "svc", "overlap"))
+	if err == nil {
+		t.Fatalf("operations overlapped: %q", overlap)
+	}
+	if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+// Installs and removes racing for the same id leave the registry and the
+// disk agreeing on whether the service is installed.
+func TestRegistryInstallRemove(t *testing.T) {
+	ctx := newTestContext(t)
+	url := writeService(t, testService)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	installed, removed := 0, 0
+	deadline := time.Now().Add(5 * time.Second)
+
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(install bool) {
+			defer wg.Done()
+			for done := 0; done < 3 && time.Now().Before(deadline); {
+				var jobId string
+				var err error
+				if install {
+					err = ctx.Install(nil, &ServiceInstall{Id: "svc", URL: url}, &jobId)
+				} else {
+					id := "svc"
+					err = ctx.Remove(nil, &id, &jobId)
+				}
+				if err != nil {
+					switch err.(type) {
+					case *BusyError, *TransitionError:
+					default:
+						if err != service.Exists && err != service.NotFound {
+							t.Errorf("install %v: %v", install, err)
+						}
+					}
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+					t.Errorf("install %v: %s %s", install, info.State, info.Error)
+				}
+				done++
+				mutex.Lock()
+				if install {
+					installed++
+				} else {
+					removed++
+				}
+				mutex.Unlock()
+			}
+		}(worker%2 == 0)
+	}
+	wg.Wait()
+
+	if installed == 0 || removed == 0 {
+		t.Fatalf("%d installs, %d removes", installed, removed)
+	}
+
+	_, err := os.Stat(filepath.Join(rootPath, "svc", "svc", "service.json"))
+	state := ctx.Registry.State("svc").Status
+	if ctx.Registry.Exists("svc") {
+		if err != nil || state != service.Stopped || installed != removed+1 {
+			t.Fatalf("installed: %v, %s", err, state)
+		}
+	} else if !os.IsNotExist(err) || state != service.NotInstalled || installed != removed {
+		t.Fatalf("removed: %v, %s", err, state)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+// Reloader reloads the configuration of a running minion on SIGHUP.
+type Reloader struct {
+	context   *ServiceContext
+	auth      *Auth
+	certStore *CertStore
+	logs      []*LogFile
+	mutex     sync.Mutex
+}
+
+// ----------------------------------------------------------------------------
+//
+// Reloader Methods
+//
+// ----------------------------------------------------------------------------
+
+// Reload the configuration file, the authentication and TLS material, the
+// service policies, the log files and the installed services.
+//
+// The configuration, authentication and TLS material are loaded before any
+// is applied, so an error in any of them keeps the current ones. Listening
+// addresses, and enabling or disabling TLS, require a restart.
+func (self *Reloader) Reload() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	log.Printf("info: reloading\n")
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	auth, err := LoadAuth(config.Auth)
+	if err != nil {
+		return err
+	}
+
+	if self.certStore != nil && config.TLS.Cert != "" {
+		if err = self.certStore.Replace(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA); err != nil {
+			return err
+		}
+	} else if self.certStore != nil || config.TLS.Cert != "" {
+		log.Printf("error: reload: enabling or disabling tls requires a restart\n")
+	}
+
+	self.auth.Replace(auth)
+	self.context.SetConfig(config)
+
+	// the remaining steps are independent, report all of their errors
+	errs := []string{}
+
+	for _, logFile := range self.logs {
+		if err = logFile.Reopen(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if err = checkServices(self.context); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	log.Printf("info: reloaded\n")
+	return nil
+}
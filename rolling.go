@@ -0,0 +1,268 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/client"
+	"github.com/aerospike-labs/minion/service"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+var (
+	ErrorInvalidTarget    error = errors.New("Invalid Rolling Target")
+	ErrorInvalidCondition error = errors.New("Invalid Ready Condition")
+	ErrorUnknownPreset    error = errors.New("Unknown Ready Preset")
+	ErrorNotReady         error = errors.New("Node Not Ready")
+)
+
+// A service on a node of a rolling operation
+type RollingTarget struct {
+	Node    string `json:"node"`
+	Service string `json:"service"`
+}
+
+// A condition on a stat of the service, as "migrate_progress_send" "=="
+// 0. Stats reported as strings are parsed as numbers.
+type ReadyCondition struct {
+	Stat  string  `json:"stat"`
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+// Arguments for Fleet.Roll.
+//
+// Targets are restarted in order, Concurrency at once, defaulting to 1.
+// Each restarted service must be running and healthy, and then meet all
+// the Ready conditions, and those of Preset, for Settle seconds, within
+// Timeout seconds of being started. Once a target fails, the targets not
+// yet started are skipped.
+type RollingOperation struct {
+	Targets     []RollingTarget  `json:"targets"`
+	Concurrency int              `json:"concurrency,omitempty"`
+	Ready       []ReadyCondition `json:"ready,omitempty"`
+	Preset      string           `json:"preset,omitempty"`
+	Settle      int              `json:"settle,omitempty"`
+	Timeout     int              `json:"timeout,omitempty"`
+}
+
+// Ready conditions of common services
+var readyPresets = map[string][]ReadyCondition{
+	// aerospike migrations are finished
+	"aerospike-migrations": {
+		{Stat: "migrate_progress_send", Op: "==", Value: 0},
+		{Stat: "migrate_progress_recv", Op: "==", Value: 0},
+	},
+}
+
+// ----------------------------------------------------------------------------
+//
+// ReadyCondition Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self ReadyCondition) String() string {
+	return fmt.Sprintf("%s %s %g", self.Stat, self.Op, self.Value)
+}
+
+func (self ReadyCondition) validate() error {
+	switch self.Op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return fmt.Errorf("%s: %s", ErrorInvalidCondition.Error(), self.String())
+	}
+	if self.Stat == "" {
+		return fmt.Errorf("%s: %s", ErrorInvalidCondition.Error(), self.String())
+	}
+	return nil
+}
+
+// holds reports whether the stats meet the condition
+func (self ReadyCondition) holds(stats client.Stats) bool {
+
+	v, ok := stats.Float(self.Stat)
+	if !ok {
+		return false
+	}
+
+	switch self.Op {
+	case "==":
+		return v == self.Value
+	case "!=":
+		return v != self.Value
+	case "<":
+		return v < self.Value
+	case "<=":
+		return v <= self.Value
+	case ">":
+		return v > self.Value
+	case ">=":
+		return v >= self.Value
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+//
+// Fleet Rolling Methods
+//
+// ----------------------------------------------------------------------------
+
+// Roll restarts services across the fleet, one target after the other,
+// waiting for each to be ready. Returns the id of the controller's job.
+func (self *Fleet) Roll(req *http.Request, op *RollingOperation, res *string) error {
+
+	nodes := make([]*FleetNode, len(op.Targets))
+	names := make([]string, len(op.Targets))
+	for i, target := range op.Targets {
+		if target.Service == "" {
+			return fmt.Errorf("%s: %s", ErrorInvalidTarget.Error(), target.Node)
+		}
+		selected, err := self.selectNodes([]string{target.Node})
+		if err != nil {
+			return err
+		}
+		nodes[i] = selected[0]
+		names[i] = target.Node + "/" + target.Service
+	}
+
+	conditions := append([]ReadyCondition{}, op.Ready...)
+	if op.Preset != "" {
+		preset, exists := readyPresets[op.Preset]
+		if !exists {
+			return fmt.Errorf("%s: %s", ErrorUnknownPreset.Error(), op.Preset)
+		}
+		conditions = append(conditions, preset...)
+	}
+	for _, condition := range conditions {
+		if err := condition.validate(); err != nil {
+			return err
+		}
+	}
+
+	concurrency := op.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	timeout := time.Duration(op.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(fleetHealthTimeout) * time.Second
+	}
+	settle := time.Duration(op.Settle) * time.Second
+
+	serviceId := ""
+	if len(op.Targets) > 0 {
+		serviceId = op.Targets[0].Service
+	}
+
+	job := self.context.Jobs.start(serviceId, "fleet-roll", func(job *Job) error {
+		results := fanOut(job.Context(), names, concurrency, true, func(ctx context.Context, i int) error {
+			target := op.Targets[i]
+			return self.onNode(job, nodes[i], target.Service, func(c *client.Client) error {
+				return self.restart(ctx, job, c, nodes[i], target.Service, conditions, settle, timeout)
+			})
+		})
+		return self.report(job, results)
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+// restart a service on a node, and wait for it to be ready. Services which
+// are down are only started.
+func (self *Fleet) restart(ctx context.Context, job *Job, c *client.Client, node *FleetNode, serviceId string, conditions []ReadyCondition, settle time.Duration, timeout time.Duration) error {
+
+	status, err := c.Status(ctx, serviceId)
+	if err != nil {
+		return err
+	}
+
+	var jobId string
+	if status.State != service.Stopped && status.State != service.Failed {
+		self.event(job, node, serviceId, "stop", nil)
+		jobId, err = c.Stop(ctx, serviceId)
+		if err == nil {
+			err = self.wait(ctx, c, jobId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	self.event(job, node, serviceId, "start", nil)
+	jobId, err = c.Start(ctx, serviceId)
+	if err == nil {
+		err = self.wait(ctx, c, jobId)
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	self.event(job, node, serviceId, "health", nil)
+	if err = self.healthy(ctx, c, serviceId, timeout); err != nil {
+		return err
+	}
+
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	self.event(job, node, serviceId, "ready", nil)
+	return self.ready(ctx, c, serviceId, conditions, settle, deadline)
+}
+
+// ready waits for the stats of a service to meet the conditions for
+// `settle`, until the deadline
+func (self *Fleet) ready(ctx context.Context, c *client.Client, serviceId string, conditions []ReadyCondition, settle time.Duration, deadline time.Time) error {
+
+	var since time.Time
+	last := ""
+
+	for {
+		stats, err := c.Stats(ctx, serviceId)
+		if err != nil {
+			last = err.Error()
+			since = time.Time{}
+		} else {
+			last = ""
+			for _, condition := range conditions {
+				if !condition.holds(stats) {
+					last = fmt.Sprintf("%s, %s is %v", condition.String(), condition.Stat, stats[condition.Stat])
+					break
+				}
+			}
+			if last != "" {
+				since = time.Time{}
+			} else if since.IsZero() {
+				since = time.Now()
+			}
+			if !since.IsZero() && time.Since(since) >= settle {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if last == "" {
+				last = "not settled"
+			}
+			return fmt.Errorf("%s: %s", ErrorNotReady.Error(), last)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(fleetPollInterval):
+		}
+	}
+}
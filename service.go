@@ -5,6 +5,7 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,6 +13,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -20,15 +24,68 @@ import (
 //
 // ----------------------------------------------------------------------------
 
+var (
+	ErrorInvalidServiceId error = errors.New("Invalid Service Id")
+)
+
 type ServiceContext struct {
 	SendEventMessage func(data, event, id string)
-	Registry         map[string]*ServiceInstall
+	Registry         *Registry
+	Jobs             *JobContext
+	Supervisor       *Supervisor
+	HealthMonitor    *HealthMonitor
+	Metrics          *Metrics
+	History          *History
+	Alerts           *Alerts
+	Webhooks         *Webhooks
+
+	configMutex sync.RWMutex
+	config      *Config
+}
+
+// Data of "install" events
+type InstallEvent struct {
+	Id   string `json:"id"`
+	Step string `json:"step"`
+}
+
+// Data of "lifecycle" events
+type LifecycleEvent struct {
+	Id    string         `json:"id"`
+	From  service.Status `json:"from"`
+	State service.Status `json:"state"`
+}
+
+// Data of "error" events
+type ErrorEvent struct {
+	Id      string `json:"id"`
+	Command string `json:"command"`
+	Error   string `json:"error"`
+}
+
+// Status of a service, as returned by Service.Status
+type ServiceStatus struct {
+	Id string `json:"id"`
+	service.StatusDetail
+	Supervisor *SupervisorStatus `json:"supervisor,omitempty"`
 }
 
 type ServiceInstall struct {
-	Id     string                 `json:"id"`
-	URL    string                 `json:"url"`
-	Params map[string]interface{} `json:"params"`
+	Id        string                 `json:"id"`
+	URL       string                 `json:"url"`
+	Params    map[string]interface{} `json:"params"`
+	Checksum  string                 `json:"checksum,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+	Supervise *SupervisePolicy       `json:"supervise,omitempty"`
+	Health    *HealthConfig          `json:"health,omitempty"`
+
+	// stop the service when minion shuts down, if unset the configured
+	// default applies
+	StopOnShutdown *bool `json:"stop_on_shutdown,omitempty"`
+
+	// kinds of the flat stats of a service without a schema, by name,
+	// as {"requests": "counter"}; others are gauges
+	StatsKinds map[string]service.MetricKind `json:"stats_kinds,omitempty"`
 }
 
 // ----------------------------------------------------------------------------
@@ -58,68 +115,97 @@ func (self *ServiceContext) getenv(serviceId string, serviceUrl string) []string
 
 // List Bundles
 func (self *ServiceContext) List(req *http.Request, args *struct{}, res *map[string]*ServiceInstall) error {
-	*res = self.Registry
+	*res = self.Registry.List()
 	return nil
 }
 
 // Install a Bundle
+//
+// Installation runs as a job, `res` is set to the job id.
 func (self *ServiceContext) Install(req *http.Request, svc *ServiceInstall, res *string) error {
 
 	var err error = nil
 
 	log.Printf("info: installing id=%s url=%s params=%#v\n", svc.Id, svc.URL, svc.Params)
 
-	if _, exists := self.Registry[svc.Id]; exists {
-		log.Printf("error: Service found: %s", svc.Id)
-		return service.Exists
+	if !validServiceId(svc.Id) {
+		log.Printf("error: %s: %q\n", ErrorInvalidServiceId.Error(), svc.Id)
+		return ErrorInvalidServiceId
 	}
 
-	// make sure the svc path exists
-	svcPath := filepath.Join(rootPath, "svc", svc.Id)
-	os.MkdirAll(svcPath, 0755)
-
-	// env
-	env := self.getenv(svc.Id, svc.URL)
+	if err = checkSource(svc); err != nil {
+		log.Printf("error: %s: %s\n", err.Error(), svc.URL)
+		return err
+	}
 
-	// download the service
-	get := exec.Command("go", "get", "-u", svc.URL)
-	log.Printf("info: executing: %s %s\n", get.Path, strings.Join(get.Args, " "))
-	get.Env = env
-	get.Dir = svcPath
-	getOut, err := get.CombinedOutput()
-	if err != nil {
+	if err = self.Registry.Acquire(svc.Id, "install"); err != nil {
 		log.Printf("error: %s\n", err.Error())
 		return err
-	} else {
-		if len(getOut) > 0 {
-			log.Printf("info: out: %x\n", string(getOut))
-		}
 	}
 
-	// binPath := filepath.Join("service")
-	build := exec.Command("go", "build", "-o", "service", svc.URL)
-	log.Printf("info: executing: %s %s\n", build.Path, strings.Join(build.Args, " "))
-	build.Env = env
-	build.Dir = svcPath
-	buildOut, err := build.CombinedOutput()
-	if err != nil {
+	if self.Registry.Exists(svc.Id) {
+		self.Registry.Release(svc.Id)
+		log.Printf("error: Service found: %s", svc.Id)
+		return service.Exists
+	}
+
+	if err = self.transition(svc.Id, service.Installing, ""); err != nil {
+		self.Registry.Release(svc.Id)
 		log.Printf("error: %s\n", err.Error())
 		return err
-	} else {
-		if len(buildOut) > 0 {
-			log.Printf("info: out: %x\n", buildOut)
+	}
+
+	job := self.Jobs.start(svc.Id, "install", func(job *Job) error {
+		defer self.Registry.Release(svc.Id)
+		start := time.Now()
+		err := self.install(job, svc)
+		self.Metrics.observeInstall(time.Since(start), err)
+		if err != nil {
+			self.emitError(svc.Id, "install", err)
+			self.transition(svc.Id, service.NotInstalled, err.Error())
+		} else {
+			self.transition(svc.Id, service.Stopped, "")
 		}
+		return err
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+// install fetches and installs the service, writing service.json last, so
+// a rescan only finds services which installed completely; a failed or
+// cancelled install leaves nothing behind, unless the svc path existed
+// before.
+func (self *ServiceContext) install(job *Job, svc *ServiceInstall) (err error) {
+
+	// make sure the svc path exists
+	svcPath := filepath.Join(rootPath, "svc", svc.Id)
+	os.MkdirAll(filepath.Dir(svcPath), 0755)
+	created := true
+	if err = os.Mkdir(svcPath, 0755); os.IsExist(err) {
+		created = false
+	} else if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
 	}
 
-	// write the url file
-	jsonFile := filepath.Join(svcPath, "service.json")
-	log.Printf("info: loading service.json: %s\n", jsonFile)
-	jsonData, err := json.Marshal(svc)
-	if err != nil {
-		log.Printf("error: loading service.json: %s\n", err.Error())
+	defer func() {
+		if err != nil && created {
+			log.Printf("info: cleaning up: %s\n", svcPath)
+			if rmErr := os.RemoveAll(svcPath); rmErr != nil {
+				log.Printf("error: %s\n", rmErr.Error())
+			}
+		}
+	}()
+
+	// env
+	env := self.getenv(svc.Id, svc.URL)
+
+	// fetch the service binary
+	if err = self.fetch(job, svc, svcPath); err != nil {
 		return err
 	}
-	ioutil.WriteFile(jsonFile, jsonData, 0755)
 
 	// write the url file
 	envFile := filepath.Join(svcPath, "service.env")
@@ -133,57 +219,115 @@ func (self *ServiceContext) Install(req *http.Request, svc *ServiceInstall, res
 
 	// run "install" command
 	log.Printf("info: installing\n")
-	if err = self.run(svc.Id, "install", svc.Params, res); err != nil {
+	sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "install"})
+	if err = self.run(job, svc.Id, "install", svc.Params, nil); err != nil {
 		log.Printf("error: installing: %s\n", err.Error())
 		return err
 	}
 
-	self.Registry[svc.Id] = svc
+	// write the service.json file
+	if err = self.save(svc); err != nil {
+		return err
+	}
+
+	self.Registry.Put(svc)
+	sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "complete"})
 
-	// *res = string(out)
 	return err
 }
 
+// save the service.json file of the service
+func (self *ServiceContext) save(svc *ServiceInstall) error {
+
+	jsonFile := filepath.Join(rootPath, "svc", svc.Id, "service.json")
+	log.Printf("info: writing service.json: %s\n", jsonFile)
+	jsonData, err := json.Marshal(svc)
+	if err != nil {
+		log.Printf("error: writing service.json: %s\n", err.Error())
+		return err
+	}
+	return ioutil.WriteFile(jsonFile, jsonData, 0755)
+}
+
 // Remove a Bundle
+//
+// Removal runs as a job, `res` is set to the job id.
 func (self *ServiceContext) Remove(req *http.Request, serviceId *string, res *string) error {
 
 	var err error = nil
 
-	svc, exists := self.Registry[*serviceId]
+	if err = self.Registry.Acquire(*serviceId, "remove"); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	svc, exists := self.Registry.Get(*serviceId)
 	if !exists {
-		log.Printf("error: Service not found: %s\n", serviceId)
+		self.Registry.Release(*serviceId)
+		log.Printf("error: Service not found: %s\n", *serviceId)
 		return service.NotFound
 	}
 
-	// run "remove" command
-	if err = self.run(svc.Id, "remove", map[string]interface{}{}, res); err != nil {
+	if err = self.Registry.CanTransition(svc.Id, service.NotInstalled); err != nil {
+		self.Registry.Release(svc.Id)
+		log.Printf("error: %s\n", err.Error())
 		return err
 	}
 
-	delete(self.Registry, svc.Id)
+	job := self.Jobs.start(svc.Id, "remove", func(job *Job) error {
+		defer self.Registry.Release(svc.Id)
+		err := self.remove(job, svc)
+		if err != nil {
+			self.emitError(svc.Id, "remove", err)
+		} else {
+			self.transition(svc.Id, service.NotInstalled, "")
+			self.Supervisor.forget(svc.Id)
+			self.HealthMonitor.forget(svc.Id)
+			self.History.forget(svc.Id)
+			self.Alerts.forget(svc.Id)
+		}
+		return err
+	})
 
-	svcPath := filepath.Join(rootPath, "svc", svc.Id)
+	*res = job.Id()
+	return nil
+}
 
-	// clean up
+func (self *ServiceContext) remove(job *Job, svc *ServiceInstall) error {
 
-	cmd := exec.Command("go", "clean", svc.URL)
-	cmd.Env = self.getenv(*serviceId, svc.URL)
-	cmd.Dir = svcPath
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("error: %s\n", err.Error())
+	var err error = nil
+
+	// run "remove" command
+	if err = self.run(job, svc.Id, "remove", map[string]interface{}{}, nil); err != nil {
 		return err
-	} else {
-		if len(out) > 0 {
-			log.Printf("info: out: %x\n", out)
-		}
 	}
 
-	srcPath := filepath.Join(rootPath, "src", svc.URL)
-	if err = os.RemoveAll(srcPath); err != nil {
-		if !os.IsNotExist(err) {
+	self.Registry.Delete(svc.Id)
+
+	svcPath := filepath.Join(rootPath, "svc", svc.Id)
+
+	// clean up
+
+	if scheme, importPath := parseSource(svc.URL); scheme == SourceGo {
+		cmd := exec.Command("go", "clean", importPath)
+		cmd.Env = self.getenv(svc.Id, svc.URL)
+		cmd.Dir = svcPath
+		out, err := job.execute(cmd)
+		if err != nil {
 			log.Printf("error: %s\n", err.Error())
 			return err
+		} else {
+			if len(out) > 0 {
+				log.Printf("info: out: %x\n", out)
+			}
+		}
+
+		srcPath := filepath.Join(rootPath, "src", importPath)
+		if err = os.RemoveAll(srcPath); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("error: %s\n", err.Error())
+				return err
+			}
 		}
 	}
 
@@ -207,64 +351,285 @@ func (self *ServiceContext) Remove(req *http.Request, serviceId *string, res *st
 
 // Check Existence of a Service
 func (self *ServiceContext) Exists(req *http.Request, serviceId *string, res *bool) error {
+	*res = self.Registry.Exists(*serviceId)
+	return nil
+}
 
-	if _, exists := self.Registry[*serviceId]; exists {
-		*res = true
-	} else {
-		*res = false
+// Status of the Service
+func (self *ServiceContext) Status(req *http.Request, serviceId *string, res *ServiceStatus) error {
+	if !self.Registry.Exists(*serviceId) {
+		return service.NotFound
+	}
+
+	res.Id = *serviceId
+	res.Supervisor = self.Supervisor.status(*serviceId)
+
+	// an operation is in progress, report its state
+	tracked := self.Registry.State(*serviceId)
+	if transitional(tracked.Status) {
+		res.State = tracked.Status
+		return nil
+	}
+
+	detail, err := self.status(*serviceId)
+	if err != nil {
+		return err
 	}
 
+	self.reconcile(*serviceId, detail)
+
+	// include the rollup of monitored health checks
+	if svc, exists := self.Registry.Get(*serviceId); exists && self.policy(svc).Health != nil {
+		if detail.Health == nil {
+			detail.Health = map[string]interface{}{}
+		}
+		detail.Health["status"] = self.HealthMonitor.report(*serviceId).Status
+	}
+
+	res.StatusDetail = *detail
 	return nil
 }
 
-// Status of the Service
-func (self *ServiceContext) Status(req *http.Request, serviceId *string, res *string) error {
-	if _, exists := self.Registry[*serviceId]; !exists {
-		return service.NotFound
+// Run the "status" command and parse its output
+func (self *ServiceContext) status(serviceId string) (*service.StatusDetail, error) {
+	var out string = ""
+
+	err := self.run(nil, serviceId, "status", map[string]interface{}{}, &out)
+
+	// a failing status command may still report a status document
+	detail, perr := service.ParseStatusDetail([]byte(out))
+	if perr != nil {
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("error: status: %s\n", perr.Error())
+		return nil, perr
 	}
-	return self.run(*serviceId, "status", map[string]interface{}{}, res)
+
+	if err != nil && detail.LastError == "" {
+		detail.LastError = err.Error()
+	}
+
+	return detail, nil
 }
 
 // Start the Service
+//
+// The service is started by a job, `res` is set to the job id.
 func (self *ServiceContext) Start(req *http.Request, serviceId *string, res *string) error {
-	if _, exists := self.Registry[*serviceId]; !exists {
-		return service.NotFound
+	if err := self.command(*serviceId, "start", service.Starting, res, self.start); err != nil {
+		return err
+	}
+	self.Supervisor.resume(*serviceId)
+	return nil
+}
+
+func (self *ServiceContext) start(job *Job, serviceId string) error {
+
+	if err := self.run(job, serviceId, "start", map[string]interface{}{}, nil); err != nil {
+		self.transition(serviceId, service.Failed, err.Error())
+		return err
+	}
+
+	// "start" exited 0, make sure the service is still up
+	detail, err := self.status(serviceId)
+	if err != nil {
+		self.transition(serviceId, service.Failed, err.Error())
+		return err
+	}
+
+	switch detail.State {
+	case service.Running, service.Degraded:
+		return self.transition(serviceId, detail.State, "")
+	default:
+		self.transition(serviceId, service.Failed, ErrorExitedAfterStart.Error())
+		return ErrorExitedAfterStart
 	}
-	return self.run(*serviceId, "start", map[string]interface{}{}, res)
 }
 
 // Stop the Service
+//
+// The service is stopped by a job, `res` is set to the job id.
 func (self *ServiceContext) Stop(req *http.Request, serviceId *string, res *string) error {
-	if _, exists := self.Registry[*serviceId]; !exists {
-		return service.NotFound
+	if err := self.command(*serviceId, "stop", service.Stopping, res, self.stop); err != nil {
+		return err
+	}
+	self.Supervisor.hold(*serviceId)
+	return nil
+}
+
+func (self *ServiceContext) stop(job *Job, serviceId string) error {
+
+	if err := self.run(job, serviceId, "stop", map[string]interface{}{}, nil); err != nil {
+		self.transition(serviceId, service.Failed, err.Error())
+		return err
 	}
-	return self.run(*serviceId, "stop", map[string]interface{}{}, res)
+
+	return self.transition(serviceId, service.Stopped, "")
 }
 
-// Stats of the Service
+// Stats of the Service, as reported by services without a schema, or
+// flattened for those with one
 func (self *ServiceContext) Stats(req *http.Request, serviceId *string, res *map[string]interface{}) error {
-	var out string = ""
 
-	if _, exists := self.Registry[*serviceId]; !exists {
+	stats, err := self.stats(*serviceId)
+	if err != nil {
+		return err
+	}
+
+	if stats.Raw != nil {
+		*res = stats.Raw
+	} else {
+		*res = stats.Flat()
+	}
+	return nil
+}
+
+// StatsReport of the Service, the stats with their kinds, units and labels
+func (self *ServiceContext) StatsReport(req *http.Request, serviceId *string, res *service.Stats) error {
+
+	stats, err := self.stats(*serviceId)
+	if err != nil {
+		return err
+	}
+
+	*res = *stats
+	return nil
+}
+
+// stats runs the "stats" command of the service, and validates its output
+func (self *ServiceContext) stats(serviceId string) (*service.Stats, error) {
+
+	if !self.Registry.Exists(serviceId) {
+		return nil, service.NotFound
+	}
+
+	cmd, err := self.serviceCommand(serviceId, "stats", map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	// stats are collected in the background, a hung command must not
+	// hold up the collection
+	out, err := executeTimeout(cmd, statsTimeout)
+	if err != nil {
+		self.Metrics.childFailed(serviceId, "stats")
+		log.Printf("error: stats: %s: %s\n", serviceId, err.Error())
+		return nil, err
+	}
+
+	stats, err := service.ParseStats(out)
+	if err == nil && stats.Raw != nil {
+		if svc, exists := self.Registry.Get(serviceId); exists && len(svc.StatsKinds) > 0 {
+			stats = service.FlatStats(stats.Raw, svc.StatsKinds)
+		}
+	}
+	if err == nil {
+		err = stats.Validate()
+	}
+	if err != nil {
+		log.Printf("error: stats: %s: %s\n", serviceId, err.Error())
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Run an operation in a job, holding the service for the duration.
+//
+// The service moves to the `pending` state before the job starts, `fn`
+// is responsible for the final transition.
+func (self *ServiceContext) command(serviceId string, commandName string, pending service.Status, res *string, fn func(job *Job, serviceId string) error) error {
+
+	if err := self.Registry.Acquire(serviceId, commandName); err != nil {
+		return err
+	}
+
+	if !self.Registry.Exists(serviceId) {
+		self.Registry.Release(serviceId)
 		return service.NotFound
 	}
 
-	err := self.run(*serviceId, "stats", map[string]interface{}{}, &out)
+	if err := self.transition(serviceId, pending, ""); err != nil {
+		self.Registry.Release(serviceId)
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	job := self.Jobs.start(serviceId, commandName, func(job *Job) error {
+		defer self.Registry.Release(serviceId)
+		err := fn(job, serviceId)
+		if err != nil {
+			self.emitError(serviceId, commandName, err)
+		}
+		return err
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+// Publish an "error" event
+func (self *ServiceContext) emitError(serviceId string, commandName string, err error) {
+	sendEvent(self.SendEventMessage, "error", &ErrorEvent{
+		Id:      serviceId,
+		Command: commandName,
+		Error:   err.Error(),
+	})
+}
+
+// Run a Service Command
+//
+// If `job` is nil, the command runs synchronously. If `res` is not nil,
+// it receives the command output, even if the command fails.
+func (self *ServiceContext) run(job *Job, serviceId string, commandName string, params map[string]interface{}, res *string) error {
+
+	cmd, err := self.serviceCommand(serviceId, commandName, params)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal([]byte(out), res)
+	out, err := job.execute(cmd)
+	if res != nil {
+		*res = string(out)
+	}
+	if err != nil {
+		if err != ErrorJobCancelled {
+			self.Metrics.childFailed(serviceId, commandName)
+		}
+		log.Printf("error: executing: %s\n", err.Error())
+		if out != nil && len(out) > 0 {
+			log.Printf("error: out: %x\n", out)
+			log.Printf("error: out: %q\n", string(out))
+		}
+	} else {
+		log.Printf("info: out: %x\n", out)
+	}
+
 	return err
 }
 
-// Run a Service Command
-func (self *ServiceContext) run(serviceId string, commandName string, params map[string]interface{}, res *string) error {
+// unsupported reports whether a command failed as not implemented by the
+// service
+func unsupported(err error) bool {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus() == service.ExitUnsupported
+		}
+	}
+	return false
+}
+
+// validServiceId reports whether `id` names a single directory under svc/
+func validServiceId(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\\")
+}
+
+// Build a Service Command, with `params` on stdin
+func (self *ServiceContext) serviceCommand(serviceId string, commandName string, params map[string]interface{}) (*exec.Cmd, error) {
 
-	var err error = nil
 	var serviceUrl string = ""
 
-	svc, exists := self.Registry[serviceId]
+	svc, exists := self.Registry.Get(serviceId)
 	if exists {
 		serviceUrl = svc.URL
 	}
@@ -279,23 +644,11 @@ func (self *ServiceContext) run(serviceId string, commandName string, params map
 	b, err := json.Marshal(params)
 	if err != nil {
 		log.Printf("error: %s", err.Error())
-		return err
+		return nil, err
 	} else {
 		cmd.Stdin = bytes.NewReader(b)
 	}
 	log.Printf("info: executing: < %s\n", b)
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("error: executing: %s\n", err.Error())
-		if out != nil && len(out) > 0 {
-			log.Printf("error: out: %x\n", out)
-			log.Printf("error: out: %q\n", string(out))
-		}
-	} else {
-		*res = string(out)
-		log.Printf("info: out: %x\n", out)
-	}
-
-	return err
+	return cmd, nil
 }
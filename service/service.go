@@ -1,6 +1,8 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -8,21 +10,187 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 var (
-	Exists   = errors.New("Service Exists")
-	NotFound = errors.New("Service Not Found")
+	Exists        = errors.New("Service Exists")
+	NotFound      = errors.New("Service Not Found")
+	InvalidStatus = errors.New("Invalid Service Status")
+	InvalidHealth = errors.New("Invalid Service Health")
+	InvalidStats  = errors.New("Invalid Service Stats")
 )
 
+// Exit code of commands the service does not implement, or does not know.
+// It is distinct from the exit codes of panics and flag errors, 2.
+const ExitUnsupported int = 64
+
 type Status int
 
 const (
 	Running Status = iota
 	Stopped
 	StatusUnknown
+	Installing
+	Starting
+	Stopping
+	Failed
+	Degraded
+	NotInstalled
 )
 
+var statusNames = map[Status]string{
+	Running:       "running",
+	Stopped:       "stopped",
+	StatusUnknown: "unknown",
+	Installing:    "installing",
+	Starting:      "starting",
+	Stopping:      "stopping",
+	Failed:        "failed",
+	Degraded:      "degraded",
+	NotInstalled:  "not_installed",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return statusNames[StatusUnknown]
+}
+
+func (s Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Status) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	*s = ParseStatus(name)
+	return nil
+}
+
+// Parse a status name, as returned by Status.String()
+func ParseStatus(name string) Status {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for s, n := range statusNames {
+		if n == name {
+			return s
+		}
+	}
+	return StatusUnknown
+}
+
+// Status document written to stdout, as JSON, by the "status" command.
+type StatusDetail struct {
+	State     Status                 `json:"state"`
+	Pid       int                    `json:"pid,omitempty"`
+	Uptime    int64                  `json:"uptime,omitempty"`
+	Version   string                 `json:"version,omitempty"`
+	LastError string                 `json:"last_error,omitempty"`
+	Health    map[string]interface{} `json:"health,omitempty"`
+}
+
+// Services may implement StatusDetailer to report more than the state.
+// Uptime is in seconds.
+type StatusDetailer interface {
+	StatusDetail() (*StatusDetail, error)
+}
+
+// Services may implement Configurer to apply updated params without
+// being reinstalled, via the "configure" command.
+type Configurer interface {
+	Configure(map[string]interface{}) error
+}
+
+// Services may implement Upgrader to migrate their state when upgraded.
+// The "upgrade" command is run with the new binary, before it is started.
+type Upgrader interface {
+	Upgrade(map[string]interface{}) error
+}
+
+// Health document written to stdout, as JSON, by the "health" command.
+type HealthResult struct {
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Services may implement HealthChecker to support the "health" command.
+type HealthChecker interface {
+	Health() (*HealthResult, error)
+}
+
+// Parse the output of the "health" command.
+//
+// The output may contain log lines. The last line holding a JSON health
+// document is used.
+func ParseHealthResult(out []byte) (*HealthResult, error) {
+
+	var result *HealthResult = nil
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "{") {
+			r := &HealthResult{}
+			if err := json.Unmarshal([]byte(line), r); err == nil {
+				result = r
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, InvalidHealth
+	}
+
+	return result, nil
+}
+
+// Parse the output of the "status" command.
+//
+// The output may contain log lines. The last line holding a JSON status
+// document is used. Output of older services, which only print
+// "status: <state>", is also understood.
+func ParseStatusDetail(out []byte) (*StatusDetail, error) {
+
+	var detail *StatusDetail = nil
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "{"):
+			d := &StatusDetail{}
+			if err := json.Unmarshal([]byte(line), d); err == nil {
+				detail = d
+			}
+		case strings.HasPrefix(line, "status:"):
+			detail = &StatusDetail{
+				State: ParseStatus(strings.TrimPrefix(line, "status:")),
+			}
+		case strings.HasPrefix(line, "error:"):
+			if detail != nil && detail.LastError == "" {
+				detail.LastError = strings.TrimSpace(strings.TrimPrefix(line, "error:"))
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if detail == nil {
+		return nil, InvalidStatus
+	}
+
+	return detail, nil
+}
+
 type Service interface {
 	Install(map[string]interface{}) error
 	Remove() error
@@ -68,29 +236,102 @@ func Run(s Service) {
 				serviceError(s.Install(params))
 			}
 		}
+	case "configure":
+		// read params from stdin as JSON
+		configurer, ok := s.(Configurer)
+		if !ok {
+			println("error: unsupported command: " + cmd)
+			os.Exit(ExitUnsupported)
+		}
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			serviceError(err)
+		} else {
+			var params map[string]interface{}
+			err = json.Unmarshal(b, &params)
+			if err != nil {
+				serviceError(err)
+			} else {
+				serviceError(configurer.Configure(params))
+			}
+		}
+	case "upgrade":
+		// read params from stdin as JSON
+		upgrader, ok := s.(Upgrader)
+		if !ok {
+			println("error: unsupported command: " + cmd)
+			os.Exit(ExitUnsupported)
+		}
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			serviceError(err)
+		} else {
+			var params map[string]interface{}
+			err = json.Unmarshal(b, &params)
+			if err != nil {
+				serviceError(err)
+			} else {
+				serviceError(upgrader.Upgrade(params))
+			}
+		}
 	case "remove":
 		serviceError(s.Remove())
 	case "status":
-		status, err := s.Status()
-		if err == nil {
-			switch status {
-			case Running:
-				println("status: running")
-			case Stopped:
-				println("status: stopped")
-			case StatusUnknown:
-				println("status: unknown")
-			}
+		// output status to stdout as JSON
+		var detail *StatusDetail
+		var err error
+		if d, ok := s.(StatusDetailer); ok {
+			detail, err = d.StatusDetail()
 		} else {
+			detail = &StatusDetail{}
+			detail.State, err = s.Status()
+		}
+		if detail == nil {
+			detail = &StatusDetail{State: StatusUnknown}
+		}
+		if err != nil {
+			detail.State = StatusUnknown
+			detail.LastError = err.Error()
+		}
+		b, merr := json.Marshal(detail)
+		if merr != nil {
+			serviceError(merr)
+		} else {
+			os.Stdout.Write(b)
+			os.Stdout.WriteString("\n")
+		}
+		serviceError(err)
+	case "health":
+		// output health to stdout as JSON
+		checker, ok := s.(HealthChecker)
+		if !ok {
+			println("error: unsupported command: " + cmd)
+			os.Exit(ExitUnsupported)
+		}
+		result, err := checker.Health()
+		if err != nil {
+			result = &HealthResult{Healthy: false, Detail: err.Error()}
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
 			serviceError(err)
+		} else {
+			os.Stdout.Write(b)
+			os.Stdout.WriteString("\n")
 		}
 	case "start":
 		serviceError(s.Start())
 	case "stop":
 		serviceError(s.Stop())
 	case "stats":
-		// output stats to stdout as JSON
-		stats, err := s.Stats()
+		// output stats to stdout as JSON, flat stats as they are
+		var stats interface{}
+		var err error
+		if r, ok := s.(StatsReporter); ok {
+			stats, err = r.StatsReport()
+		} else {
+			stats, err = s.Stats()
+		}
 		if err == nil {
 			b, err := json.Marshal(stats)
 			if err != nil {
@@ -104,5 +345,6 @@ func Run(s Service) {
 		}
 	default:
 		println("error: unknown command: " + cmd)
+		os.Exit(ExitUnsupported)
 	}
 }
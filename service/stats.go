@@ -0,0 +1,421 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type MetricKind string
+
+const (
+	// a value which only increases, as a count of requests
+	Counter MetricKind = "counter"
+
+	// a value which goes up and down, as memory used
+	Gauge MetricKind = "gauge"
+
+	// a distribution of observations, in buckets
+	Histogram MetricKind = "histogram"
+)
+
+// A stat of a service.
+//
+// Metrics sharing a name differ by their labels. The unit is free form,
+// as "bytes", "seconds", "percent" or "ops/s". The value of a histogram is
+// the count of its observations, its sum their sum if known, and its
+// buckets are cumulative.
+type Metric struct {
+	Name    string            `json:"name"`
+	Kind    MetricKind        `json:"kind"`
+	Unit    string            `json:"unit,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   float64           `json:"value"`
+	Sum     float64           `json:"sum,omitempty"`
+	Buckets []Bucket          `json:"buckets,omitempty"`
+}
+
+// A histogram bucket, counting the observations up to UpperBound
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      float64 `json:"count"`
+}
+
+// Stats document written to stdout, as JSON, by the "stats" command.
+//
+// Raw holds the flat stats of services without a schema, as reported,
+// when the metrics were converted from them.
+type Stats struct {
+	Metrics []Metric               `json:"metrics"`
+	Raw     map[string]interface{} `json:"-"`
+}
+
+// Services may implement StatsReporter to report typed stats. Services
+// which do not report their flat Stats(), which are converted by
+// FlatStats when parsed.
+type StatsReporter interface {
+	StatsReport() (*Stats, error)
+}
+
+// ----------------------------------------------------------------------------
+//
+// Stats Methods
+//
+// ----------------------------------------------------------------------------
+
+// Add a metric
+func (self *Stats) Add(m Metric) {
+	self.Metrics = append(self.Metrics, m)
+}
+
+// Get returns the metric of `name` without labels
+func (self *Stats) Get(name string) (*Metric, bool) {
+	for i, m := range self.Metrics {
+		if m.Name == name && len(m.Labels) == 0 {
+			return &self.Metrics[i], true
+		}
+	}
+	return nil, false
+}
+
+// Validate checks the names, kinds and values of the metrics
+func (self *Stats) Validate() error {
+
+	kinds := map[string]MetricKind{}
+	keys := map[string]bool{}
+
+	for _, m := range self.Metrics {
+		if !validName(m.Name) {
+			return fmt.Errorf("%s: invalid name: %q", InvalidStats.Error(), m.Name)
+		}
+
+		switch m.Kind {
+		case Counter, Gauge, Histogram:
+		default:
+			return fmt.Errorf("%s: %s: invalid kind: %q", InvalidStats.Error(), m.Name, m.Kind)
+		}
+		if kind, exists := kinds[m.Name]; exists && kind != m.Kind {
+			return fmt.Errorf("%s: %s: both %s and %s", InvalidStats.Error(), m.Name, kind, m.Kind)
+		}
+		kinds[m.Name] = m.Kind
+
+		for name := range m.Labels {
+			if !validName(name) || name == "le" {
+				return fmt.Errorf("%s: %s: invalid label: %q", InvalidStats.Error(), m.Name, name)
+			}
+		}
+		key := m.Key()
+		if keys[key] {
+			return fmt.Errorf("%s: %s: duplicate", InvalidStats.Error(), key)
+		}
+		keys[key] = true
+
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			return fmt.Errorf("%s: %s: invalid value", InvalidStats.Error(), key)
+		}
+		if m.Kind != Gauge && m.Value < 0 {
+			return fmt.Errorf("%s: %s: negative %s", InvalidStats.Error(), key, m.Kind)
+		}
+
+		if m.Kind != Histogram {
+			if len(m.Buckets) > 0 {
+				return fmt.Errorf("%s: %s: buckets of a %s", InvalidStats.Error(), key, m.Kind)
+			}
+			continue
+		}
+		for i, b := range m.Buckets {
+			if i > 0 && (b.UpperBound <= m.Buckets[i-1].UpperBound || b.Count < m.Buckets[i-1].Count) {
+				return fmt.Errorf("%s: %s: buckets are not cumulative", InvalidStats.Error(), key)
+			}
+			if b.Count > m.Value {
+				return fmt.Errorf("%s: %s: bucket count exceeds value", InvalidStats.Error(), key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Flat returns the stats as a map, as returned by services without a
+// schema. Labeled metrics are keyed as `name{label="value"}`, and the
+// buckets of histograms as `name_bucket{le="bound"}`.
+func (self *Stats) Flat() map[string]interface{} {
+	flat := map[string]interface{}{}
+	for _, m := range self.Metrics {
+		flat[m.Key()] = m.Value
+		for _, b := range m.Buckets {
+			labels := map[string]string{"le": formatFloat(b.UpperBound)}
+			for k, v := range m.Labels {
+				labels[k] = v
+			}
+			flat[metricKey(m.Name+"_bucket", labels)] = b.Count
+		}
+	}
+	return flat
+}
+
+// ----------------------------------------------------------------------------
+//
+// Metric Methods
+//
+// ----------------------------------------------------------------------------
+
+// Key identifies the metric by its name and labels
+func (self *Metric) Key() string {
+	return metricKey(self.Name, self.Labels)
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// FlatStats converts the flat stats of services without a schema.
+//
+// Numbers, numeric strings and booleans become gauges, or the kind hinted
+// for their name by `kinds`, arrays of numbers are labeled by index and
+// nested objects are flattened. Latency stats of Aerospike,
+// "latency:<histogram>:gt:<threshold>" and "latency:<histogram>:ops/sec",
+// become "latency_over" and "latency_ops" labeled by histogram. Other
+// values are dropped, but kept in Raw, as are stats whose name collides
+// with an earlier one, by name, once converted, such as "a_b" after "a-b".
+func FlatStats(flat map[string]interface{}, kinds map[string]MetricKind) *Stats {
+
+	// values of services running in process are not yet JSON
+	var values map[string]interface{}
+	if b, err := json.Marshal(flat); err == nil {
+		json.Unmarshal(b, &values)
+	}
+
+	stats := &Stats{Raw: values}
+	addFlat(stats, "", values, kinds)
+	stats.Metrics = dedupe(stats.Metrics)
+	sort.SliceStable(stats.Metrics, func(i, j int) bool {
+		return stats.Metrics[i].Key() < stats.Metrics[j].Key()
+	})
+	return stats
+}
+
+func addFlat(stats *Stats, prefix string, values map[string]interface{}, kinds map[string]MetricKind) {
+
+	// in order, so the first of colliding stats is kept
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		v := values[name]
+		if prefix == "" && strings.HasPrefix(name, "latency:") {
+			if m, ok := latencyMetric(name, v); ok {
+				stats.Add(m)
+			}
+			continue
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			addFlat(stats, prefix+name+"_", v, kinds)
+		case []interface{}:
+			metric := metricName(prefix + name)
+			for i, item := range v {
+				if f, ok := flatValue(item); ok {
+					stats.Add(Metric{
+						Name:   metric,
+						Kind:   flatKind(metric, kinds),
+						Labels: map[string]string{"index": strconv.Itoa(i)},
+						Value:  f,
+					})
+				}
+			}
+		default:
+			if f, ok := flatValue(v); ok {
+				metric := metricName(prefix + name)
+				stats.Add(Metric{Name: metric, Kind: flatKind(metric, kinds), Value: f})
+			}
+		}
+	}
+}
+
+// dedupe drops the metrics of a key already seen, or of a name already
+// seen with another kind, which would not validate
+func dedupe(metrics []Metric) []Metric {
+
+	keys := map[string]bool{}
+	kinds := map[string]MetricKind{}
+
+	kept := metrics[:0]
+	for _, m := range metrics {
+		key := m.Key()
+		if kind, exists := kinds[m.Name]; keys[key] || (exists && kind != m.Kind) {
+			continue
+		}
+		keys[key] = true
+		kinds[m.Name] = m.Kind
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// latencyMetric converts a flat Aerospike latency stat
+func latencyMetric(name string, v interface{}) (Metric, bool) {
+
+	f, ok := flatValue(v)
+	if !ok {
+		return Metric{}, false
+	}
+
+	parts := strings.Split(name, ":")
+	switch {
+	case len(parts) == 4 && parts[2] == "gt":
+		return LatencyOver(parts[1], parts[3], f), true
+	case len(parts) == 4 && parts[2] == "lt":
+		return Metric{
+			Name:   "latency_under",
+			Kind:   Gauge,
+			Unit:   "percent",
+			Labels: map[string]string{"histogram": parts[1], "threshold": parts[3]},
+			Value:  f,
+		}, true
+	case len(parts) == 3 && parts[2] == "ops/sec":
+		return LatencyOps(parts[1], f), true
+	}
+	return Metric{}, false
+}
+
+// LatencyOver is the percent of operations of a latency histogram slower
+// than the threshold
+func LatencyOver(histogram string, threshold string, percent float64) Metric {
+	return Metric{
+		Name:   "latency_over",
+		Kind:   Gauge,
+		Unit:   "percent",
+		Labels: map[string]string{"histogram": histogram, "threshold": threshold},
+		Value:  percent,
+	}
+}
+
+// LatencyOps is the throughput of a latency histogram
+func LatencyOps(histogram string, ops float64) Metric {
+	return Metric{
+		Name:   "latency_ops",
+		Kind:   Gauge,
+		Unit:   "ops/s",
+		Labels: map[string]string{"histogram": histogram},
+		Value:  ops,
+	}
+}
+
+// Parse the output of the "stats" command.
+//
+// The output may contain log lines. The last line holding a JSON object
+// is used, either a stats document or the flat stats of older services.
+func ParseStats(out []byte) (*Stats, error) {
+
+	var stats *Stats = nil
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+
+		var doc struct {
+			Metrics []Metric `json:"metrics"`
+		}
+		if err := json.Unmarshal([]byte(line), &doc); err == nil && doc.Metrics != nil {
+			stats = &Stats{Metrics: doc.Metrics}
+			continue
+		}
+
+		var flat map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &flat); err == nil {
+			stats = FlatStats(flat, nil)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if stats == nil {
+		return nil, InvalidStats
+	}
+
+	return stats, nil
+}
+
+// flatKind returns the kind hinted for a flat stat, a gauge by default
+func flatKind(name string, kinds map[string]MetricKind) MetricKind {
+	if kind, exists := kinds[name]; exists {
+		return kind
+	}
+	return Gauge
+}
+
+func flatValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	default:
+		return 0, false
+	}
+}
+
+// validName reports whether `name` is a valid metric or label name
+func validName(name string) bool {
+	return name != "" && metricName(name) == name
+}
+
+// metricName replaces the characters not allowed in metric names
+func metricName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	names := []string{}
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, k := range names {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
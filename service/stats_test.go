@@ -0,0 +1,175 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStats(t *testing.T) {
+
+	// a stats document, after log lines
+	stats, err := ParseStats([]byte("starting\n{\"metrics\":[{\"name\":\"requests\",\"kind\":\"counter\",\"value\":3}]}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := stats.Get("requests"); !ok || m.Kind != Counter || m.Value != 3 || stats.Raw != nil {
+		t.Fatalf("document: %+v", stats)
+	}
+
+	// flat stats, the last line wins
+	stats, err = ParseStats([]byte("{\"requests\":1}\n{\"requests\":2,\"version\":\"3.8\",\"mode\":\"strict\"}\nshutting down\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := stats.Get("requests"); !ok || m.Kind != Gauge || m.Value != 2 {
+		t.Fatalf("flat: %+v", stats)
+	}
+	// values which are not numbers are kept in Raw
+	if _, ok := stats.Get("mode"); ok || stats.Raw["mode"] != "strict" || stats.Raw["version"] != "3.8" {
+		t.Fatalf("flat raw: %+v", stats)
+	}
+
+	for _, out := range []string{"", "not json\n", "[1, 2]\n"} {
+		if _, err = ParseStats([]byte(out)); err != InvalidStats {
+			t.Errorf("%q: %v", out, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		metrics []Metric
+		err     string
+	}{
+		{[]Metric{{Name: "requests", Kind: Counter, Value: 1}, {Name: "used", Kind: Gauge, Value: -1}}, ""},
+		{[]Metric{{Name: "requests", Kind: Counter, Value: 1, Labels: map[string]string{"ns": "a"}}, {Name: "requests", Kind: Counter, Value: 2, Labels: map[string]string{"ns": "b"}}}, ""},
+		{[]Metric{{Name: "1requests", Kind: Counter}}, "invalid name"},
+		{[]Metric{{Name: "requests", Kind: "summary"}}, "invalid kind"},
+		{[]Metric{{Name: "requests", Kind: Counter}, {Name: "requests", Kind: Gauge, Labels: map[string]string{"ns": "a"}}}, "both counter and gauge"},
+		{[]Metric{{Name: "requests", Kind: Counter, Labels: map[string]string{"le": "1"}}}, "invalid label"},
+		{[]Metric{{Name: "requests", Kind: Counter}, {Name: "requests", Kind: Counter}}, "duplicate"},
+		{[]Metric{{Name: "requests", Kind: Counter, Value: -1}}, "negative counter"},
+		{[]Metric{{Name: "requests", Kind: Counter, Buckets: []Bucket{{1, 1}}}}, "buckets of a counter"},
+		{[]Metric{{Name: "latency", Kind: Histogram, Value: 3, Buckets: []Bucket{{1, 1}, {2, 3}}}}, ""},
+		{[]Metric{{Name: "latency", Kind: Histogram, Value: 3, Buckets: []Bucket{{2, 1}, {1, 3}}}}, "not cumulative"},
+		{[]Metric{{Name: "latency", Kind: Histogram, Value: 3, Buckets: []Bucket{{1, 2}, {2, 1}}}}, "not cumulative"},
+		{[]Metric{{Name: "latency", Kind: Histogram, Value: 1, Buckets: []Bucket{{1, 2}}}}, "exceeds value"},
+	}
+
+	for i, test := range tests {
+		err := (&Stats{Metrics: test.metrics}).Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%d: %v, expected %q", i, err, test.err)
+		}
+	}
+}
+
+func TestFlatStats(t *testing.T) {
+	flat := map[string]interface{}{
+		"requests":                  float64(10),
+		"used":                      "2.5",
+		"up":                        true,
+		"disks":                     []interface{}{float64(1), "x", float64(3)},
+		"ns":                        map[string]interface{}{"objects": 4},
+		"latency:reads:gt:1ms":      "0.5",
+		"latency:reads:ops/sec":     float64(100),
+		"latency:writes:unexpected": float64(1),
+	}
+
+	stats := FlatStats(flat, map[string]MetricKind{"requests": Counter, "ns_objects": Counter})
+	if err := stats.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := stats.Flat()
+	expected := map[string]interface{}{
+		"requests":         float64(10),
+		"used":             2.5,
+		"up":               float64(1),
+		"ns_objects":       float64(4),
+		`disks{index="0"}`: float64(1),
+		`disks{index="2"}`: float64(3),
+		`latency_over{histogram="reads",threshold="1ms"}`: 0.5,
+		`latency_ops{histogram="reads"}`:                  float64(100),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("flat: %v, expected %v", got, expected)
+	}
+
+	for name, kind := range map[string]MetricKind{"requests": Counter, "ns_objects": Counter, "used": Gauge} {
+		if m, ok := stats.Get(name); !ok || m.Kind != kind {
+			t.Errorf("%s: %+v, expected a %s", name, m, kind)
+		}
+	}
+
+	// in process values are kept as JSON
+	if stats.Raw["used"] != "2.5" || !reflect.DeepEqual(stats.Raw["ns"], map[string]interface{}{"objects": float64(4)}) {
+		t.Errorf("raw: %v", stats.Raw)
+	}
+}
+
+// Stats colliding once converted keep the first, by name, and validate
+func TestFlatCollisions(t *testing.T) {
+	flat := map[string]interface{}{
+		"a-b":                  float64(1),
+		"a_b":                  float64(2),
+		"ns":                   map[string]interface{}{"objects": float64(3)},
+		"ns_objects":           float64(4),
+		"latency:reads:gt:1ms": float64(5),
+		"latency_over":         float64(6),
+	}
+
+	for i := 0; i < 10; i++ {
+		stats := FlatStats(flat, map[string]MetricKind{"latency_over": Counter})
+		if err := stats.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]interface{}{
+			"a_b":        float64(1),
+			"ns_objects": float64(3),
+			`latency_over{histogram="reads",threshold="1ms"}`: float64(5),
+		}
+		if got := stats.Flat(); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("flat: %v, expected %v", got, expected)
+		}
+		if len(stats.Raw) != len(flat) {
+			t.Fatalf("raw: %v", stats.Raw)
+		}
+	}
+}
+
+// Flat, then converted back, unlabeled stats keep their values
+func TestFlatRoundTrip(t *testing.T) {
+	stats := &Stats{}
+	stats.Add(Metric{Name: "requests", Kind: Counter, Value: 7})
+	stats.Add(Metric{Name: "used", Kind: Gauge, Unit: "bytes", Value: 1024})
+	stats.Add(Metric{Name: "latency", Kind: Histogram, Value: 3, Buckets: []Bucket{{0.5, 1}, {1, 3}}})
+
+	flat := stats.Flat()
+	expected := map[string]interface{}{
+		"requests":                 float64(7),
+		"used":                     float64(1024),
+		"latency":                  float64(3),
+		`latency_bucket{le="0.5"}`: float64(1),
+		`latency_bucket{le="1"}`:   float64(3),
+	}
+	if !reflect.DeepEqual(flat, expected) {
+		t.Fatalf("flat: %v", flat)
+	}
+
+	// labeled keys are not names
+	delete(flat, `latency_bucket{le="0.5"}`)
+	delete(flat, `latency_bucket{le="1"}`)
+	back := FlatStats(flat, map[string]MetricKind{"requests": Counter})
+	if !reflect.DeepEqual(back.Flat(), flat) {
+		t.Fatalf("round trip: %v", back.Flat())
+	}
+	if m, _ := back.Get("requests"); m.Kind != Counter || m.Value != 7 {
+		t.Errorf("requests: %+v", m)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Installs which fail, or are cancelled, leave nothing for a rescan to
+// register.
+func TestInstallCancel(t *testing.T) {
+	ctx := newTestContext(t)
+
+	// "install" signals it started, then hangs until cancelled
+	script := strings.Replace(testService, "case \"$1\" in\nstatus)", "case \"$1\" in\ninstall)\n\ttouch \"$SERVICE_PATH/../installing\"\n\tsleep 30\n\texit 0 ;;\nstatus)", 1)
+	failing := strings.Replace(testService, "case \"$1\" in\nstatus)", "case \"$1\" in\ninstall)\n\texit 1 ;;\nstatus)", 1)
+
+	var jobId string
+	if err := ctx.Install(nil, &ServiceInstall{Id: "svc", URL: writeService(t, script)}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	job, _ := ctx.Jobs.get(jobId)
+
+	started := filepath.Join(rootPath, "svc", "installing")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("install command not started")
+		}
+	}
+	if info := job.Info(); info.Ended != nil {
+		t.Fatalf("running install ended: %v", info.Ended)
+	}
+	if err := job.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.Error != ErrorJobCancelled.Error() || info.Ended == nil {
+		t.Fatalf("cancelled install: %s %s %v", info.State, info.Error, info.Ended)
+	}
+	os.Remove(started)
+
+	if err := ctx.Install(nil, &ServiceInstall{Id: "other", URL: writeService(t, failing)}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State == JobSucceeded {
+		t.Fatal("failing install succeeded")
+	}
+
+	if err := checkServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"svc", "other"} {
+		if ctx.Registry.Exists(id) {
+			t.Errorf("%s: registered by rescan", id)
+		}
+		if state := ctx.Registry.State(id).Status; state != service.NotInstalled {
+			t.Errorf("%s: %s", id, state)
+		}
+		if _, err := os.Stat(filepath.Join(rootPath, "svc", id)); !os.IsNotExist(err) {
+			t.Errorf("%s: left behind: %v", id, err)
+		}
+	}
+}
+
+// Services without a schema get their stats back as reported, and typed
+// by the hints of service.json
+func TestStatsFlat(t *testing.T) {
+	ctx := newTestContext(t)
+	script := strings.Replace(testService, `{"metrics":[{"name":"requests","kind":"counter","value":1}]}`, `{"requests":5,"version":"3.8"}`, 1)
+
+	var jobId string
+	svc := &ServiceInstall{Id: "svc", URL: writeService(t, script), StatsKinds: map[string]service.MetricKind{"requests": service.Counter}}
+	if err := ctx.Install(nil, svc, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+		t.Fatalf("install: %s %s", info.State, info.Error)
+	}
+
+	id := "svc"
+	var flat map[string]interface{}
+	if err := ctx.Stats(nil, &id, &flat); err != nil {
+		t.Fatal(err)
+	}
+	if flat["requests"] != float64(5) || flat["version"] != "3.8" || len(flat) != 2 {
+		t.Fatalf("stats: %v", flat)
+	}
+
+	var report service.Stats
+	if err := ctx.StatsReport(nil, &id, &report); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := report.Get("requests"); !ok || m.Kind != service.Counter {
+		t.Fatalf("report: %+v", report)
+	}
+	if m, ok := report.Get("version"); !ok || m.Kind != service.Gauge || m.Value != 3.8 {
+		t.Fatalf("report: %+v", report)
+	}
+}
+
+// Ids which are not a single directory under svc/ are rejected, and the
+// directories of failed installs are only removed if they created them
+func TestInstallId(t *testing.T) {
+	ctx := newTestContext(t)
+	installService(t, ctx, "other", testService)
+
+	var jobId string
+	for _, id := range []string{"", ".", "..", "a/b", "../other", `a\b`} {
+		if err := ctx.Install(nil, &ServiceInstall{Id: id, URL: writeService(t, testService)}, &jobId); err != ErrorInvalidServiceId {
+			t.Errorf("%q: %v", id, err)
+		}
+	}
+
+	kept := filepath.Join(rootPath, "svc", "svc", "kept")
+	os.MkdirAll(filepath.Dir(kept), 0755)
+	if err := ioutil.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	failing := strings.Replace(testService, "case \"$1\" in\nstatus)", "case \"$1\" in\ninstall)\n\texit 1 ;;\nstatus)", 1)
+	if err := ctx.Install(nil, &ServiceInstall{Id: "svc", URL: writeService(t, failing)}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobFailed {
+		t.Fatalf("failing install: %s", info.State)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatalf("existing directory removed: %v", err)
+	}
+	if !ctx.Registry.Exists("other") {
+		t.Fatal("other service removed")
+	}
+	if _, err := os.Stat(filepath.Join(rootPath, "svc", "other", "service.json")); err != nil {
+		t.Fatal(err)
+	}
+}
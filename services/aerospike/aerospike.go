@@ -20,8 +20,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 	"unicode/utf8"
 )
 
@@ -34,10 +37,89 @@ var (
 	host string = "localhost:3003"
 )
 
+// aerospike.conf generated by "configure", environment variables are
+// expanded when the service starts.
+const AEROSPIKE_CONF string = `service {
+	paxos-single-replica-limit 1
+	pidfile ${AEROSPIKE_HOME}/var/run/aerospike.pid
+	service-threads {{.service_threads}}
+	transaction-queues {{.transaction_queues}}
+	transaction-threads-per-queue {{.transaction_threads_per_queue}}
+	proto-fd-max {{.proto_fd_max}}
+	work-directory ${AEROSPIKE_HOME}/var
+}
+
+logging {
+	file ${AEROSPIKE_HOME}/var/log/aerospike.log {
+		context any info
+	}
+}
+
+mod-lua {
+	system-path ${AEROSPIKE_HOME}/share/udf/lua
+	user-path ${AEROSPIKE_HOME}/var/udf/lua
+}
+
+network {
+	service {
+		address any
+		port {{.service_port}}
+	}
+
+	heartbeat {
+{{- if .mesh_seeds}}
+		mode mesh
+		port {{.heartbeat_port}}
+{{- range .mesh_seeds}}
+		mesh-seed-address-port {{seed .}}
+{{- end}}
+{{- else}}
+		mode multicast
+		address {{.multicast_address}}
+		port {{.heartbeat_port}}
+{{- end}}
+		interval 150
+		timeout 10
+	}
+
+	fabric {
+		port {{.fabric_port}}
+	}
+
+	info {
+		port {{.info_port}}
+	}
+}
+
+namespace {{.namespace}} {
+	replication-factor {{.replication_factor}}
+	memory-size {{.memory_size}}
+	default-ttl {{.default_ttl}}
+	storage-engine memory
+}
+`
+
 var (
 	ErrorInvalidChecksum error = errors.New("Invalid Checksum")
 	ErrorMissingVersion  error = errors.New("Missing 'version' Parameter")
 
+	configDefaults = map[string]interface{}{
+		"service_threads":               4,
+		"transaction_queues":            4,
+		"transaction_threads_per_queue": 4,
+		"proto_fd_max":                  15000,
+		"service_port":                  3000,
+		"fabric_port":                   3001,
+		"heartbeat_port":                3002,
+		"info_port":                     3003,
+		"multicast_address":             "239.1.99.222",
+		"mesh_seeds":                    nil,
+		"namespace":                     "test",
+		"replication_factor":            2,
+		"memory_size":                   "4G",
+		"default_ttl":                   "30d",
+	}
+
 	svcPath string = os.Getenv("SERVICE_PATH")
 
 	statsMapper = map[string]func(n string, m map[string]int) int{
@@ -107,6 +189,22 @@ var (
 		"udf_write_ok":  get("udf_write_success"),
 		"udf_write_err": get("udf_write_err_others"),
 	}
+
+	// units of the stats which are gauges, the others are counters
+	statsGauges = map[string]string{
+		"memory_total":          "bytes",
+		"memory_used":           "bytes",
+		"memory_used_data":      "bytes",
+		"memory_used_index":     "bytes",
+		"memory_used_sindex":    "bytes",
+		"disk_total":            "bytes",
+		"disk_used":             "bytes",
+		"cluster_size":          "nodes",
+		"objects":               "",
+		"transactions_waiting":  "",
+		"migrate_progress_send": "partitions",
+		"migrate_progress_recv": "partitions",
+	}
 )
 
 type AerospikeService struct{}
@@ -244,6 +342,13 @@ func (svc *AerospikeService) Install(params map[string]interface{}) error {
 		return err
 	}
 
+	// record the installed version, reported by status
+	err = ioutil.WriteFile(filepath.Join(svcPath, "version"), []byte(fmt.Sprint(version)), 0644)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
 	return nil
 }
 
@@ -282,16 +387,108 @@ func (svc *AerospikeService) Status() (Status, error) {
 	}
 }
 
+func (svc *AerospikeService) StatusDetail() (*StatusDetail, error) {
+
+	status, err := svc.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &StatusDetail{State: status}
+
+	if version, err := ioutil.ReadFile(filepath.Join(svcPath, "version")); err == nil {
+		detail.Version = strings.TrimSpace(string(version))
+	}
+
+	// the pid file is written when asd starts
+	if status == Running {
+		pidPath := filepath.Join(svcPath, "aerospike-server", "var", "run", "aerospike.pid")
+		if info, err := os.Stat(pidPath); err == nil {
+			if pid, err := ioutil.ReadFile(pidPath); err == nil {
+				detail.Pid, _ = strconv.Atoi(strings.TrimSpace(string(pid)))
+				detail.Uptime = int64(time.Since(info.ModTime()).Seconds())
+			}
+		}
+	}
+
+	return detail, nil
+}
+
+func (svc *AerospikeService) Health() (*HealthResult, error) {
+
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return &HealthResult{Healthy: false, Detail: err.Error()}, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "status\n")
+
+	out, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return &HealthResult{Healthy: false, Detail: err.Error()}, nil
+	}
+
+	out = strings.TrimSpace(out)
+	return &HealthResult{Healthy: out == "ok", Detail: out}, nil
+}
+
+// Configure generates aerospike.conf from the params, used by Start
+// instead of $CONFIG_PATH/aerospike.conf.
+func (svc *AerospikeService) Configure(params map[string]interface{}) error {
+
+	var err error
+	var conf bytes.Buffer
+
+	values := map[string]interface{}{}
+	for k, v := range configDefaults {
+		values[k] = v
+	}
+	for k, v := range params {
+		values[k] = v
+	}
+
+	funcs := template.FuncMap{
+		// "host:port" => "host port"
+		"seed": func(seed interface{}) string {
+			return strings.Replace(fmt.Sprint(seed), ":", " ", 1)
+		},
+	}
+
+	tmpl, err := template.New("aerospike.conf").Funcs(funcs).Parse(AEROSPIKE_CONF)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	if err = tmpl.Execute(&conf, values); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(svcPath, "aerospike.conf"), conf.Bytes(), 0644)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func (svc *AerospikeService) Start() error {
 
-	// copy file from $CONFIG_PATH/aerospike.conf to
-	// ./aerospike-server/etc/aerospike.conf
+	// copy the configured aerospike.conf, or $CONFIG_PATH/aerospike.conf,
+	// to ./aerospike-server/etc/aerospike.conf
 
 	var err error
 
 	os.Setenv("AEROSPIKE_HOME", filepath.Join(svcPath, "aerospike-server"))
 
-	src_path := os.ExpandEnv(filepath.Join("$CONFIG_PATH", "aerospike.conf"))
+	src_path := filepath.Join(svcPath, "aerospike.conf")
+	if _, err := os.Stat(src_path); err != nil {
+		src_path = os.ExpandEnv(filepath.Join("$CONFIG_PATH", "aerospike.conf"))
+	}
 	dst_path := filepath.Join("aerospike-server", "etc", "aerospike.conf")
 
 	if _, err := os.Stat(src_path); err != nil {
@@ -371,7 +568,7 @@ func histogramField(c rune) bool {
 	return c == ',' || c == ';' || c == ':'
 }
 
-func statistics(conn net.Conn, stats map[string]interface{}) error {
+func statistics(conn net.Conn, stats *Stats) error {
 
 	var err error
 	var out string
@@ -398,18 +595,30 @@ func statistics(conn net.Conn, stats map[string]interface{}) error {
 		log.Printf("error: Invalid input: %s\n", err)
 	}
 
-	for k, fn := range statsMapper {
-		if fn == nil {
-			stats[k] = rawStats[k]
-		} else {
-			stats[k] = fn(k, rawStats)
+	names := []string{}
+	for k := range statsMapper {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		value := rawStats[k]
+		if fn := statsMapper[k]; fn != nil {
+			value = fn(k, rawStats)
 		}
+
+		metric := Metric{Name: k, Kind: Counter, Value: float64(value)}
+		if unit, gauge := statsGauges[k]; gauge {
+			metric.Kind = Gauge
+			metric.Unit = unit
+		}
+		stats.Add(metric)
 	}
 
 	return err
 }
 
-func processHistogramLatency(out []byte, iStart, iNameEnd, iHeadersEnd, iValuesEnd int, stats map[string]interface{}) error {
+func processHistogramLatency(out []byte, iStart, iNameEnd, iHeadersEnd, iValuesEnd int, stats *Stats) error {
 
 	name := string(out[iStart:iNameEnd])
 
@@ -419,28 +628,27 @@ func processHistogramLatency(out []byte, iStart, iNameEnd, iHeadersEnd, iValuesE
 	sValues := string(out[iHeadersEnd+1 : iValuesEnd])
 	values := strings.Split(sValues, ",")
 
+	// the first column is the time of the slice
 	for i, h := range headers {
-		prefix := "latency:" + name
-		switch i {
-		case 0:
-			stats[prefix+":start"] = h
-			stats[name+":end"] = values[i]
-		default:
-			switch h[0] {
-			case '<':
-				stats[prefix+":lt:"+h[1:]] = values[i]
-			case '>':
-				stats[prefix+":gt:"+h[1:]] = values[i]
-			default:
-				stats[prefix+":"+h] = values[i]
-			}
+		if i == 0 || i >= len(values) || h == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(values[i], 64)
+		if err != nil {
+			continue
+		}
+		switch {
+		case h == "ops/sec":
+			stats.Add(LatencyOps(name, value))
+		case h[0] == '>':
+			stats.Add(LatencyOver(name, h[1:], value))
 		}
 	}
 
 	return nil
 }
 
-func histogramLatency(conn net.Conn, stats map[string]interface{}) error {
+func histogramLatency(conn net.Conn, stats *Stats) error {
 
 	var err error
 	var out []byte
@@ -488,7 +696,7 @@ func histogramLatency(conn net.Conn, stats map[string]interface{}) error {
 	return err
 }
 
-func histogramObjectSize(conn net.Conn, stats map[string]interface{}) error {
+func histogramObjectSize(conn net.Conn, stats *Stats) error {
 
 	var err error
 	var out []byte
@@ -509,6 +717,8 @@ func histogramObjectSize(conn net.Conn, stats map[string]interface{}) error {
 	// 0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,
 	// 0,0,0,0;
 	//
+	// The number of buckets and their width, then the count of each bucket.
+	//
 
 	values := []int{}
 
@@ -538,15 +748,39 @@ func histogramObjectSize(conn net.Conn, stats map[string]interface{}) error {
 		}
 	}
 
-	stats["objects_sizes"] = values
+	if len(values) < 2 {
+		return err
+	}
+
+	// sizes are in 128 byte blocks
+	histogram := Metric{Name: "objects_sizes", Kind: Histogram, Unit: "rblocks"}
+	width := values[1]
+	for i, count := range values[2:] {
+		histogram.Value += float64(count)
+		histogram.Buckets = append(histogram.Buckets, Bucket{
+			UpperBound: float64((i + 1) * width),
+			Count:      histogram.Value,
+		})
+	}
+	stats.Add(histogram)
 
 	return err
 }
 
 func (svc *AerospikeService) Stats() (map[string]interface{}, error) {
 
+	stats, err := svc.StatsReport()
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+
+	return stats.Flat(), nil
+}
+
+func (svc *AerospikeService) StatsReport() (*Stats, error) {
+
 	var err error
-	stats := map[string]interface{}{}
+	stats := &Stats{}
 
 	conn, err := net.Dial("tcp", host)
 	if err != nil {
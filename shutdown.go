@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// time given to cancelled jobs to exit
+	shutdownGrace time.Duration = 5 * time.Second
+)
+
+// Shutdown stops a running minion gracefully.
+type Shutdown struct {
+	context *ServiceContext
+	events  *EventStream
+	servers []*http.Server
+	timeout time.Duration
+	once    sync.Once
+}
+
+// ----------------------------------------------------------------------------
+//
+// Shutdown Methods
+//
+// ----------------------------------------------------------------------------
+
+// Run the shutdown:
+//
+//  1. stop supervising, monitoring and collecting metrics of services
+//  2. stop accepting requests, and wait for those in flight
+//  3. wait for running jobs, cancelling them at the deadline
+//  4. stop the services with "stop_on_shutdown"
+//  5. stop notifying webhooks, queued notifications are delivered on the
+//     next start
+//
+// The deadline applies to the requests and jobs; stopping services has a
+// deadline of its own.
+func (self *Shutdown) Run() {
+	self.once.Do(func() {
+		log.Printf("info: shutting down\n")
+
+		self.context.Supervisor.Stop()
+		self.context.HealthMonitor.Stop()
+		self.context.Metrics.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), self.timeout)
+		defer cancel()
+
+		// event streams never go idle
+		self.events.Close()
+
+		for _, server := range self.servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("error: shutdown: %s: %s\n", server.Addr, err.Error())
+			}
+		}
+
+		if err := self.context.Jobs.drain(ctx, shutdownGrace); err != nil {
+			log.Printf("error: shutdown: jobs: %s\n", err.Error())
+		}
+
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), self.timeout)
+		defer stopCancel()
+		self.context.stopOnShutdown(stopCtx)
+		self.context.Webhooks.Stop()
+
+		log.Printf("info: shutdown complete\n")
+	})
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Shutdown Methods
+//
+// ----------------------------------------------------------------------------
+
+// stopOnShutdown stops the running services with "stop_on_shutdown", and
+// waits for them until `ctx` is done. The services are asked for their
+// status, the tracked one is unknown for those left running by a previous
+// minion.
+func (self *ServiceContext) stopOnShutdown(ctx context.Context) {
+
+	var jobId string
+	stopping := []string{}
+
+	for id, svc := range self.Registry.List() {
+		if stop := self.policy(svc).StopOnShutdown; stop == nil || !*stop {
+			continue
+		}
+		state := self.Registry.State(id).Status
+		if !transitional(state) {
+			detail, err := self.status(id)
+			if err != nil {
+				log.Printf("error: shutdown: %s: %s\n", id, err.Error())
+				continue
+			}
+			self.reconcile(id, detail)
+			state = detail.State
+		}
+		if state != service.Running && state != service.Degraded {
+			continue
+		}
+		log.Printf("info: stopping service on shutdown: %s\n", id)
+		if err := self.command(id, "stop", service.Stopping, &jobId, self.stop); err != nil {
+			log.Printf("error: shutdown: %s: %s\n", id, err.Error())
+			continue
+		}
+		stopping = append(stopping, jobId)
+	}
+
+	for _, jobId := range stopping {
+		job, exists := self.Jobs.get(jobId)
+		if !exists {
+			continue
+		}
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			log.Printf("error: shutdown: %s: %s\n", job.Info().Service, ctx.Err().Error())
+			job.Cancel()
+		}
+	}
+}
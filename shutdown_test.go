@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"context"
+	"testing"
+	"time"
+)
+
+// Services left running by a previous minion, of unknown tracked state,
+// are stopped on shutdown
+func TestStopOnShutdown(t *testing.T) {
+	ctx := newTestContext(t)
+	stop := true
+	ctx.SetConfig(&Config{Defaults: ServicePolicy{StopOnShutdown: &stop}})
+
+	for _, id := range []string{"running", "stopped"} {
+		installService(t, ctx, id, testService)
+	}
+	id := "running"
+	var jobId string
+	if err := ctx.Start(nil, &id, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, jobId)
+
+	// as found by the rescan of a restarted minion
+	ctx.Registry = NewRegistry()
+	if err := checkServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"running", "stopped"} {
+		ctx.Registry.Observe(id, service.StatusUnknown, "")
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx.stopOnShutdown(stopCtx)
+
+	for _, id := range []string{"running", "stopped"} {
+		if state := ctx.Registry.State(id).Status; state != service.Stopped {
+			t.Errorf("%s: %s", id, state)
+		}
+		detail, err := ctx.status(id)
+		if err != nil || detail.State != service.Stopped {
+			t.Errorf("%s: %v %v", id, detail, err)
+		}
+	}
+}
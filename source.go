@@ -0,0 +1,448 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	SourceGo    string = "go"
+	SourceFile  string = "file"
+	SourceHTTP  string = "http"
+	SourceHTTPS string = "https"
+)
+
+const (
+	// largest artifact, and binary extracted from it, unless configured
+	sourceMaxSize int64 = 512 << 20
+
+	// longest download, unless configured
+	sourceTimeout time.Duration = 10 * time.Minute
+)
+
+var (
+	ErrorUnsupportedSource  error = errors.New("Unsupported Service Source")
+	ErrorMissingBinary      error = errors.New("Missing Service Binary")
+	ErrorInvalidChecksum    error = errors.New("Invalid Checksum")
+	ErrorInvalidSignature   error = errors.New("Invalid Signature")
+	ErrorUnverifiableSource error = errors.New("Checksum And Signature Unsupported For Go Sources")
+	ErrorInsecureSource     error = errors.New("HTTP Sources Require A Checksum Or Signature")
+	ErrorArtifactTooLarge   error = errors.New("Artifact Too Large")
+)
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// parseSource splits a service URL into its scheme and location.
+// URLs without a scheme are Go import paths.
+func parseSource(serviceUrl string) (string, string) {
+	i := strings.Index(serviceUrl, "://")
+	if i < 0 {
+		return SourceGo, serviceUrl
+	}
+
+	scheme := serviceUrl[:i]
+	switch scheme {
+	case SourceGo, SourceFile:
+		return scheme, serviceUrl[i+3:]
+	default:
+		return scheme, serviceUrl
+	}
+}
+
+// checkSource checks the service URL is a supported source, which can be
+// verified as required: plain http artifacts must have a checksum or a
+// signature, and go sources can have neither.
+func checkSource(svc *ServiceInstall) error {
+
+	scheme, _ := parseSource(svc.URL)
+	verified := svc.Checksum != "" || svc.Signature != ""
+
+	switch scheme {
+	case SourceGo:
+		if verified {
+			return ErrorUnverifiableSource
+		}
+	case SourceHTTP:
+		if !verified {
+			return ErrorInsecureSource
+		}
+	case SourceFile, SourceHTTPS:
+	default:
+		return ErrorUnsupportedSource
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Source Methods
+//
+// ----------------------------------------------------------------------------
+
+// maxArtifactSize returns the configured limit of artifacts, in bytes
+func (self *ServiceContext) maxArtifactSize() int64 {
+	if config := self.currentConfig(); config != nil && config.Install.MaxSize > 0 {
+		return config.Install.MaxSize
+	}
+	return sourceMaxSize
+}
+
+// downloadTimeout returns the configured limit of downloads
+func (self *ServiceContext) downloadTimeout() time.Duration {
+	if config := self.currentConfig(); config != nil && config.Install.Timeout > 0 {
+		return time.Duration(config.Install.Timeout)
+	}
+	return sourceTimeout
+}
+
+// fetch the service binary for `svc` into `dstPath`/service.
+//
+//	go://<import path>   go get and go build, the previous behavior
+//	file://<path>        a service binary, or a directory containing one
+//	https://<url>        a tarball containing a service binary
+//	http://<url>         the same, with a checksum or signature
+//
+// Artifacts of file and http(s) sources are verified against svc.Checksum
+// and svc.Signature, when given. Artifacts, and the binary extracted from
+// them, are limited to the configured install.max_size.
+func (self *ServiceContext) fetch(job *Job, svc *ServiceInstall, dstPath string) error {
+
+	var err error = nil
+
+	if err = checkSource(svc); err != nil {
+		log.Printf("error: %s: %s\n", err.Error(), svc.URL)
+		return err
+	}
+
+	scheme, location := parseSource(svc.URL)
+	maxSize := self.maxArtifactSize()
+	binPath := filepath.Join(dstPath, "service")
+
+	switch scheme {
+	case SourceGo:
+		return self.fetchGo(job, svc, location, dstPath)
+
+	case SourceFile:
+		sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "copy"})
+		info, err := os.Stat(location)
+		if err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+		if info.IsDir() {
+			location = filepath.Join(location, "service")
+			info, err = os.Stat(location)
+			if err != nil {
+				log.Printf("error: %s\n", err.Error())
+				return err
+			}
+		}
+		if info.Size() > maxSize {
+			log.Printf("error: %s: %s\n", ErrorArtifactTooLarge.Error(), location)
+			return ErrorArtifactTooLarge
+		}
+		if err = verifyArtifact(svc, location, nil); err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+		if err = copyBinary(location, binPath, maxSize); err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+
+	case SourceHTTP, SourceHTTPS:
+		sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "download"})
+		tgz, err := ioutil.TempFile(dstPath, ".download-")
+		if err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+		defer os.Remove(tgz.Name())
+		sum, err := download(job, location, maxSize, self.downloadTimeout(), tgz)
+		if closeErr := tgz.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+		if err = verifyArtifact(svc, tgz.Name(), sum); err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+		sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "extract"})
+		if err = extractBinary(tgz.Name(), binPath, maxSize); err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return err
+		}
+
+	}
+
+	return err
+}
+
+// fetchGo downloads and builds a Go import path
+func (self *ServiceContext) fetchGo(job *Job, svc *ServiceInstall, importPath string, dstPath string) error {
+
+	var err error = nil
+
+	svcPath := filepath.Join(rootPath, "svc", svc.Id)
+	env := self.getenv(svc.Id, svc.URL)
+
+	// download the service
+	sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "download"})
+	get := exec.Command("go", "get", "-u", importPath)
+	log.Printf("info: executing: %s %s\n", get.Path, strings.Join(get.Args, " "))
+	get.Env = env
+	get.Dir = svcPath
+	getOut, err := job.execute(get)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	} else {
+		if len(getOut) > 0 {
+			log.Printf("info: out: %x\n", string(getOut))
+		}
+	}
+
+	sendEvent(self.SendEventMessage, "install", &InstallEvent{Id: svc.Id, Step: "build"})
+	build := exec.Command("go", "build", "-o", filepath.Join(dstPath, "service"), importPath)
+	log.Printf("info: executing: %s %s\n", build.Path, strings.Join(build.Args, " "))
+	build.Env = env
+	build.Dir = svcPath
+	buildOut, err := job.execute(build)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	} else {
+		if len(buildOut) > 0 {
+			log.Printf("info: out: %x\n", buildOut)
+		}
+	}
+
+	return err
+}
+
+// download the artifact at `url`, of at most `maxSize` bytes, into
+// `file`, returning its SHA-256. The download is cancelled with the job,
+// or after `timeout`.
+func download(job *Job, url string, maxSize int64, timeout time.Duration, file io.Writer) ([]byte, error) {
+
+	req, err := http.NewRequestWithContext(job.Context(), "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("info: downloading: %s\n", url)
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("download failed: " + res.Status)
+	}
+	if res.ContentLength > maxSize {
+		return nil, ErrorArtifactTooLarge
+	}
+
+	hash := sha256.New()
+	if err = copyLimited(io.MultiWriter(file, hash), res.Body, maxSize); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// extractBinary writes the "service" file of the (gzipped) tarball
+// `archive` to `binPath`, failing if it is larger than `maxSize` bytes
+func extractBinary(archive string, binPath string, maxSize int64) error {
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var tr io.Reader = r
+
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		tr = gzipReader
+	}
+
+	tarReader := tar.NewReader(tr)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == "service" {
+			if hdr.Size > maxSize {
+				return ErrorArtifactTooLarge
+			}
+			return writeBinary(binPath, tarReader, maxSize)
+		}
+	}
+
+	return ErrorMissingBinary
+}
+
+// copyBinary copies the binary at `src` to `binPath`
+func copyBinary(src string, binPath string, maxSize int64) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return writeBinary(binPath, file, maxSize)
+}
+
+// writeBinary writes `r` to the executable `binPath`
+func writeBinary(binPath string, r io.Reader, maxSize int64) error {
+	file, err := os.OpenFile(binPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	err = copyLimited(file, r, maxSize)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyLimited copies `r` to the end, failing if it holds more than
+// `maxSize` bytes
+func copyLimited(w io.Writer, r io.Reader, maxSize int64) error {
+	n, err := io.Copy(w, io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxSize {
+		return ErrorArtifactTooLarge
+	}
+	return nil
+}
+
+// verifyArtifact checks the artifact at `path` against svc.Checksum, a
+// hex SHA-256 optionally prefixed by "sha256:", and svc.Signature, a base64
+// Ed25519 signature by one of the keys in etc/keys/*.pub. `sum` is the
+// SHA-256 of the artifact, if already known.
+func verifyArtifact(svc *ServiceInstall, path string, sum []byte) error {
+
+	if svc.Checksum != "" {
+		expected, err := hex.DecodeString(strings.TrimPrefix(svc.Checksum, "sha256:"))
+		if err != nil {
+			return ErrorInvalidChecksum
+		}
+		if sum == nil {
+			if sum, err = fileSum(path); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(expected, sum) {
+			return ErrorInvalidChecksum
+		}
+	}
+
+	if svc.Signature != "" {
+		signature, err := base64.StdEncoding.DecodeString(svc.Signature)
+		if err != nil {
+			return ErrorInvalidSignature
+		}
+		keys, err := trustedKeys()
+		if err != nil {
+			return err
+		}
+
+		// Ed25519 signs the whole message, not a hash of it
+		artifact, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if ed25519.Verify(key, artifact, signature) {
+				return nil
+			}
+		}
+		return ErrorInvalidSignature
+	}
+
+	return nil
+}
+
+// fileSum returns the SHA-256 of a file
+func fileSum(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// trustedKeys loads the base64 Ed25519 public keys in etc/keys/*.pub
+func trustedKeys() ([]ed25519.PublicKey, error) {
+
+	files, err := filepath.Glob(filepath.Join(rootPath, "etc", "keys", "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []ed25519.PublicKey{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Printf("error: invalid key: %s\n", file)
+			continue
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+
+	return keys, nil
+}
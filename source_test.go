@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarball returns a gzipped tarball holding `binary` as "service"
+func tarball(t *testing.T, binary []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "pkg/service", Mode: 0755, Size: int64(len(binary)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(binary)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// serveArtifact serves `artifact`, chunked so its length is unknown
+func serveArtifact(t *testing.T, artifact []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(artifact); i += 512 {
+			end := i + 512
+			if end > len(artifact) {
+				end = len(artifact)
+			}
+			w.Write(artifact[i:end])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckSource(t *testing.T) {
+	tests := []struct {
+		svc ServiceInstall
+		err error
+	}{
+		{ServiceInstall{URL: "github.com/aerospike-labs/minion/services/aerospike"}, nil},
+		{ServiceInstall{URL: "github.com/aerospike-labs/minion/services/aerospike", Checksum: "00"}, ErrorUnverifiableSource},
+		{ServiceInstall{URL: "file:///opt/service"}, nil},
+		{ServiceInstall{URL: "https://example.com/service.tgz"}, nil},
+		{ServiceInstall{URL: "http://example.com/service.tgz"}, ErrorInsecureSource},
+		{ServiceInstall{URL: "http://example.com/service.tgz", Checksum: "00"}, nil},
+		{ServiceInstall{URL: "http://example.com/service.tgz", Signature: "AA=="}, nil},
+		{ServiceInstall{URL: "ftp://example.com/service.tgz"}, ErrorUnsupportedSource},
+	}
+
+	for _, test := range tests {
+		if err := checkSource(&test.svc); err != test.err {
+			t.Errorf("%s: %v, expected %v", test.svc.URL, err, test.err)
+		}
+	}
+}
+
+func TestInstallHTTP(t *testing.T) {
+	ctx := newTestContext(t)
+	artifact := tarball(t, []byte(testService))
+	server := serveArtifact(t, artifact)
+
+	// plain http requires a checksum
+	var jobId string
+	err := ctx.Install(nil, &ServiceInstall{Id: "svc", URL: server.URL + "/service.tgz"}, &jobId)
+	if err != ErrorInsecureSource {
+		t.Fatalf("install without checksum: %v", err)
+	}
+
+	// a wrong checksum fails the install
+	err = ctx.Install(nil, &ServiceInstall{Id: "svc", URL: server.URL + "/service.tgz", Checksum: checksum([]byte("other"))}, &jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.Error != ErrorInvalidChecksum.Error() {
+		t.Fatalf("install with wrong checksum: %s %s", info.State, info.Error)
+	}
+
+	err = ctx.Install(nil, &ServiceInstall{Id: "svc", URL: server.URL + "/service.tgz", Checksum: checksum(artifact)}, &jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+		t.Fatalf("install: %s %s", info.State, info.Error)
+	}
+	if !ctx.Registry.Exists("svc") {
+		t.Fatal("not installed")
+	}
+}
+
+func TestInstallMaxSize(t *testing.T) {
+	ctx := newTestContext(t)
+	artifact := tarball(t, bytes.Repeat([]byte("#"), 64*1024))
+	server := serveArtifact(t, artifact)
+
+	ctx.SetConfig(&Config{Install: InstallConfig{MaxSize: int64(len(artifact) - 1)}})
+
+	var jobId string
+	err := ctx.Install(nil, &ServiceInstall{Id: "svc", URL: server.URL + "/service.tgz", Checksum: checksum(artifact)}, &jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.Error != ErrorArtifactTooLarge.Error() {
+		t.Fatalf("install: %s %s", info.State, info.Error)
+	}
+}
+
+func TestExtractBinary(t *testing.T) {
+	binary := bytes.Repeat([]byte("#"), 4096)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "service.tgz")
+	if err := ioutil.WriteFile(archive, tarball(t, binary), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binPath := filepath.Join(dir, "service")
+	if err := extractBinary(archive, binPath, int64(len(binary))); err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	if extracted, err := ioutil.ReadFile(binPath); err != nil || !bytes.Equal(extracted, binary) {
+		t.Fatalf("extracted: %v", err)
+	}
+
+	// compressed, the archive is well under the limit
+	if err := extractBinary(archive, binPath, int64(len(binary)-1)); err != ErrorArtifactTooLarge {
+		t.Fatalf("extract over limit: %v", err)
+	}
+}
+
+// Downloads from a stalled server time out
+func TestInstallTimeout(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.SetConfig(&Config{Install: InstallConfig{Timeout: Duration(200 * time.Millisecond)}})
+
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	var jobId string
+	if err := ctx.Install(nil, &ServiceInstall{Id: "svc", URL: server.URL + "/service.tgz", Checksum: checksum([]byte("partial"))}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if info := waitJob(t, ctx, jobId); info.State != JobFailed || !strings.Contains(info.Error, "Timeout") {
+		t.Fatalf("install: %s %s", info.State, info.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("timed out after %s", elapsed)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+var (
+	ErrorCrashLoop  error = errors.New("Crash Loop Detected")
+	ErrorMaxRetries error = errors.New("Maximum Restart Retries Exceeded")
+)
+
+// Supervision of a service, declared in service.json.
+//
+// With "on-failure", minion restarts the service when it dies. With
+// "always", minion also starts it when found stopped, unless it was
+// stopped through minion. Durations are in seconds.
+type SupervisePolicy struct {
+	Restart           RestartPolicy `json:"restart"`
+	Interval          int           `json:"interval,omitempty"`
+	Backoff           int           `json:"backoff,omitempty"`
+	MaxBackoff        int           `json:"max_backoff,omitempty"`
+	MaxRetries        int           `json:"max_retries,omitempty"`
+	CrashLoopRestarts int           `json:"crash_loop_restarts,omitempty"`
+	CrashLoopWindow   int           `json:"crash_loop_window,omitempty"`
+}
+
+// Supervision status, as returned by Service.Status
+type SupervisorStatus struct {
+	Restart     RestartPolicy `json:"restart"`
+	Restarts    int           `json:"restarts"`
+	LastExit    string        `json:"last_exit,omitempty"`
+	LastRestart *time.Time    `json:"last_restart,omitempty"`
+	CrashLoop   bool          `json:"crash_loop"`
+	GaveUp      bool          `json:"gave_up"`
+}
+
+// Data of "restart" events
+type RestartEvent struct {
+	Id       string `json:"id"`
+	Restarts int    `json:"restarts"`
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"`
+}
+
+type supervision struct {
+	status  SupervisorStatus
+	checked time.Time
+	next    time.Time
+	backoff time.Duration
+	retries int
+	history []time.Time
+	held    bool
+}
+
+// Supervisor keeps supervised services running.
+type Supervisor struct {
+	context *ServiceContext
+	mutex   sync.Mutex
+	watches map[string]*supervision
+	done    chan struct{}
+}
+
+// ----------------------------------------------------------------------------
+//
+// SupervisePolicy Methods
+//
+// ----------------------------------------------------------------------------
+
+// withDefaults returns the policy with unset values defaulted
+func (self SupervisePolicy) withDefaults() SupervisePolicy {
+	if self.Restart == "" {
+		self.Restart = RestartNever
+	}
+	if self.Interval <= 0 {
+		self.Interval = 10
+	}
+	if self.Backoff <= 0 {
+		self.Backoff = 1
+	}
+	if self.MaxBackoff <= 0 {
+		self.MaxBackoff = 60
+	}
+	if self.MaxRetries <= 0 {
+		self.MaxRetries = 5
+	}
+	if self.CrashLoopRestarts <= 0 {
+		self.CrashLoopRestarts = 5
+	}
+	if self.CrashLoopWindow <= 0 {
+		self.CrashLoopWindow = 300
+	}
+	return self
+}
+
+// ----------------------------------------------------------------------------
+//
+// Supervisor Methods
+//
+// ----------------------------------------------------------------------------
+
+func NewSupervisor(context *ServiceContext) *Supervisor {
+	return &Supervisor{
+		context: context,
+		watches: map[string]*supervision{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Run the supervisor until Stop is called
+func (self *Supervisor) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case now := <-ticker.C:
+			for id, svc := range self.context.Registry.List() {
+				svc = self.context.policy(svc)
+				if svc.Supervise == nil {
+					continue
+				}
+				policy := svc.Supervise.withDefaults()
+				if policy.Restart == RestartNever {
+					continue
+				}
+				if self.due(id, policy, now) {
+					self.check(id, policy)
+				}
+			}
+		}
+	}
+}
+
+// Stop the supervisor
+func (self *Supervisor) Stop() {
+	close(self.done)
+}
+
+func (self *Supervisor) watch(serviceId string) *supervision {
+	w, exists := self.watches[serviceId]
+	if !exists {
+		w = &supervision{}
+		self.watches[serviceId] = w
+	}
+	return w
+}
+
+// due reports whether the service should be checked at `now`
+func (self *Supervisor) due(serviceId string, policy SupervisePolicy, now time.Time) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	w := self.watch(serviceId)
+	w.status.Restart = policy.Restart
+	if w.status.CrashLoop || w.status.GaveUp {
+		return false
+	}
+	if now.Sub(w.checked) < time.Duration(policy.Interval)*time.Second || now.Before(w.next) {
+		return false
+	}
+	w.checked = now
+	return true
+}
+
+// check the service, and restart it if the policy requires
+func (self *Supervisor) check(serviceId string, policy SupervisePolicy) {
+
+	// skip services with an operation in progress
+	if err := self.context.Registry.Acquire(serviceId, "supervise"); err != nil {
+		return
+	}
+	defer self.context.Registry.Release(serviceId)
+
+	tracked := self.context.Registry.State(serviceId)
+	if transitional(tracked.Status) {
+		return
+	}
+
+	detail, err := self.context.status(serviceId)
+	if err != nil {
+		log.Printf("error: supervise: %s: %s\n", serviceId, err.Error())
+		return
+	}
+	self.context.reconcile(serviceId, detail)
+
+	if !self.restartable(serviceId, policy, detail.State) {
+		return
+	}
+
+	reason := detail.LastError
+	if reason == "" {
+		reason = detail.State.String()
+	}
+	self.restart(serviceId, policy, reason)
+}
+
+// restartable reports whether the policy calls for a restart in `state`
+func (self *Supervisor) restartable(serviceId string, policy SupervisePolicy, state service.Status) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	w := self.watch(serviceId)
+
+	switch state {
+	case service.Running, service.Degraded:
+		// stable for a full window, forget earlier crashes
+		if w.status.LastRestart == nil || time.Since(*w.status.LastRestart) > time.Duration(policy.CrashLoopWindow)*time.Second {
+			w.backoff = 0
+			w.history = nil
+		}
+		return false
+	case service.Failed:
+		return policy.Restart == RestartOnFailure || policy.Restart == RestartAlways
+	case service.Stopped:
+		return policy.Restart == RestartAlways && !w.held
+	}
+	return false
+}
+
+// restart the service, applying backoff and crash-loop detection
+func (self *Supervisor) restart(serviceId string, policy SupervisePolicy, reason string) {
+
+	now := time.Now()
+	window := time.Duration(policy.CrashLoopWindow) * time.Second
+
+	self.mutex.Lock()
+	w := self.watch(serviceId)
+
+	history := []time.Time{}
+	for _, t := range w.history {
+		if now.Sub(t) < window {
+			history = append(history, t)
+		}
+	}
+	w.history = history
+
+	if len(w.history) >= policy.CrashLoopRestarts {
+		w.status.CrashLoop = true
+		self.mutex.Unlock()
+		log.Printf("error: supervise: %s: %s\n", serviceId, ErrorCrashLoop.Error())
+		self.context.Registry.Observe(serviceId, service.Failed, ErrorCrashLoop.Error())
+		self.context.emitError(serviceId, "supervise", ErrorCrashLoop)
+		return
+	}
+
+	w.history = append(w.history, now)
+	w.status.Restarts++
+	w.status.LastExit = reason
+	w.status.LastRestart = &now
+	restarts := w.status.Restarts
+	self.mutex.Unlock()
+
+	log.Printf("info: supervise: restarting %s (%d): %s\n", serviceId, restarts, reason)
+
+	err := self.context.transition(serviceId, service.Starting, "")
+	if err == nil {
+		err = self.context.start(nil, serviceId)
+	}
+
+	event := &RestartEvent{Id: serviceId, Restarts: restarts, Reason: reason}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	sendEvent(self.context.SendEventMessage, "restart", event)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// exponential backoff between restarts
+	if w.backoff == 0 {
+		w.backoff = time.Duration(policy.Backoff) * time.Second
+	} else {
+		w.backoff *= 2
+	}
+	if max := time.Duration(policy.MaxBackoff) * time.Second; w.backoff > max {
+		w.backoff = max
+	}
+	w.next = time.Now().Add(w.backoff)
+
+	if err == nil {
+		w.retries = 0
+		return
+	}
+
+	w.retries++
+	if w.retries >= policy.MaxRetries {
+		w.status.GaveUp = true
+		log.Printf("error: supervise: %s: %s\n", serviceId, ErrorMaxRetries.Error())
+		self.context.emitError(serviceId, "supervise", ErrorMaxRetries)
+	}
+}
+
+// hold stops restarting a service stopped through minion
+func (self *Supervisor) hold(serviceId string) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.watch(serviceId).held = true
+}
+
+// resume supervision of a service started through minion
+func (self *Supervisor) resume(serviceId string) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	w := self.watch(serviceId)
+	w.held = false
+	w.retries = 0
+	w.backoff = 0
+	w.next = time.Time{}
+	w.history = nil
+	w.status.CrashLoop = false
+	w.status.GaveUp = false
+}
+
+// forget a removed service
+func (self *Supervisor) forget(serviceId string) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.watches, serviceId)
+}
+
+// status of the supervision of a service, nil if not supervised
+func (self *Supervisor) status(serviceId string) *SupervisorStatus {
+	if self == nil {
+		return nil
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	w, exists := self.watches[serviceId]
+	if !exists {
+		return nil
+	}
+	status := w.status
+	return &status
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a service which reports itself failed unless running, and fails to
+// start while the "fail_start" file exists
+const crashingService = `#!/bin/sh
+cd "$SERVICE_PATH"
+case "$1" in
+status)
+	if [ -f running ]; then echo '{"state":"running"}'; else echo '{"state":"failed"}'; fi ;;
+start)
+	[ -f fail_start ] && exit 1
+	touch running ;;
+stop) rm -f running ;;
+esac
+exit 0
+`
+
+// supervised returns a copy of the supervision of a service
+func supervised(ctx *ServiceContext, serviceId string) supervision {
+	ctx.Supervisor.mutex.Lock()
+	defer ctx.Supervisor.mutex.Unlock()
+	return *ctx.Supervisor.watch(serviceId)
+}
+
+// touch creates, or with `remove` removes, a file of the test service
+func touch(t *testing.T, name string, remove bool) {
+	t.Helper()
+
+	file := filepath.Join(rootPath, "svc", "svc", name)
+	if remove {
+		os.Remove(file)
+		return
+	}
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Failed restarts back off exponentially, up to MaxBackoff, and stop
+// after MaxRetries
+func TestSupervisorBackoff(t *testing.T) {
+	ctx := newTestContext(t)
+	installService(t, ctx, "svc", crashingService)
+	touch(t, "fail_start", false)
+
+	policy := SupervisePolicy{Restart: RestartOnFailure, Backoff: 1, MaxBackoff: 2, MaxRetries: 3, CrashLoopRestarts: 10}.withDefaults()
+
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second, 2 * time.Second} {
+		now := time.Now()
+		ctx.Supervisor.check("svc", policy)
+
+		w := supervised(ctx, "svc")
+		if w.status.Restarts != i+1 || w.retries != i+1 || w.backoff != backoff {
+			t.Fatalf("restart %d: %+v", i, w)
+		}
+		if w.next.Before(now.Add(backoff)) {
+			t.Fatalf("restart %d: next in %s", i, w.next.Sub(now))
+		}
+		later := now.Add(time.Duration(i+1) * time.Hour)
+		if ctx.Supervisor.due("svc", policy, later) != (i < 2) {
+			t.Fatalf("restart %d: due", i)
+		}
+		if ctx.Supervisor.due("svc", policy, later) {
+			t.Fatalf("restart %d: due within the interval", i)
+		}
+	}
+
+	if w := supervised(ctx, "svc"); !w.status.GaveUp {
+		t.Fatalf("did not give up: %+v", w.status)
+	}
+	if state := ctx.Registry.State("svc").Status; state != service.Failed {
+		t.Fatalf("state: %s", state)
+	}
+
+	// a start through minion supervises the service again
+	touch(t, "fail_start", true)
+	ctx.Supervisor.resume("svc")
+	ctx.Supervisor.check("svc", policy)
+	if w := supervised(ctx, "svc"); w.status.GaveUp || w.retries != 0 || w.status.Restarts != 4 {
+		t.Fatalf("after resume: %+v", w)
+	}
+	if state := ctx.Registry.State("svc").Status; state != service.Running {
+		t.Fatalf("state: %s", state)
+	}
+}
+
+// Services crashing CrashLoopRestarts times within the window are left
+// failed
+func TestSupervisorCrashLoop(t *testing.T) {
+	ctx := newTestContext(t)
+	installService(t, ctx, "svc", crashingService)
+
+	policy := SupervisePolicy{Restart: RestartOnFailure, CrashLoopRestarts: 2}.withDefaults()
+
+	for i := 0; i < 3; i++ {
+		touch(t, "running", true)
+		ctx.Supervisor.check("svc", policy)
+	}
+
+	w := supervised(ctx, "svc")
+	if !w.status.CrashLoop || w.status.Restarts != 2 {
+		t.Fatalf("crash loop: %+v", w.status)
+	}
+	if state := ctx.Registry.State("svc").Status; state != service.Failed {
+		t.Fatalf("state: %s", state)
+	}
+	if ctx.Supervisor.due("svc", policy, time.Now().Add(time.Hour)) {
+		t.Fatal("crash loop: due")
+	}
+}
+
+// Services stopped through minion are not restarted by "always", until
+// started through minion again
+func TestSupervisorHold(t *testing.T) {
+	ctx := newTestContext(t)
+	installService(t, ctx, "svc", testService)
+	id := "svc"
+
+	policy := SupervisePolicy{Restart: RestartAlways}.withDefaults()
+
+	ctx.Supervisor.check(id, policy)
+	if state := ctx.Registry.State(id).Status; state != service.Running {
+		t.Fatalf("always: %s", state)
+	}
+
+	var jobId string
+	if err := ctx.Stop(nil, &id, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, jobId)
+	ctx.Supervisor.check(id, policy)
+	if state := ctx.Registry.State(id).Status; state != service.Stopped {
+		t.Fatalf("held: %s", state)
+	}
+
+	if err := ctx.Start(nil, &id, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, jobId)
+
+	// stopped behind minion's back
+	touch(t, "running", true)
+	ctx.Supervisor.check(id, policy)
+	if w := supervised(ctx, id); w.held || w.status.Restarts != 2 {
+		t.Fatalf("resumed: %+v", w)
+	}
+	if state := ctx.Registry.State(id).Status; state != service.Running {
+		t.Fatalf("resumed: %s", state)
+	}
+}
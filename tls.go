@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+var (
+	ErrorInvalidClientCA error = errors.New("Invalid Client CA Certificates")
+)
+
+// Certificates of the TLS listener, reloadable while serving.
+type CertStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// ----------------------------------------------------------------------------
+//
+// CertStore Methods
+//
+// ----------------------------------------------------------------------------
+
+// LoadCertStore loads the certificate and key, and the client CA bundle
+// if `caFile` is set.
+func LoadCertStore(certFile string, keyFile string, caFile string) (*CertStore, error) {
+	store := &CertStore{}
+	if err := store.Replace(certFile, keyFile, caFile); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Replace the files the certificates are loaded from, and load them.
+// On error, the current files and certificates are kept.
+func (self *CertStore) Replace(certFile string, keyFile string, caFile string) error {
+
+	cert, clientCAs, err := loadCerts(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	self.certFile = certFile
+	self.keyFile = keyFile
+	self.caFile = caFile
+	self.cert = cert
+	self.clientCAs = clientCAs
+	self.mutex.Unlock()
+
+	log.Printf("info: loaded tls certificate: %s\n", certFile)
+	return nil
+}
+
+// Config returns a TLS config serving the current certificates.
+//
+// Client certificates are verified against the client CAs when presented;
+// whether one is required is left to the "cert" authentication mode.
+func (self *CertStore) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			self.mutex.RLock()
+			defer self.mutex.RUnlock()
+			return self.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			self.mutex.RLock()
+			defer self.mutex.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*self.cert},
+			}
+			if self.clientCAs != nil {
+				config.ClientCAs = self.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// loadCerts loads the certificate and key, and the client CA bundle if
+// `caFile` is set.
+func loadCerts(certFile string, keyFile string, caFile string) (*tls.Certificate, *x509.CertPool, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var clientCAs *x509.CertPool = nil
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, ErrorInvalidClientCA
+		}
+	}
+
+	return &cert, clientCAs, nil
+}
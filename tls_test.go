@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A certificate, and its key, written as PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+var testSerial int64 = 0
+
+// newCert creates a certificate for `name`, signed by `ca`, or self-signed
+// as a CA if `ca` is nil
+func newCert(t *testing.T, dir string, name string, ca *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, fmt.Sprintf("%s-%d.crt", name, testSerial)),
+		keyFile:  filepath.Join(dir, fmt.Sprintf("%s-%d.key", name, testSerial)),
+	}
+	ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+// tlsClient returns a client trusting `ca`, presenting `cert` if not nil,
+// whether or not the server accepts its issuer
+func tlsClient(ca *testCert, cert *testCert) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{
+				Certificate: [][]byte{cert.cert.Raw},
+				PrivateKey:  cert.key,
+			}, nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// rpcCall posts a JSON-RPC call, returning the status and the body
+func rpcCall(t *testing.T, client *http.Client, url string, method string) (int, string) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"method":%q,"params":[{}],"id":1}`, method)
+	res, err := client.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	out, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, strings.TrimSpace(string(out))
+}
+
+func TestTLSClientCerts(t *testing.T) {
+	setTestRoot(t)
+	dir := t.TempDir()
+
+	ca := newCert(t, dir, "ca", nil)
+	serverCert := newCert(t, dir, "minion", ca)
+	ops := newCert(t, dir, "ops", ca)
+	viewer := newCert(t, dir, "viewer", ca)
+	stranger := newCert(t, dir, "stranger", ca)
+	untrusted := newCert(t, dir, "ops", newCert(t, dir, "other-ca", nil))
+
+	writeEtc(t, "certs.roles", "ops admin\nviewer reader\n")
+	auth, err := LoadAuth([]string{AuthCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadCertStore(serverCert.certFile, serverCert.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler answers with the authenticated user
+	user := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.URL.User.Username())
+	})
+	server := httptest.NewUnstartedServer(auth.Handler(ioutil.Discard, user, true))
+	server.TLS = store.Config()
+	server.StartTLS()
+	defer server.Close()
+	url := server.URL + "/rpc"
+
+	tests := []struct {
+		cert   *testCert
+		method string
+		status int
+		user   string
+	}{
+		// certificates are optional for the handshake, not for auth
+		{nil, "Service.List", http.StatusUnauthorized, ""},
+		{ops, "Service.Install", http.StatusOK, "ops"},
+		{viewer, "Service.List", http.StatusOK, "viewer"},
+		{viewer, "Service.Install", http.StatusForbidden, ""},
+		{stranger, "Service.List", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		name := "none"
+		if test.cert != nil {
+			name = test.cert.cert.Subject.CommonName
+		}
+		status, body := rpcCall(t, tlsClient(ca, test.cert), url, test.method)
+		if status != test.status || (status == http.StatusOK && body != test.user) {
+			t.Errorf("%s %s: %d %q, expected %d %q", name, test.method, status, body, test.status, test.user)
+		}
+	}
+
+	// certificates of other CAs fail the handshake
+	body := strings.NewReader(`{"method":"Service.List","params":[{}],"id":1}`)
+	if _, err := tlsClient(ca, untrusted).Post(url, "application/json", body); err == nil {
+		t.Error("untrusted certificate accepted")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+
+	ca := newCert(t, dir, "ca", nil)
+	first := newCert(t, dir, "minion", ca)
+	second := newCert(t, dir, "minion", ca)
+
+	writeConfig := func(cert *testCert) {
+		writeEtc(t, "minion.json", fmt.Sprintf(`{"tls": {"cert": %q, "key": %q, "client_ca": %q}}`, cert.certFile, cert.keyFile, ca.certFile))
+	}
+	writeConfig(first)
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadAuth(config.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadCertStore(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := &Reloader{context: ctx, auth: auth, certStore: store}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = store.Config()
+	server.StartTLS()
+	defer server.Close()
+
+	// the serial of the certificate served to a new connection
+	served := func() int64 {
+		client := tlsClient(ca, nil)
+		defer client.CloseIdleConnections()
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := served(); serial != first.cert.SerialNumber.Int64() {
+		t.Fatalf("served %d, expected %d", serial, first.cert.SerialNumber.Int64())
+	}
+
+	writeConfig(second)
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serial := served(); serial != second.cert.SerialNumber.Int64() {
+		t.Fatalf("served %d after reload, expected %d", serial, second.cert.SerialNumber.Int64())
+	}
+
+	// a broken certificate keeps the current one
+	writeEtc(t, "broken.crt", "not a certificate")
+	writeEtc(t, "minion.json", fmt.Sprintf(`{"tls": {"cert": %q, "key": %q}}`, filepath.Join(rootPath, "etc", "broken.crt"), second.keyFile))
+	if err = reloader.Reload(); err == nil {
+		t.Fatal("reloaded a broken certificate")
+	}
+	if serial := served(); serial != second.cert.SerialNumber.Int64() {
+		t.Fatalf("served %d after failed reload, expected %d", serial, second.cert.SerialNumber.Int64())
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+const (
+	// number of previous versions kept under svc/<id>/versions
+	upgradeKeep int = 3
+
+	// interval between health checks of an upgraded service, until it is
+	// healthy or its start period is over
+	upgradeHealthPoll time.Duration = 2 * time.Second
+)
+
+// Arguments for Service.Upgrade.
+// An empty URL upgrades from the installed URL. Params, if given, replace
+// the installed params and are passed to the "upgrade" command.
+type ServiceUpgrade struct {
+	Id        string                 `json:"id"`
+	URL       string                 `json:"url"`
+	Checksum  string                 `json:"checksum,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// ServiceContext Upgrade Methods
+//
+// ----------------------------------------------------------------------------
+
+// Upgrade a Service
+//
+// The new version is built into a staging directory, then swapped in for
+// the running one. If the "upgrade" command, the start or the health check
+// fails, the previous version is restored. The upgrade runs as a job,
+// `res` is set to the job id.
+func (self *ServiceContext) Upgrade(req *http.Request, args *ServiceUpgrade, res *string) error {
+
+	var err error = nil
+
+	if err = self.Registry.Acquire(args.Id, "upgrade"); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+
+	svc, exists := self.Registry.Get(args.Id)
+	if !exists {
+		self.Registry.Release(args.Id)
+		return service.NotFound
+	}
+
+	if tracked := self.Registry.State(args.Id); transitional(tracked.Status) {
+		self.Registry.Release(args.Id)
+		return &TransitionError{Id: args.Id, From: tracked.Status, To: service.Stopping}
+	}
+
+	upgraded := *svc
+	if args.URL != "" {
+		upgraded.URL = args.URL
+	}
+	upgraded.Checksum = args.Checksum
+	upgraded.Signature = args.Signature
+	if args.Params != nil {
+		upgraded.Params = args.Params
+	}
+	if err = checkSource(&upgraded); err != nil {
+		self.Registry.Release(args.Id)
+		log.Printf("error: %s: %s\n", err.Error(), upgraded.URL)
+		return err
+	}
+
+	job := self.Jobs.start(svc.Id, "upgrade", func(job *Job) error {
+		defer self.Registry.Release(svc.Id)
+		err := self.upgrade(job, svc, &upgraded)
+		if err != nil {
+			self.emitError(svc.Id, "upgrade", err)
+		}
+		return err
+	})
+
+	*res = job.Id()
+	return nil
+}
+
+func (self *ServiceContext) upgrade(job *Job, svc *ServiceInstall, upgraded *ServiceInstall) error {
+
+	var err error = nil
+
+	svcPath := filepath.Join(rootPath, "svc", svc.Id)
+	stagingPath := filepath.Join(svcPath, "staging")
+	versionPath := filepath.Join(svcPath, "versions", time.Now().UTC().Format("20060102T150405.000000000Z"))
+
+	// build the new version
+	os.RemoveAll(stagingPath)
+	if err = os.MkdirAll(stagingPath, 0755); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+	defer os.RemoveAll(stagingPath)
+
+	sendEvent(self.SendEventMessage, "upgrade", &InstallEvent{Id: svc.Id, Step: "fetch"})
+	if err = self.fetch(job, upgraded, stagingPath); err != nil {
+		return err
+	}
+
+	// stop the running instance
+	tracked := self.Registry.State(svc.Id)
+	running := tracked.Status == service.Running || tracked.Status == service.Degraded
+
+	if running {
+		sendEvent(self.SendEventMessage, "upgrade", &InstallEvent{Id: svc.Id, Step: "stop"})
+		if err = self.transition(svc.Id, service.Stopping, ""); err != nil {
+			return err
+		}
+		if err = self.stop(job, svc.Id); err != nil {
+			return err
+		}
+	}
+
+	// keep the previous version, and swap in the new one
+	sendEvent(self.SendEventMessage, "upgrade", &InstallEvent{Id: svc.Id, Step: "swap"})
+	if err = os.MkdirAll(filepath.Dir(versionPath), 0755); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+	if err = os.Mkdir(versionPath, 0755); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return err
+	}
+	if err = copyFile(filepath.Join(svcPath, "service.json"), filepath.Join(versionPath, "service.json")); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		os.RemoveAll(versionPath)
+		return err
+	}
+
+	// the binary is kept before the new one replaces it, so there always
+	// is one in place
+	if err = linkFile(filepath.Join(svcPath, "service"), filepath.Join(versionPath, "service")); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		os.RemoveAll(versionPath)
+		return err
+	}
+	if err = os.Rename(filepath.Join(stagingPath, "service"), filepath.Join(svcPath, "service")); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		os.RemoveAll(versionPath)
+		return err
+	}
+
+	// run "upgrade", start, and check health; roll back on failure
+	if err = self.activate(job, upgraded, running); err != nil {
+		log.Printf("error: upgrade: %s: rolling back: %s\n", svc.Id, err.Error())
+		sendEvent(self.SendEventMessage, "upgrade", &InstallEvent{Id: svc.Id, Step: "rollback"})
+		if rerr := self.rollback(job, svc, versionPath, running); rerr != nil {
+			log.Printf("error: rollback: %s\n", rerr.Error())
+			return fmt.Errorf("upgrade failed: %s, rollback failed: %s", err.Error(), rerr.Error())
+		}
+		return fmt.Errorf("upgrade failed, rolled back: %s", err.Error())
+	}
+
+	self.Registry.Put(upgraded)
+	if err = self.save(upgraded); err != nil {
+		return err
+	}
+
+	pruneVersions(filepath.Join(svcPath, "versions"), upgradeKeep)
+
+	sendEvent(self.SendEventMessage, "upgrade", &InstallEvent{Id: svc.Id, Step: "complete"})
+	return nil
+}
+
+// activate the swapped in version
+func (self *ServiceContext) activate(job *Job, svc *ServiceInstall, start bool) error {
+
+	var err error = nil
+
+	// services without an "upgrade" command have nothing to migrate
+	if err = self.run(job, svc.Id, "upgrade", svc.Params, nil); err != nil && !unsupported(err) {
+		return err
+	}
+
+	if !start {
+		return nil
+	}
+
+	sendEvent(self.SendEventMessage, "upgrade", &InstallEvent{Id: svc.Id, Step: "start"})
+	if err = self.transition(svc.Id, service.Starting, ""); err != nil {
+		return err
+	}
+	if err = self.start(job, svc.Id); err != nil {
+		return err
+	}
+
+	if health := self.policy(svc).Health; health != nil {
+		return self.awaitHealthy(job, svc.Id, health.withDefaults())
+	}
+
+	return nil
+}
+
+// awaitHealthy checks the health of a started service until it is healthy,
+// failing once the start period of its health config is over
+func (self *ServiceContext) awaitHealthy(job *Job, serviceId string, config HealthConfig) error {
+
+	deadline := time.Now().Add(time.Duration(config.StartPeriod) * time.Second)
+
+	for {
+		self.HealthMonitor.check(serviceId, config)
+		status := self.HealthMonitor.report(serviceId).Status
+		if status == HealthHealthy {
+			return nil
+		}
+		if time.Now().Add(upgradeHealthPoll).After(deadline) {
+			return fmt.Errorf("health check %s", status)
+		}
+
+		select {
+		case <-job.Context().Done():
+			return ErrorJobCancelled
+		case <-time.After(upgradeHealthPoll):
+		}
+	}
+}
+
+// rollback to the version kept in `versionPath`
+func (self *ServiceContext) rollback(job *Job, svc *ServiceInstall, versionPath string, start bool) error {
+
+	var err error = nil
+
+	svcPath := filepath.Join(rootPath, "svc", svc.Id)
+
+	if state := self.Registry.State(svc.Id).Status; state == service.Running || state == service.Degraded {
+		if err = self.transition(svc.Id, service.Stopping, ""); err == nil {
+			self.stop(job, svc.Id)
+		}
+	}
+
+	if err = os.Rename(filepath.Join(versionPath, "service"), filepath.Join(svcPath, "service")); err != nil {
+		return err
+	}
+	if err = copyFile(filepath.Join(versionPath, "service.json"), filepath.Join(svcPath, "service.json")); err != nil {
+		return err
+	}
+	os.RemoveAll(versionPath)
+
+	if !start {
+		return nil
+	}
+
+	if err = self.transition(svc.Id, service.Starting, ""); err != nil {
+		return err
+	}
+	return self.start(job, svc.Id)
+}
+
+// pruneVersions keeps the `keep` most recent versions
+func pruneVersions(versionsPath string, keep int) {
+
+	entries, err := ioutil.ReadDir(versionsPath)
+	if err != nil {
+		return
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > keep {
+		log.Printf("info: removing version: %s\n", names[0])
+		os.RemoveAll(filepath.Join(versionsPath, names[0]))
+		names = names[1:]
+	}
+}
+
+// linkFile hard links `src` to `dst`, or copies it if it cannot be linked
+func linkFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0755)
+}
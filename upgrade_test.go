@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// versionService returns the test service marked as `version`, running
+// `commands` before the others
+func versionService(version string, commands string) string {
+	script := strings.Replace(testService, "case \"$1\" in\nstatus)", "case \"$1\" in\n"+commands+"status)", 1)
+	return script + "# " + version + "\n"
+}
+
+// startUpgradable installs and starts version 1 of the test service
+func startUpgradable(t *testing.T, ctx *ServiceContext, health *HealthConfig) {
+	t.Helper()
+
+	var jobId string
+	svc := &ServiceInstall{Id: "svc", URL: writeService(t, versionService("v1", "health)\n\techo '{\"healthy\":true}'\n\texit 0 ;;\n")), Health: health}
+	if err := ctx.Install(nil, svc, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, jobId)
+
+	id := "svc"
+	if err := ctx.Start(nil, &id, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitJob(t, ctx, jobId); info.State != JobSucceeded {
+		t.Fatalf("start: %s %s", info.State, info.Error)
+	}
+}
+
+// installedVersion returns the version of the installed binary
+func installedVersion(t *testing.T) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, "svc", "svc", "service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	return strings.TrimPrefix(lines[len(lines)-1], "# ")
+}
+
+// versions returns the versions kept of the service
+func versions(t *testing.T) []string {
+	t.Helper()
+
+	entries, _ := ioutil.ReadDir(filepath.Join(rootPath, "svc", "svc", "versions"))
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// upgradeTo upgrades the service to `script`, returning the job
+func upgradeTo(t *testing.T, ctx *ServiceContext, script string) JobInfo {
+	t.Helper()
+
+	var jobId string
+	if err := ctx.Upgrade(nil, &ServiceUpgrade{Id: "svc", URL: writeService(t, script)}, &jobId); err != nil {
+		t.Fatal(err)
+	}
+	return waitJob(t, ctx, jobId)
+}
+
+// Upgrades which fail to run "upgrade", to start, or to become healthy
+// restore the previous version, running
+func TestUpgradeRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands string
+		err      string
+	}{
+		{"upgrade", "upgrade)\n\texit 1 ;;\n", "exit status 1"},
+		{"start", "start)\n\texit 1 ;;\n", "exit status 1"},
+		{"health", "health)\n\techo '{\"healthy\":false}'\n\texit 0 ;;\n", "health check " + HealthUnhealthy},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestContext(t)
+			startUpgradable(t, ctx, &HealthConfig{StartPeriod: 1})
+
+			info := upgradeTo(t, ctx, versionService("v2", test.commands))
+			if info.State != JobFailed || !strings.Contains(info.Error, "rolled back: "+test.err) {
+				t.Fatalf("upgrade: %s %s", info.State, info.Error)
+			}
+
+			if version := installedVersion(t); version != "v1" {
+				t.Fatalf("rolled back to %s", version)
+			}
+			if state := ctx.Registry.State("svc").Status; state != service.Running {
+				t.Fatalf("rolled back: %s", state)
+			}
+			if kept := versions(t); len(kept) != 0 {
+				t.Fatalf("versions: %v", kept)
+			}
+			if _, err := os.Stat(filepath.Join(rootPath, "svc", "svc", "staging")); !os.IsNotExist(err) {
+				t.Fatalf("staging: %v", err)
+			}
+		})
+	}
+}
+
+// Successful upgrades keep the upgradeKeep previous versions
+func TestUpgradePrune(t *testing.T) {
+	ctx := newTestContext(t)
+	startUpgradable(t, ctx, nil)
+
+	for i := 2; i <= upgradeKeep+2; i++ {
+		version := "v" + strconv.Itoa(i)
+		if info := upgradeTo(t, ctx, versionService(version, "")); info.State != JobSucceeded {
+			t.Fatalf("upgrade to %s: %s %s", version, info.State, info.Error)
+		}
+		if installed := installedVersion(t); installed != version {
+			t.Fatalf("upgraded to %s, expected %s", installed, version)
+		}
+	}
+
+	kept := versions(t)
+	if len(kept) != upgradeKeep {
+		t.Fatalf("versions: %v", kept)
+	}
+
+	// the oldest kept is the version before the last pruned one
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, "svc", "svc", "versions", kept[0], "service"))
+	if err != nil || !strings.HasSuffix(string(data), "# v2\n") {
+		t.Fatalf("oldest version: %v %q", err, data)
+	}
+	if state := ctx.Registry.State("svc").Status; state != service.Running {
+		t.Fatalf("upgraded: %s", state)
+	}
+}
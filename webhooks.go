@@ -0,0 +1,551 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+//
+// Types
+//
+// ----------------------------------------------------------------------------
+
+// Events notified to webhooks
+const (
+	WebhookInstall string = "install"
+	WebhookRemove  string = "remove"
+	WebhookStart   string = "start"
+	WebhookStop    string = "stop"
+	WebhookFailure string = "failure"
+	WebhookCancel  string = "cancel"
+	WebhookAlert   string = "alert"
+)
+
+const (
+	// interval between checks of the queue for due deliveries
+	webhookPoll time.Duration = time.Second
+
+	// timeout of each attempt
+	webhookTimeout time.Duration = 10 * time.Second
+
+	// attempts of a delivery before it is dropped, and the backoff before
+	// the first retry, doubled on each retry
+	webhookAttempts   int           = 10
+	webhookBackoff    time.Duration = 5 * time.Second
+	webhookBackoffMax time.Duration = 30 * time.Minute
+)
+
+var (
+	ErrorInvalidWebhook error = errors.New("Invalid Webhook")
+)
+
+var webhookEvents = []string{
+	WebhookInstall,
+	WebhookRemove,
+	WebhookStart,
+	WebhookStop,
+	WebhookFailure,
+	WebhookCancel,
+	WebhookAlert,
+}
+
+// A webhook, in the "webhooks" of the configuration. The events listed,
+// or all events, of the services listed, or of all services, are posted
+// to the URL.
+//
+// With a secret, the X-Minion-Signature header of each request is the
+// hex HMAC-SHA256 of its body.
+type WebhookConfig struct {
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret,omitempty"`
+	Events   []string `json:"events,omitempty"`
+	Services []string `json:"services,omitempty"`
+}
+
+// Payload posted to webhooks. Id identifies the delivery, and is the same
+// for each attempt. Data is that of the event notified: the "install",
+// "lifecycle", "error", "job" or "alert" event.
+type WebhookPayload struct {
+	Id      string          `json:"id"`
+	Event   string          `json:"event"`
+	Service string          `json:"service"`
+	Host    string          `json:"host"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Webhooks posts notifications of events to the configured webhooks.
+//
+// Deliveries are queued on disk, under var/webhooks/, until they succeed,
+// so notifications survive restarts; a delivery may be posted more than
+// once. Deliveries to a URL are posted in order, one at a time. Failed
+// attempts are retried with exponential backoff, unless the webhook
+// answered with a client error.
+type Webhooks struct {
+	context *ServiceContext
+	path    string
+	host    string
+	client  *http.Client
+	mutex   sync.Mutex
+	queue   []*webhookDelivery
+	sending map[string]bool
+	last    int64
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// A queued delivery, as a file of the queue
+type webhookDelivery struct {
+	Id       string          `json:"id"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Due      time.Time       `json:"due"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// ----------------------------------------------------------------------------
+//
+// WebhookConfig Methods
+//
+// ----------------------------------------------------------------------------
+
+func (self *WebhookConfig) validate() error {
+
+	u, err := url.Parse(self.URL)
+	if err != nil {
+		return fmt.Errorf("%s: %s", ErrorInvalidWebhook.Error(), err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: %s", ErrorInvalidWebhook.Error(), self.URL)
+	}
+
+	for _, event := range self.Events {
+		if !contains(webhookEvents, event) {
+			return fmt.Errorf("%s: %s: unknown event: %s", ErrorInvalidWebhook.Error(), self.URL, event)
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether the webhook is notified of `event` of a service
+func (self *WebhookConfig) matches(event string, serviceId string) bool {
+	if len(self.Events) > 0 && !contains(self.Events, event) {
+		return false
+	}
+	if len(self.Services) > 0 && !contains(self.Services, serviceId) {
+		return false
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------
+//
+// Webhooks Methods
+//
+// ----------------------------------------------------------------------------
+
+// NewWebhooks returns the webhooks, with the deliveries queued in `path`
+func NewWebhooks(context *ServiceContext, path string) *Webhooks {
+	host, _ := os.Hostname()
+
+	self := &Webhooks{
+		context: context,
+		path:    path,
+		host:    host,
+		client:  &http.Client{Timeout: webhookTimeout},
+		sending: map[string]bool{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	self.load()
+	return self
+}
+
+// Forward returns `send`, also notifying the webhooks of the events sent
+func (self *Webhooks) Forward(send func(data, event, id string)) func(data, event, id string) {
+	return func(data, event, id string) {
+		send(data, event, id)
+		self.notify(event, data)
+	}
+}
+
+// Run delivers the queued notifications, until stopped
+func (self *Webhooks) Run() {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-self.wake:
+		case <-ticker.C:
+		}
+		self.dispatch()
+	}
+}
+
+// Stop delivering. Deliveries left in the queue are posted on the next
+// start.
+func (self *Webhooks) Stop() {
+	if self == nil {
+		return
+	}
+	close(self.done)
+}
+
+// load the queue left by the previous run
+func (self *Webhooks) load() {
+
+	files, err := filepath.Glob(filepath.Join(self.path, "*.json"))
+	if err != nil {
+		log.Printf("error: webhooks: %s\n", err.Error())
+		return
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("error: webhooks: %s\n", err.Error())
+			continue
+		}
+		d := &webhookDelivery{}
+		if err = json.Unmarshal(data, d); err != nil || d.Id == "" {
+			log.Printf("error: webhooks: %s: invalid delivery\n", file)
+			os.Remove(file)
+			continue
+		}
+		self.queue = append(self.queue, d)
+		if id, err := strconv.ParseInt(d.Id, 10, 64); err == nil && id > self.last {
+			self.last = id
+		}
+	}
+
+	sort.Slice(self.queue, func(i, j int) bool {
+		return self.queue[i].Id < self.queue[j].Id
+	})
+
+	if len(self.queue) > 0 {
+		log.Printf("info: webhooks: %d queued deliveries\n", len(self.queue))
+	}
+}
+
+// notify the webhooks of an event, if it is one they are notified of
+func (self *Webhooks) notify(event string, data string) {
+
+	name, serviceId, ok := webhookEvent(event, data)
+	if !ok {
+		return
+	}
+
+	config := self.context.currentConfig()
+	if config == nil {
+		return
+	}
+
+	for i := range config.Webhooks {
+		hook := &config.Webhooks[i]
+		if hook.matches(name, serviceId) {
+			if err := self.enqueue(hook.URL, name, serviceId, data); err != nil {
+				log.Printf("error: webhooks: %s: %s\n", hook.URL, err.Error())
+			}
+		}
+	}
+}
+
+// enqueue a delivery, saving it before it is attempted
+func (self *Webhooks) enqueue(hookURL string, event string, serviceId string, data string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+
+	// ids are increasing, and order the queue across restarts
+	id := now.UnixNano()
+	if id <= self.last {
+		id = self.last + 1
+	}
+	self.last = id
+
+	payload, err := json.Marshal(&WebhookPayload{
+		Id:      strconv.FormatInt(id, 10),
+		Event:   event,
+		Service: serviceId,
+		Host:    self.host,
+		Time:    now,
+		Data:    json.RawMessage(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	d := &webhookDelivery{
+		Id:      strconv.FormatInt(id, 10),
+		URL:     hookURL,
+		Event:   event,
+		Due:     now,
+		Payload: payload,
+	}
+	if err = self.save(d); err != nil {
+		return err
+	}
+	self.queue = append(self.queue, d)
+
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dispatch the first queued delivery of each URL, if it is due and none
+// is being sent to the URL
+func (self *Webhooks) dispatch() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	first := map[string]bool{}
+
+	for _, d := range self.queue {
+		if first[d.URL] {
+			continue
+		}
+		first[d.URL] = true
+
+		if self.sending[d.URL] || d.Due.After(now) {
+			continue
+		}
+		self.sending[d.URL] = true
+		go self.deliver(d)
+	}
+}
+
+// deliver a notification, and retry it later or drop it if it failed
+func (self *Webhooks) deliver(d *webhookDelivery) {
+
+	var hook *WebhookConfig = nil
+	if config := self.context.currentConfig(); config != nil {
+		hook = config.webhook(d.URL)
+	}
+
+	var err error = nil
+	retry := false
+	if hook == nil {
+		err = errors.New("webhook removed")
+	} else {
+		retry, err = self.post(hook, d)
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.sending, d.URL)
+	d.Attempts++
+
+	switch {
+	case err == nil:
+		self.remove(d)
+	case !retry || d.Attempts >= webhookAttempts:
+		log.Printf("error: webhooks: %s: dropping %s %s after %d attempts: %s\n", d.URL, d.Event, d.Id, d.Attempts, err.Error())
+		self.remove(d)
+	default:
+		log.Printf("error: webhooks: %s: %s %s: %s\n", d.URL, d.Event, d.Id, err.Error())
+		d.Due = time.Now().Add(webhookDelay(d.Attempts))
+		if err = self.save(d); err != nil {
+			log.Printf("error: webhooks: %s\n", err.Error())
+		}
+	}
+
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+}
+
+// post a delivery. Returns whether a failed delivery may be retried.
+func (self *Webhooks) post(hook *WebhookConfig, d *webhookDelivery) (bool, error) {
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "minion")
+	req.Header.Set("X-Minion-Event", d.Event)
+	req.Header.Set("X-Minion-Delivery", d.Id)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(d.Payload)
+		req.Header.Set("X-Minion-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := self.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests:
+		return true, errors.New(res.Status)
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		return false, errors.New(res.Status)
+	default:
+		return true, errors.New(res.Status)
+	}
+}
+
+// save a delivery to the queue on disk
+func (self *Webhooks) save(d *webhookDelivery) error {
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	// the file is replaced, so a crash never leaves half a delivery
+	file := filepath.Join(self.path, d.Id+".json")
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// remove a delivery from the queue
+func (self *Webhooks) remove(d *webhookDelivery) {
+	for i, q := range self.queue {
+		if q == d {
+			self.queue = append(self.queue[:i], self.queue[i+1:]...)
+			break
+		}
+	}
+	if err := os.Remove(filepath.Join(self.path, d.Id+".json")); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: webhooks: %s\n", err.Error())
+	}
+}
+
+// ----------------------------------------------------------------------------
+//
+// Config Webhook Methods
+//
+// ----------------------------------------------------------------------------
+
+// webhook returns the configured webhook of `hookURL`
+func (self *Config) webhook(hookURL string) *WebhookConfig {
+	for i := range self.Webhooks {
+		if self.Webhooks[i].URL == hookURL {
+			return &self.Webhooks[i]
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+//
+// Functions
+//
+// ----------------------------------------------------------------------------
+
+// webhookEvent returns the webhook event and service of an event, if it
+// is one webhooks are notified of.
+//
+// A service is started or stopped when its start or stop completes, and
+// fails when an operation fails or it leaves the running state on its own.
+// Operations which were cancelled are notified as such, not as failures.
+func webhookEvent(event string, data string) (string, string, bool) {
+
+	switch event {
+	case "install":
+		e := InstallEvent{}
+		if json.Unmarshal([]byte(data), &e) != nil || e.Step != "complete" {
+			return "", "", false
+		}
+		return WebhookInstall, e.Id, true
+
+	case "lifecycle":
+		e := LifecycleEvent{}
+		if json.Unmarshal([]byte(data), &e) != nil {
+			return "", "", false
+		}
+		switch {
+		case e.From == service.Starting && (e.State == service.Running || e.State == service.Degraded):
+			return WebhookStart, e.Id, true
+		case e.From == service.Stopping && e.State == service.Stopped:
+			return WebhookStop, e.Id, true
+		case e.State == service.NotInstalled && e.From != service.Installing:
+			return WebhookRemove, e.Id, true
+		case e.State == service.Failed && (e.From == service.Running || e.From == service.Degraded):
+			return WebhookFailure, e.Id, true
+		}
+
+	case "error":
+		e := ErrorEvent{}
+		if json.Unmarshal([]byte(data), &e) != nil || e.Error == ErrorJobCancelled.Error() {
+			return "", "", false
+		}
+		return WebhookFailure, e.Id, true
+
+	case "job":
+		e := JobEvent{}
+		if json.Unmarshal([]byte(data), &e) != nil || e.State != JobCancelled || e.Service == "" {
+			return "", "", false
+		}
+		return WebhookCancel, e.Service, true
+
+	case "alert":
+		e := AlertEvent{}
+		if json.Unmarshal([]byte(data), &e) != nil {
+			return "", "", false
+		}
+		return WebhookAlert, e.Service, true
+	}
+
+	return "", "", false
+}
+
+// webhookDelay is the backoff after `attempts` failed attempts
+func webhookDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookBackoffMax {
+		delay = webhookBackoffMax
+	}
+	return delay
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
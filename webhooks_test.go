@@ -0,0 +1,241 @@
+package main
+
+import (
+	"github.com/aerospike-labs/minion/service"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A request received by a webhook
+type hookRequest struct {
+	path    string
+	header  http.Header
+	payload WebhookPayload
+	body    []byte
+}
+
+// A webhook receiver, answering each path with the statuses queued for
+// it, then 200
+type hookReceiver struct {
+	mutex    sync.Mutex
+	statuses map[string][]int
+	requests []hookRequest
+}
+
+func (self *hookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r := hookRequest{path: req.URL.Path, header: req.Header, body: body}
+	json.Unmarshal(body, &r.payload)
+
+	self.mutex.Lock()
+	self.requests = append(self.requests, r)
+	status := http.StatusOK
+	if queued := self.statuses[r.path]; len(queued) > 0 {
+		status, self.statuses[r.path] = queued[0], queued[1:]
+	}
+	self.mutex.Unlock()
+
+	w.WriteHeader(status)
+}
+
+// answer queues `statuses` for the requests to `path`
+func (self *hookReceiver) answer(path string, statuses ...int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.statuses[path] = statuses
+}
+
+// received returns the requests received since the last call
+func (self *hookReceiver) received() []hookRequest {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	requests := self.requests
+	self.requests = nil
+	return requests
+}
+
+// dispatchAll dispatches the due deliveries, and waits for them
+func dispatchAll(t *testing.T, hooks *Webhooks) {
+	t.Helper()
+
+	hooks.dispatch()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		hooks.mutex.Lock()
+		sending := len(hooks.sending)
+		hooks.mutex.Unlock()
+		if sending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("deliveries still sending")
+		}
+	}
+}
+
+// queued returns the queued deliveries, making them due
+func queued(hooks *Webhooks) []webhookDelivery {
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+
+	deliveries := []webhookDelivery{}
+	for _, d := range hooks.queue {
+		deliveries = append(deliveries, *d)
+		d.Due = time.Now()
+	}
+	return deliveries
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx := newTestContext(t)
+	receiver := &hookReceiver{statuses: map[string][]int{}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	ctx.SetConfig(&Config{Webhooks: []WebhookConfig{
+		{URL: server.URL + "/hook", Secret: "s3cret"},
+		{URL: server.URL + "/alerts", Events: []string{WebhookAlert}},
+	}})
+	path := filepath.Join(rootPath, "var", "webhooks")
+	os.MkdirAll(path, 0755)
+
+	hooks := NewWebhooks(ctx, path)
+	ctx.SendEventMessage = hooks.Forward(func(data, event, id string) {})
+
+	// signed with the secret of the webhook
+	sendEvent(ctx.SendEventMessage, "install", &InstallEvent{Id: "svc", Step: "complete"})
+	dispatchAll(t, hooks)
+
+	requests := receiver.received()
+	if len(requests) != 1 || requests[0].path != "/hook" || requests[0].payload.Event != WebhookInstall || requests[0].payload.Service != "svc" {
+		t.Fatalf("install: %+v", requests)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(requests[0].body)
+	if signature := requests[0].header.Get("X-Minion-Signature"); signature != hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("signature: %q", signature)
+	}
+
+	// server errors are retried, after a backoff
+	receiver.answer("/hook", http.StatusServiceUnavailable)
+	sendEvent(ctx.SendEventMessage, "lifecycle", &LifecycleEvent{Id: "svc", From: service.Stopping, State: service.Stopped})
+	dispatchAll(t, hooks)
+	first := receiver.received()
+
+	hooks.dispatch()
+	if requests := receiver.received(); len(first) != 1 || len(requests) != 0 {
+		t.Fatalf("retried before the backoff: %d, %d", len(first), len(requests))
+	}
+	deliveries := queued(hooks)
+	if len(deliveries) != 1 || deliveries[0].Attempts != 1 || time.Until(deliveries[0].Due) < webhookBackoff-time.Second {
+		t.Fatalf("queue after 503: %+v", deliveries)
+	}
+
+	dispatchAll(t, hooks)
+	requests = receiver.received()
+	if len(requests) != 1 || requests[0].header.Get("X-Minion-Delivery") != first[0].header.Get("X-Minion-Delivery") || requests[0].payload.Event != WebhookStop {
+		t.Fatalf("retry: %+v", requests)
+	}
+	if deliveries := queued(hooks); len(deliveries) != 0 {
+		t.Fatalf("queue after retry: %+v", deliveries)
+	}
+
+	// client errors are not retried
+	receiver.answer("/alerts", http.StatusBadRequest)
+	sendEvent(ctx.SendEventMessage, "alert", &AlertEvent{AlertState: AlertState{Rule: "high", Service: "svc", State: AlertFiring}})
+	dispatchAll(t, hooks)
+	if requests := receiver.received(); len(requests) != 2 {
+		t.Fatalf("alert: %d requests", len(requests))
+	}
+	if deliveries := queued(hooks); len(deliveries) != 0 {
+		t.Fatalf("queue after 400: %+v", deliveries)
+	}
+	if files, _ := filepath.Glob(filepath.Join(path, "*.json")); len(files) != 0 {
+		t.Fatalf("left on disk: %v", files)
+	}
+}
+
+// Queued deliveries are posted by the webhooks of the next start
+func TestWebhooksReload(t *testing.T) {
+	ctx := newTestContext(t)
+	receiver := &hookReceiver{statuses: map[string][]int{"/hook": {http.StatusBadGateway}}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	ctx.SetConfig(&Config{Webhooks: []WebhookConfig{{URL: server.URL + "/hook"}}})
+	path := filepath.Join(rootPath, "var", "webhooks")
+	os.MkdirAll(path, 0755)
+
+	hooks := NewWebhooks(ctx, path)
+	ctx.SendEventMessage = hooks.Forward(func(data, event, id string) {})
+	sendEvent(ctx.SendEventMessage, "error", &ErrorEvent{Id: "svc", Command: "start", Error: "exit status 1"})
+	dispatchAll(t, hooks)
+	hooks.Stop()
+
+	first := receiver.received()
+	if len(first) != 1 || first[0].payload.Event != WebhookFailure {
+		t.Fatalf("failure: %+v", first)
+	}
+
+	reloaded := NewWebhooks(ctx, path)
+	deliveries := queued(reloaded)
+	if len(deliveries) != 1 || deliveries[0].Attempts != 1 || deliveries[0].Id != first[0].payload.Id {
+		t.Fatalf("reloaded queue: %+v", deliveries)
+	}
+
+	dispatchAll(t, reloaded)
+	requests := receiver.received()
+	if len(requests) != 1 || requests[0].payload.Id != first[0].payload.Id {
+		t.Fatalf("after reload: %+v", requests)
+	}
+
+	// new deliveries are ordered after those loaded
+	ctx.SendEventMessage = reloaded.Forward(func(data, event, id string) {})
+	receiver.answer("/hook", http.StatusBadGateway)
+	sendEvent(ctx.SendEventMessage, "error", &ErrorEvent{Id: "svc", Command: "stop", Error: "exit status 1"})
+	if deliveries := queued(reloaded); len(deliveries) != 1 || deliveries[0].Id <= first[0].payload.Id {
+		t.Fatalf("new delivery: %+v", deliveries)
+	}
+}
+
+// Cancelled jobs are notified as cancelled, not failed
+func TestWebhooksCancel(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.SetConfig(&Config{Webhooks: []WebhookConfig{{URL: "http://127.0.0.1:1/hook"}}})
+	path := filepath.Join(rootPath, "var", "webhooks")
+	os.MkdirAll(path, 0755)
+
+	hooks := NewWebhooks(ctx, path)
+	ctx.SendEventMessage = hooks.Forward(func(data, event, id string) {})
+	ctx.Jobs.SendEventMessage = ctx.SendEventMessage
+
+	job := ctx.Jobs.start("svc", "install", func(job *Job) error {
+		<-job.Context().Done()
+		ctx.emitError("svc", "install", ErrorJobCancelled)
+		return ErrorJobCancelled
+	})
+	if err := job.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, ctx, job.Id())
+
+	deliveries := queued(hooks)
+	if len(deliveries) != 1 || deliveries[0].Event != WebhookCancel {
+		t.Fatalf("deliveries: %+v", deliveries)
+	}
+	var payload WebhookPayload
+	json.Unmarshal(deliveries[0].Payload, &payload)
+	if payload.Service != "svc" {
+		t.Fatalf("payload: %+v", payload)
+	}
+}